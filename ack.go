@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// the interval to send acknowledgements to socket inputs with -input-ack
+const ackInterval = time.Second
+
+var inputAck bool // -input-ack
+
+// inputAcker tells the sender of a socket input how many bytes of the stream are stored, by
+// sending "ACK <bytes>\n" lines back (-input-ack). A byte is acknowledged once all the
+// connections with events up to it are uploaded, so that the sender can resend the rest
+// after a crash for at-least-once delivery.
+type inputAcker struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	// connections that are not uploaded yet, with the offsets of their first events
+	pending map[*logEntry]int64
+	acked   int64
+}
+
+// newInputAcker returns an acker sending acknowledgements to writer, which is nil only to track
+// the stored offset, e.g. for -replay-offset-file
+func newInputAcker(writer io.Writer) *inputAcker {
+	return &inputAcker{
+		writer:  writer,
+		pending: make(map[*logEntry]int64),
+	}
+}
+
+// track holds acknowledgements from the offset until the entry is uploaded.
+// It does nothing if acker is nil.
+func (acker *inputAcker) track(entry *logEntry, offset int64) {
+	if acker == nil {
+		return
+	}
+	acker.mutex.Lock()
+	acker.pending[entry] = offset
+	acker.mutex.Unlock()
+}
+
+// release is called when the entry is uploaded. It does nothing if acker is nil.
+func (acker *inputAcker) release(entry *logEntry) {
+	if acker == nil {
+		return
+	}
+	acker.mutex.Lock()
+	delete(acker.pending, entry)
+	acker.mutex.Unlock()
+}
+
+// storedOffset returns the offset up to which the stream is stored, given the offset of processed
+// lines, i.e. the smallest offset of the first events of the connections not uploaded yet
+func (acker *inputAcker) storedOffset(processed int64) int64 {
+	acker.mutex.Lock()
+	defer acker.mutex.Unlock()
+	offset := processed
+	for _, pendingOffset := range acker.pending {
+		if pendingOffset < offset {
+			offset = pendingOffset
+		}
+	}
+	return offset
+}
+
+// ack sends the offset up to which the stream is stored, given the offset of processed lines
+func (acker *inputAcker) ack(processed int64) error {
+	offset := acker.storedOffset(processed)
+	acker.mutex.Lock()
+	if offset <= acker.acked {
+		acker.mutex.Unlock()
+		return nil
+	}
+	acker.acked = offset
+	acker.mutex.Unlock()
+
+	_, err := fmt.Fprintf(acker.writer, "ACK %d\n", offset)
+	return err
+}
+
+// start sends acknowledgements of the source periodically. The returned function stops it
+// after sending the last acknowledgement.
+func (acker *inputAcker) start(source *inputSource) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(ackInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := acker.ack(source.processedOffset()); err != nil {
+					log.Printf("Cannot acknowledge %s: %v", source.name, err)
+					return
+				}
+			case <-done:
+				acker.ack(source.processedOffset())
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
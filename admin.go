@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	json "github.com/goccy/go-json"
+)
+
+// serveAdmin serves the admin API in background (-admin-addr):
+//
+//	POST /snapshot?conn=$conn_id[&source=$source] or ?dcid=$dcid
+//
+// uploads snapshots of the matching live connections without finalizing them, and responds
+// with the names of the objects. The listener is handed off by soft restart.
+func serveAdmin(ctx context.Context, addr string, storage *storageManager) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		var connID int64 = -1
+		if conn := query.Get("conn"); conn != "" {
+			var err error
+			connID, err = strconv.ParseInt(conn, 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid conn: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		dcid := query.Get("dcid")
+		if (connID < 0) == (dcid == "") {
+			http.Error(w, "Either conn or dcid is required", http.StatusBadRequest)
+			return
+		}
+
+		objectNames := snapshotConns(ctx, storage, connID, query.Get("source"), dcid)
+		if len(objectNames) == 0 {
+			http.Error(w, "No live connection is found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"objects": objectNames})
+	})
+	listener, err := softRestart.listen("tcp", addr, nil)
+	if err != nil {
+		log.Fatalf("Cannot serve the admin API at %s: %v", addr, err)
+	}
+	go func() {
+		defer softRestart.stopListening()
+		err := http.Serve(listener, mux)
+		if err != nil && !softRestart.startedHandoff() {
+			log.Fatalf("Cannot serve the admin API at %s: %v", addr, err)
+		}
+	}()
+}
+
+// snapshotConns uploads snapshots of the live connections of connID in the source, or in any
+// source if it's empty, or those of dcid if connID is negative, and returns the object names.
+// Unlike flushAll, snapshots are named after the time of the request, so that final objects
+// don't overwrite them.
+func snapshotConns(ctx context.Context, storage *storageManager, connID int64, source string, dcid string) []string {
+	var snapshots []*logEntry
+	snapshotTime := now().UnixNano() / int64(time.Millisecond)
+
+	connsMutex.Lock()
+	for _, key := range connToLogs.Keys() {
+		value, ok := connToLogs.Peek(key)
+		if !ok {
+			continue
+		}
+		entry := value.(*logEntry)
+		if entry.processed || len(entry.events) == 0 || entry.awaitingFilter() {
+			continue
+		}
+		if connID >= 0 {
+			if entry.connID != connID || (source != "" && entry.source.name != source) {
+				continue
+			}
+		} else if entry.nameEvent == nil || fmt.Sprint(entry.nameEvent["dcid"]) != dcid {
+			continue
+		}
+
+		// the analyzers, the events, and the other fields that the connection keeps updating are
+		// copied, as the connection continues during the upload
+		analyzers, err := freezeAnalyzers(entry.analyzers)
+		if err != nil {
+			log.Printf("Cannot snapshot connID=%d: %v", entry.connID, err)
+			continue
+		}
+		snapshot := *entry
+		snapshot.analyzers = analyzers
+		snapshot.events = entry.events[:len(entry.events):len(entry.events)]
+		snapshot.fieldDictionary = entry.fieldDictionary.clone()
+		snapshot.duplicateAccepts = append([]duplicateAccept(nil), entry.duplicateAccepts...)
+		snapshot.downstreamObjects = append([]string(nil), entry.downstreamObjects...)
+		snapshot.upstreamObjects = append([]string(nil), entry.upstreamObjects...)
+		snapshot.incomplete = true
+		snapshot.snapshotTime = snapshotTime
+		snapshots = append(snapshots, &snapshot)
+	}
+	connsMutex.Unlock()
+
+	objectNames := make([]string, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		latch := &sync.WaitGroup{}
+		latch.Add(1)
+		record := uploadEvents(ctx, latch, storage, snapshot)
+		if record.Result != "ok" {
+			log.Printf("Failed to upload a snapshot of connID=%d: %s", snapshot.connID, record.Result)
+			continue
+		}
+		log.Printf("Uploaded a snapshot of connID=%d as \"%s\"", snapshot.connID, record.ObjectName)
+		objectNames = append(objectNames, record.ObjectName)
+	}
+	return objectNames
+}
+
+// snapshotObjectName returns the name of a snapshot by the admin API
+func snapshotObjectName(objectName string, snapshotTime int64) string {
+	return fmt.Sprintf("%s-snapshot%d", objectName, snapshotTime)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	json "github.com/goccy/go-json"
+)
+
+// An analyzer derives connection-level statistics from events. Each analyzer is
+// created per connection, and the JSON fields of its result are flattened into
+// the root schema.
+type analyzer interface {
+	// update accumulates an event
+	update(eventType interface{}, rawEvent h2ologEvent)
+	// result computes the derived fields and returns a value to serialize as JSON
+	result() interface{}
+}
+
+// An analyzer with unexported state implements handoffAnalyzer to hand it off to the new process
+// on soft restart. The state of the others is their JSON fields.
+type handoffAnalyzer interface {
+	// handoffState returns a value to serialize as JSON with all the state of the analyzer
+	handoffState() interface{}
+	// restoreState restores the state serialized by handoffState
+	restoreState(data []byte) error
+}
+
+type analyzerModule struct {
+	name        string
+	newAnalyzer func() analyzer
+	disabled    bool
+}
+
+// analyzer modules in the order of registration, which is the order of fields in the root schema
+var analyzerModules = make([]analyzerModule, 0)
+
+// registerAnalyzer registers an analyzer module, typically in init()
+func registerAnalyzer(name string, newAnalyzer func() analyzer) {
+	analyzerModules = append(analyzerModules, analyzerModule{
+		name:        name,
+		newAnalyzer: newAnalyzer,
+	})
+}
+
+// newAnalyzers creates an instance of each analyzer module for a connection
+func newAnalyzers() []analyzer {
+	analyzers := make([]analyzer, 0, len(analyzerModules))
+	for _, module := range analyzerModules {
+		if !module.disabled {
+			analyzers = append(analyzers, module.newAnalyzer())
+		}
+	}
+	return analyzers
+}
+
+// disableAnalyzers disables analyzer modules by comma-separated names (-disable-analyzers)
+func disableAnalyzers(names string) error {
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for i := range analyzerModules {
+			if analyzerModules[i].name == name {
+				analyzerModules[i].disabled = true
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown analyzer '%s' (available: %s)", name, strings.Join(analyzerNames(), ","))
+		}
+	}
+	return nil
+}
+
+func analyzerNames() []string {
+	names := make([]string, 0, len(analyzerModules))
+	for _, module := range analyzerModules {
+		names = append(names, module.name)
+	}
+	return names
+}
+
+// eventInt64 returns the integer field of the event
+func eventInt64(rawEvent h2ologEvent, key string) (int64, bool) {
+	number, ok := rawEvent[key].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	value, err := number.Int64()
+	return value, err == nil
+}
+
+// parseLongHeader returns the first byte and the version of a long header packet in hex
+func parseLongHeader(packet string) (byte, uint32, bool) {
+	if len(packet) < 10 {
+		return 0, 0, false
+	}
+	header, err := hex.DecodeString(packet[:10])
+	if err != nil || header[0]&0x80 == 0 {
+		// not a long header packet
+		return 0, 0, false
+	}
+	version := uint32(header[1])<<24 | uint32(header[2])<<16 | uint32(header[3])<<8 | uint32(header[4])
+	return header[0], version, true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	json "github.com/goccy/go-json"
+)
+
+func init() {
+	registerAnalyzer("anomaly", func() analyzer { return &anomalyAnalyzer{} })
+}
+
+// thresholds of anomalyAnalyzer
+const (
+	// QUIC servers must not send more than three times the bytes received before address validation
+	amplificationFactor = 3
+	// the min number of RESET_STREAM frames to be excessive, if they are also most of the streams
+	excessiveStreamResets = 10
+)
+
+// anomalyAnalyzer flags connections with patterns of abuse
+type anomalyAnalyzer struct {
+	// bytes of datagrams received and packets sent before the handshake completes
+	bytesReceived int64
+	bytesSent     int64
+	handshakeDone bool
+
+	numStreams      int
+	numStreamResets int
+}
+
+type anomalyResult struct {
+	// "amplification" if the handshake didn't complete and the sent bytes exceed the limit of
+	// amplification, and "excessive_resets" if most of many streams are reset
+	Anomalies []string `json:"anomalies"`
+}
+
+func (a *anomalyAnalyzer) update(eventType interface{}, rawEvent h2ologEvent) {
+	switch eventType {
+	case "receive": // quicly:receive
+		if !a.handshakeDone {
+			length, _ := eventInt64(rawEvent, "bytes-len")
+			a.bytesReceived += length
+		}
+	case "packet-sent": // quicly:packet_sent
+		if !a.handshakeDone {
+			length, _ := eventInt64(rawEvent, "len")
+			a.bytesSent += length
+		}
+	case "handshake-done-send", "handshake-done-receive": // quicly:handshake_done_send, quicly:handshake_done_receive
+		a.handshakeDone = true
+	case "stream-on-open": // quicly:stream_on_open
+		a.numStreams++
+	case "reset-stream-send", "reset-stream-receive": // quicly:reset_stream_send, quicly:reset_stream_receive
+		a.numStreamResets++
+	}
+}
+
+func (a *anomalyAnalyzer) anomalies() []string {
+	anomalies := make([]string, 0)
+	if !a.handshakeDone && a.bytesReceived > 0 && a.bytesSent > a.bytesReceived*amplificationFactor {
+		anomalies = append(anomalies, "amplification")
+	}
+	if a.numStreamResets >= excessiveStreamResets && a.numStreamResets*2 >= a.numStreams {
+		anomalies = append(anomalies, "excessive_resets")
+	}
+	return anomalies
+}
+
+func (a *anomalyAnalyzer) result() interface{} {
+	return &anomalyResult{Anomalies: a.anomalies()}
+}
+
+// anomaliesOf returns the anomalies flagged in the entry
+func anomaliesOf(entry *logEntry) []string {
+	for _, analyzer := range entry.analyzers {
+		if a, ok := analyzer.(*anomalyAnalyzer); ok {
+			return a.anomalies()
+		}
+	}
+	return nil
+}
+
+// anomalyState is the state of anomalyAnalyzer handed off on soft restart
+type anomalyState struct {
+	BytesReceived   int64 `json:"bytes_received"`
+	BytesSent       int64 `json:"bytes_sent"`
+	HandshakeDone   bool  `json:"handshake_done"`
+	NumStreams      int   `json:"num_streams"`
+	NumStreamResets int   `json:"num_stream_resets"`
+}
+
+func (a *anomalyAnalyzer) handoffState() interface{} {
+	return &anomalyState{a.bytesReceived, a.bytesSent, a.handshakeDone, a.numStreams, a.numStreamResets}
+}
+
+func (a *anomalyAnalyzer) restoreState(data []byte) error {
+	var state anomalyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	*a = anomalyAnalyzer{state.BytesReceived, state.BytesSent, state.HandshakeDone, state.NumStreams, state.NumStreamResets}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+func init() {
+	registerAnalyzer("close", func() analyzer { return &closeAnalyzer{} })
+}
+
+// closeAnalyzer extracts the reason why the connection was closed
+type closeAnalyzer struct {
+	// who closed the connection: "local", "peer", "idle-timeout" or "stateless-reset"; empty if unknown
+	CloseInitiator string `json:"close_initiator,omitempty"`
+	// "transport" or "application" for CONNECTION_CLOSE frames
+	CloseType string `json:"close_type,omitempty"`
+	// the error code of the CONNECTION_CLOSE frame
+	CloseErrorCode int64 `json:"close_error_code"`
+	// the frame type of the transport CONNECTION_CLOSE frame
+	CloseFrameType int64 `json:"close_frame_type"`
+	// the reason phrase of the CONNECTION_CLOSE frame
+	CloseReason string `json:"close_reason,omitempty"`
+}
+
+func (a *closeAnalyzer) update(eventType interface{}, rawEvent h2ologEvent) {
+	switch eventType {
+	case "transport-close-send": // quicly:transport_close_send
+		a.updateClose("local", "transport", rawEvent)
+	case "transport-close-receive": // quicly:transport_close_receive
+		a.updateClose("peer", "transport", rawEvent)
+	case "application-close-send": // quicly:application_close_send
+		a.updateClose("local", "application", rawEvent)
+	case "application-close-receive": // quicly:application_close_receive
+		a.updateClose("peer", "application", rawEvent)
+	case "idle-timeout": // quicly:idle_timeout
+		a.updateClose("idle-timeout", "", rawEvent)
+	case "stateless-reset-receive": // quicly:stateless_reset_receive
+		a.updateClose("stateless-reset", "", rawEvent)
+	}
+}
+
+// updateClose records the first close of the connection
+func (a *closeAnalyzer) updateClose(initiator string, closeType string, rawEvent h2ologEvent) {
+	if a.CloseInitiator != "" {
+		return
+	}
+	a.CloseInitiator = initiator
+	a.CloseType = closeType
+	a.CloseErrorCode, _ = eventInt64(rawEvent, "error-code")
+	a.CloseFrameType, _ = eventInt64(rawEvent, "frame-type")
+	a.CloseReason, _ = rawEvent["reason-phrase"].(string)
+}
+
+func (a *closeAnalyzer) result() interface{} {
+	return a
+}
@@ -0,0 +1,31 @@
+package main
+
+func init() {
+	registerAnalyzer("datagram", func() analyzer { return &datagramAnalyzer{} })
+}
+
+// datagramAnalyzer counts DATAGRAM frames
+type datagramAnalyzer struct {
+	// DATAGRAM frames sent and received, and their payload bytes
+	NumDatagramsSent      int   `json:"num_datagrams_sent"`
+	NumDatagramsReceived  int   `json:"num_datagrams_received"`
+	DatagramBytesSent     int64 `json:"datagram_bytes_sent"`
+	DatagramBytesReceived int64 `json:"datagram_bytes_received"`
+}
+
+func (a *datagramAnalyzer) update(eventType interface{}, rawEvent h2ologEvent) {
+	switch eventType {
+	case "datagram-frame-send": // quicly:datagram_frame_send
+		a.NumDatagramsSent++
+		length, _ := eventInt64(rawEvent, "payload-len")
+		a.DatagramBytesSent += length
+	case "datagram-frame-receive": // quicly:datagram_frame_receive
+		a.NumDatagramsReceived++
+		length, _ := eventInt64(rawEvent, "payload-len")
+		a.DatagramBytesReceived += length
+	}
+}
+
+func (a *datagramAnalyzer) result() interface{} {
+	return a
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	json "github.com/goccy/go-json"
+)
+
+func init() {
+	registerAnalyzer("goodput", func() analyzer { return &goodputAnalyzer{} })
+}
+
+// the width of windows to compute PeakGoodputBps
+const goodputWindowMillis = 100
+
+// goodputAnalyzer estimates the bandwidth from application stream bytes acked by the peer
+type goodputAnalyzer struct {
+	// bytes of application streams acked by the peer, from quicly:stream_acked
+	GoodputBytes int64 `json:"goodput_bytes"`
+	// GoodputBytes per second over the connection lifetime
+	AvgGoodputBps int64 `json:"avg_goodput_bps"`
+	// the max goodput per second in a window of goodputWindowMillis
+	PeakGoodputBps int64 `json:"peak_goodput_bps"`
+
+	// the time of the first and the last event
+	firstTime int64
+	lastTime  int64
+	// the start of the current window and the bytes acked in it
+	windowStart int64
+	windowBytes int64
+}
+
+func (a *goodputAnalyzer) update(eventType interface{}, rawEvent h2ologEvent) {
+	timeMillis, _ := eventInt64(rawEvent, "time")
+	if timeMillis > 0 {
+		if a.firstTime == 0 {
+			a.firstTime = timeMillis
+		}
+		a.lastTime = timeMillis
+	}
+
+	if eventType == "stream-acked" { // quicly:stream_acked
+		streamID, _ := eventInt64(rawEvent, "stream-id")
+		if length, ok := eventInt64(rawEvent, "len"); ok && streamID >= 0 {
+			a.GoodputBytes += length
+			if timeMillis-a.windowStart >= goodputWindowMillis {
+				a.closeWindow()
+				a.windowStart = timeMillis
+			}
+			a.windowBytes += length
+		}
+	}
+}
+
+func (a *goodputAnalyzer) closeWindow() {
+	a.PeakGoodputBps = a.peakGoodputBps()
+	a.windowBytes = 0
+}
+
+// peakGoodputBps returns PeakGoodputBps including the current window
+func (a *goodputAnalyzer) peakGoodputBps() int64 {
+	if bps := a.windowBytes * 1000 / goodputWindowMillis; bps > a.PeakGoodputBps {
+		return bps
+	}
+	return a.PeakGoodputBps
+}
+
+// result returns a copy with the current window, leaving the state of the connection, which
+// may continue after snapshots, as it is
+func (a *goodputAnalyzer) result() interface{} {
+	result := *a
+	result.PeakGoodputBps = a.peakGoodputBps()
+	if duration := a.lastTime - a.firstTime; duration > 0 {
+		result.AvgGoodputBps = a.GoodputBytes * 1000 / duration
+	}
+	return &result
+}
+
+// goodputState is the state of goodputAnalyzer handed off on soft restart
+type goodputState struct {
+	goodputAnalyzer
+	FirstTime   int64 `json:"first_time"`
+	LastTime    int64 `json:"last_time"`
+	WindowStart int64 `json:"window_start"`
+	WindowBytes int64 `json:"window_bytes"`
+}
+
+func (a *goodputAnalyzer) handoffState() interface{} {
+	return &goodputState{*a, a.firstTime, a.lastTime, a.windowStart, a.windowBytes}
+}
+
+func (a *goodputAnalyzer) restoreState(data []byte) error {
+	var state goodputState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	*a = state.goodputAnalyzer
+	a.firstTime, a.lastTime, a.windowStart, a.windowBytes = state.FirstTime, state.LastTime, state.WindowStart, state.WindowBytes
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	json "github.com/goccy/go-json"
+)
+
+func init() {
+	registerAnalyzer("idle", func() analyzer { return &idleAnalyzer{} })
+}
+
+// idleAnalyzer detects long gaps between events
+type idleAnalyzer struct {
+	// the number of gaps between events longer than -idle-gap-threshold
+	NumIdleGaps int `json:"num_idle_gaps"`
+	// the longest gap between events in milliseconds
+	LongestIdleGapMillis int64 `json:"longest_idle_gap_ms"`
+
+	// the time of the last event
+	lastTime int64
+}
+
+func (a *idleAnalyzer) update(eventType interface{}, rawEvent h2ologEvent) {
+	timeMillis, _ := eventInt64(rawEvent, "time")
+	if timeMillis <= 0 {
+		return
+	}
+	if a.lastTime != 0 {
+		gapMillis := timeMillis - a.lastTime
+		if gapMillis > a.LongestIdleGapMillis {
+			a.LongestIdleGapMillis = gapMillis
+		}
+		if gapMillis >= idleGapThreshold.Milliseconds() {
+			a.NumIdleGaps++
+		}
+	}
+	a.lastTime = timeMillis
+}
+
+func (a *idleAnalyzer) result() interface{} {
+	return a
+}
+
+// idleState is the state of idleAnalyzer handed off on soft restart
+type idleState struct {
+	idleAnalyzer
+	LastTime int64 `json:"last_time"`
+}
+
+func (a *idleAnalyzer) handoffState() interface{} {
+	return &idleState{*a, a.lastTime}
+}
+
+func (a *idleAnalyzer) restoreState(data []byte) error {
+	var state idleState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	*a = state.idleAnalyzer
+	a.lastTime = state.LastTime
+	return nil
+}
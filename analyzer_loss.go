@@ -0,0 +1,237 @@
+package main
+
+import (
+	"math/bits"
+	"sort"
+
+	json "github.com/goccy/go-json"
+)
+
+func init() {
+	registerAnalyzer("loss", func() analyzer {
+		return &lossAnalyzer{
+			sentTimes:         make(map[sentPacket]int64),
+			largestReceivedPn: make(map[int64]int64),
+		}
+	})
+}
+
+// the number of epochs in "packet-type" of quicly: initial, 0-RTT, handshake, and 1-RTT
+const numPacketTypes = 4
+
+// the max number of packets waiting for quicly:packet_acked or quicly:packet_lost
+const maxPendingSentPackets = 8192
+
+// lossAnalyzer computes ack delays, losses and packet number gaps
+type lossAnalyzer struct {
+	// percentiles of ACK Delay reported by the peer, from quicly:ack_delay_received, in milliseconds
+	AckDelayP50 int64 `json:"ack_delay_p50"`
+	AckDelayP90 int64 `json:"ack_delay_p90"`
+	AckDelayP99 int64 `json:"ack_delay_p99"`
+	// percentiles of the time from quicly:packet_sent to quicly:packet_acked in milliseconds
+	SentToAckedP50 int64 `json:"sent_to_acked_p50"`
+	SentToAckedP90 int64 `json:"sent_to_acked_p90"`
+	SentToAckedP99 int64 `json:"sent_to_acked_p99"`
+	// the number of packets declared lost, from quicly:packet_lost
+	NumLostPackets int `json:"num_lost_packets"`
+	// the number of gaps in packet numbers of quicly:packet_received
+	NumReceivedPnGaps int `json:"num_received_pn_gaps"`
+	// the number of packets received with a packet number lower than the largest one
+	NumReorderedPackets int `json:"num_reordered_packets"`
+
+	// the time of quicly:packet_sent of packets waiting for acks
+	sentTimes   map[sentPacket]int64
+	ackDelays   latencyHistogram
+	sentToAcked latencyHistogram
+	// packet-type -> the largest pn of quicly:packet_received, as each packet number space has its own sequence
+	largestReceivedPn map[int64]int64
+}
+
+// a sent packet, whose packet number is unique in the packet number space of the packet type
+type sentPacket struct {
+	packetType int64
+	pn         int64
+}
+
+func (a *lossAnalyzer) update(eventType interface{}, rawEvent h2ologEvent) {
+	timeMillis, _ := eventInt64(rawEvent, "time")
+
+	switch eventType {
+	case "packet-sent": // quicly:packet_sent
+		ackOnly, _ := eventInt64(rawEvent, "ack-only")
+		// ack-only packets are never acked
+		if pn, ok := eventInt64(rawEvent, "pn"); ok && ackOnly == 0 && len(a.sentTimes) < maxPendingSentPackets {
+			packetType, _ := eventInt64(rawEvent, "packet-type")
+			a.sentTimes[sentPacket{packetType, pn}] = timeMillis
+		}
+	case "packet-acked": // quicly:packet_acked
+		if packet, ok := a.sentPacketOf(rawEvent); ok {
+			a.sentToAcked.add(timeMillis - a.sentTimes[packet])
+			delete(a.sentTimes, packet)
+		}
+	case "packet-lost": // quicly:packet_lost
+		a.NumLostPackets++
+		if packet, ok := a.sentPacketOf(rawEvent); ok {
+			delete(a.sentTimes, packet)
+		}
+	case "ack-delay-received": // quicly:ack_delay_received
+		if ackDelay, ok := eventInt64(rawEvent, "ack-delay"); ok {
+			a.ackDelays.add(ackDelay)
+		}
+	case "packet-received": // quicly:packet_received
+		if pn, ok := eventInt64(rawEvent, "pn"); ok {
+			packetType, _ := eventInt64(rawEvent, "packet-type")
+			a.updateReceivedPn(packetType, pn)
+		}
+	}
+}
+
+// sentPacketOf returns the sent packet of the pn of an event. As quicly:packet_acked has no
+// packet-type, the packet is looked up in all the spaces, and ambiguous ones are not resolved.
+func (a *lossAnalyzer) sentPacketOf(rawEvent h2ologEvent) (sentPacket, bool) {
+	pn, ok := eventInt64(rawEvent, "pn")
+	if !ok {
+		return sentPacket{}, false
+	}
+	if packetType, ok := eventInt64(rawEvent, "packet-type"); ok {
+		packet := sentPacket{packetType, pn}
+		_, ok := a.sentTimes[packet]
+		return packet, ok
+	}
+	var found sentPacket
+	numFound := 0
+	for packetType := int64(0); packetType < numPacketTypes; packetType++ {
+		packet := sentPacket{packetType, pn}
+		if _, ok := a.sentTimes[packet]; ok {
+			found = packet
+			numFound++
+		}
+	}
+	return found, numFound == 1
+}
+
+func (a *lossAnalyzer) updateReceivedPn(packetType int64, pn int64) {
+	largest, ok := a.largestReceivedPn[packetType]
+	if !ok {
+		// packet numbers may not start from zero in a space
+		a.largestReceivedPn[packetType] = pn
+		return
+	}
+	if pn < largest {
+		a.NumReorderedPackets++
+		return
+	}
+	if pn > largest+1 {
+		a.NumReceivedPnGaps++
+	}
+	a.largestReceivedPn[packetType] = pn
+}
+
+// result returns a copy with the percentiles, as the connection may continue after snapshots
+func (a *lossAnalyzer) result() interface{} {
+	result := *a
+	result.AckDelayP50 = a.ackDelays.percentile(50)
+	result.AckDelayP90 = a.ackDelays.percentile(90)
+	result.AckDelayP99 = a.ackDelays.percentile(99)
+	result.SentToAckedP50 = a.sentToAcked.percentile(50)
+	result.SentToAckedP90 = a.sentToAcked.percentile(90)
+	result.SentToAckedP99 = a.sentToAcked.percentile(99)
+	return &result
+}
+
+// latencyHistogram counts values in buckets of 1/16 precision, so that its size is bounded
+// however long the connection lives
+type latencyHistogram struct {
+	counts map[int64]int
+	total  int
+}
+
+// the number of bits of the buckets of latencyHistogram, below which values are exact
+const latencyHistogramBits = 5
+
+func (histogram *latencyHistogram) add(value int64) {
+	if value < 0 {
+		value = 0
+	}
+	if shift := bits.Len64(uint64(value)) - latencyHistogramBits; shift > 0 {
+		value = value >> shift << shift
+	}
+	if histogram.counts == nil {
+		histogram.counts = make(map[int64]int)
+	}
+	histogram.counts[value]++
+	histogram.total++
+}
+
+// percentile returns the lower bound of the bucket of the p-th percentile, or 0 if empty
+func (histogram *latencyHistogram) percentile(p int) int64 {
+	if histogram.total == 0 {
+		return 0
+	}
+	buckets := make([]int64, 0, len(histogram.counts))
+	for bucket := range histogram.counts {
+		buckets = append(buckets, bucket)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	rank := (histogram.total*p + 99) / 100
+	count := 0
+	for _, bucket := range buckets {
+		count += histogram.counts[bucket]
+		if count >= rank {
+			return bucket
+		}
+	}
+	return buckets[len(buckets)-1]
+}
+
+// lossState is the state of lossAnalyzer handed off on soft restart
+type lossState struct {
+	lossAnalyzer
+	// [packet-type, pn, time] of the packets waiting for acks
+	SentTimes         [][3]int64      `json:"sent_times"`
+	AckDelays         map[int64]int   `json:"ack_delays"`
+	SentToAcked       map[int64]int   `json:"sent_to_acked"`
+	LargestReceivedPn map[int64]int64 `json:"largest_received_pn"`
+}
+
+func (a *lossAnalyzer) handoffState() interface{} {
+	state := &lossState{
+		lossAnalyzer:      *a,
+		SentTimes:         make([][3]int64, 0, len(a.sentTimes)),
+		AckDelays:         a.ackDelays.counts,
+		SentToAcked:       a.sentToAcked.counts,
+		LargestReceivedPn: a.largestReceivedPn,
+	}
+	for packet, timeMillis := range a.sentTimes {
+		state.SentTimes = append(state.SentTimes, [3]int64{packet.packetType, packet.pn, timeMillis})
+	}
+	return state
+}
+
+func (a *lossAnalyzer) restoreState(data []byte) error {
+	var state lossState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	*a = state.lossAnalyzer
+	a.sentTimes = make(map[sentPacket]int64, len(state.SentTimes))
+	for _, sent := range state.SentTimes {
+		a.sentTimes[sentPacket{sent[0], sent[1]}] = sent[2]
+	}
+	a.ackDelays = newLatencyHistogram(state.AckDelays)
+	a.sentToAcked = newLatencyHistogram(state.SentToAcked)
+	a.largestReceivedPn = state.LargestReceivedPn
+	if a.largestReceivedPn == nil {
+		a.largestReceivedPn = make(map[int64]int64)
+	}
+	return nil
+}
+
+// newLatencyHistogram returns a histogram of the counts by bucket
+func newLatencyHistogram(counts map[int64]int) latencyHistogram {
+	histogram := latencyHistogram{counts: counts}
+	for _, count := range counts {
+		histogram.total += count
+	}
+	return histogram
+}
@@ -0,0 +1,33 @@
+package main
+
+func init() {
+	registerAnalyzer("rtt", func() analyzer { return &rttAnalyzer{} })
+}
+
+// rttAnalyzer records RTT estimates of the congestion controller
+type rttAnalyzer struct {
+	// the latest estimates in milliseconds, from quicly:quictrace_cc_ack
+	MinRTT      int64 `json:"min_rtt"`
+	SmoothedRTT int64 `json:"smoothed_rtt"`
+	// the max of quicly:quictrace_cc_ack.latest-rtt in milliseconds
+	MaxLatestRTT int64 `json:"max_latest_rtt"`
+}
+
+func (a *rttAnalyzer) update(eventType interface{}, rawEvent h2ologEvent) {
+	if eventType != "quictrace-cc-ack" { // quicly:quictrace_cc_ack
+		return
+	}
+	if minRTT, ok := eventInt64(rawEvent, "min-rtt"); ok {
+		a.MinRTT = minRTT
+	}
+	if smoothedRTT, ok := eventInt64(rawEvent, "smoothed-rtt"); ok {
+		a.SmoothedRTT = smoothedRTT
+	}
+	if latestRTT, ok := eventInt64(rawEvent, "latest-rtt"); ok && latestRTT > a.MaxLatestRTT {
+		a.MaxLatestRTT = latestRTT
+	}
+}
+
+func (a *rttAnalyzer) result() interface{} {
+	return a
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	json "github.com/goccy/go-json"
+)
+
+func init() {
+	registerAnalyzer("streams", func() analyzer { return &streamsAnalyzer{} })
+}
+
+// streamsAnalyzer computes stream concurrency and resets
+type streamsAnalyzer struct {
+	// the number of streams opened, from quicly:stream_on_open
+	NumStreams int `json:"num_streams"`
+	// the max number of streams open at the same time
+	MaxConcurrentStreams int `json:"max_concurrent_streams"`
+	// the number of RESET_STREAM frames sent and received
+	NumStreamResets int `json:"num_stream_resets"`
+
+	// the number of streams open now
+	numOpenStreams int
+}
+
+func (a *streamsAnalyzer) update(eventType interface{}, rawEvent h2ologEvent) {
+	switch eventType {
+	case "stream-on-open": // quicly:stream_on_open
+		// negative stream IDs are internal ones of quicly, e.g. for crypto streams
+		if streamID, ok := eventInt64(rawEvent, "stream-id"); ok && streamID >= 0 {
+			a.NumStreams++
+			a.numOpenStreams++
+			if a.numOpenStreams > a.MaxConcurrentStreams {
+				a.MaxConcurrentStreams = a.numOpenStreams
+			}
+		}
+	case "stream-on-destroy": // quicly:stream_on_destroy
+		if streamID, ok := eventInt64(rawEvent, "stream-id"); ok && streamID >= 0 && a.numOpenStreams > 0 {
+			a.numOpenStreams--
+		}
+	case "reset-stream-send", "reset-stream-receive": // quicly:reset_stream_send, quicly:reset_stream_receive
+		a.NumStreamResets++
+	}
+}
+
+func (a *streamsAnalyzer) result() interface{} {
+	return a
+}
+
+// streamsState is the state of streamsAnalyzer handed off on soft restart
+type streamsState struct {
+	streamsAnalyzer
+	NumOpenStreams int `json:"num_open_streams"`
+}
+
+func (a *streamsAnalyzer) handoffState() interface{} {
+	return &streamsState{*a, a.numOpenStreams}
+}
+
+func (a *streamsAnalyzer) restoreState(data []byte) error {
+	var state streamsState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	*a = state.streamsAnalyzer
+	a.numOpenStreams = state.NumOpenStreams
+	return nil
+}
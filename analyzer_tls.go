@@ -0,0 +1,26 @@
+package main
+
+func init() {
+	registerAnalyzer("tls", func() analyzer { return &tlsAnalyzer{} })
+}
+
+// tlsAnalyzer records the TLS handshake and key updates
+type tlsAnalyzer struct {
+	// the last return value of quicly:crypto_handshake, where 0 means success
+	HandshakeResult int64 `json:"handshake_result"`
+	// the number of key updates, from quicly:crypto_send_key_update and quicly:crypto_receive_key_update
+	NumKeyUpdates int `json:"num_key_updates"`
+}
+
+func (a *tlsAnalyzer) update(eventType interface{}, rawEvent h2ologEvent) {
+	switch eventType {
+	case "crypto-handshake": // quicly:crypto_handshake
+		a.HandshakeResult, _ = eventInt64(rawEvent, "ret")
+	case "crypto-send-key-update", "crypto-receive-key-update": // quicly:crypto_send_key_update, quicly:crypto_receive_key_update
+		a.NumKeyUpdates++
+	}
+}
+
+func (a *tlsAnalyzer) result() interface{} {
+	return a
+}
@@ -0,0 +1,38 @@
+package main
+
+func init() {
+	registerAnalyzer("token", func() analyzer { return &tokenAnalyzer{} })
+}
+
+// tokenAnalyzer tracks address validation
+type tokenAnalyzer struct {
+	// true if quicly:accept has an address token, i.e. the client has been validated by Retry or NEW_TOKEN
+	AddressToken bool `json:"address_token"`
+	// true if a Retry packet is received
+	Retry bool `json:"retry"`
+	// the number of NEW_TOKEN frames sent and received
+	NumNewTokensSent     int `json:"num_new_tokens_sent"`
+	NumNewTokensReceived int `json:"num_new_tokens_received"`
+}
+
+func (a *tokenAnalyzer) update(eventType interface{}, rawEvent h2ologEvent) {
+	switch eventType {
+	case "accept": // quicly:accept
+		addressToken, _ := eventInt64(rawEvent, "address-token")
+		a.AddressToken = addressToken != 0
+	case "new-token-send": // quicly:new_token_send
+		a.NumNewTokensSent++
+	case "new-token-receive": // quicly:new_token_receive
+		a.NumNewTokensReceived++
+	case "receive": // quicly:receive
+		packet, _ := rawEvent["bytes"].(string)
+		if firstByte, version, ok := parseLongHeader(packet); ok && version != 0 && (firstByte&0x30)>>4 == 3 {
+			// the long header packet type of Retry
+			a.Retry = true
+		}
+	}
+}
+
+func (a *tokenAnalyzer) result() interface{} {
+	return a
+}
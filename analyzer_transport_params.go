@@ -0,0 +1,60 @@
+package main
+
+func init() {
+	registerAnalyzer("transport-params", func() analyzer { return &transportParamsAnalyzer{} })
+}
+
+// transportParamsAnalyzer captures transport parameters and flow-control limits
+type transportParamsAnalyzer struct {
+	// transport parameters, from events that report them (e.g. "max-idle-timeout" fields)
+	MaxIdleTimeout    int64 `json:"max_idle_timeout,omitempty"`
+	MaxUDPPayloadSize int64 `json:"max_udp_payload_size,omitempty"`
+	// the latest flow-control limits, from quicly:max_data_receive and quicly:max_streams_receive
+	PeerMaxData        int64 `json:"peer_max_data,omitempty"`
+	PeerMaxStreamsBidi int64 `json:"peer_max_streams_bidi,omitempty"`
+	PeerMaxStreamsUni  int64 `json:"peer_max_streams_uni,omitempty"`
+	// the latest flow-control limits, from quicly:max_data_send and quicly:max_streams_send
+	LocalMaxData        int64 `json:"local_max_data,omitempty"`
+	LocalMaxStreamsBidi int64 `json:"local_max_streams_bidi,omitempty"`
+	LocalMaxStreamsUni  int64 `json:"local_max_streams_uni,omitempty"`
+}
+
+func (a *transportParamsAnalyzer) update(eventType interface{}, rawEvent h2ologEvent) {
+	switch eventType {
+	case "max-data-receive": // quicly:max_data_receive
+		if maximum, ok := eventInt64(rawEvent, "maximum"); ok {
+			a.PeerMaxData = maximum
+		}
+	case "max-data-send": // quicly:max_data_send
+		if maximum, ok := eventInt64(rawEvent, "maximum"); ok {
+			a.LocalMaxData = maximum
+		}
+	case "max-streams-receive": // quicly:max_streams_receive
+		updateMaxStreams(rawEvent, &a.PeerMaxStreamsBidi, &a.PeerMaxStreamsUni)
+	case "max-streams-send": // quicly:max_streams_send
+		updateMaxStreams(rawEvent, &a.LocalMaxStreamsBidi, &a.LocalMaxStreamsUni)
+	}
+
+	if value, ok := eventInt64(rawEvent, "max-idle-timeout"); ok {
+		a.MaxIdleTimeout = value
+	}
+	if value, ok := eventInt64(rawEvent, "max-udp-payload-size"); ok {
+		a.MaxUDPPayloadSize = value
+	}
+}
+
+func updateMaxStreams(rawEvent h2ologEvent, bidi *int64, uni *int64) {
+	maximum, ok := eventInt64(rawEvent, "maximum")
+	if !ok {
+		return
+	}
+	if isUnidirectional, _ := eventInt64(rawEvent, "is-unidirectional"); isUnidirectional != 0 {
+		*uni = maximum
+	} else {
+		*bidi = maximum
+	}
+}
+
+func (a *transportParamsAnalyzer) result() interface{} {
+	return a
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+
+	json "github.com/goccy/go-json"
+)
+
+func init() {
+	registerAnalyzer("version", func() analyzer {
+		return &versionAnalyzer{Versions: make([]string, 0)}
+	})
+}
+
+// versionAnalyzer tracks QUIC versions and version negotiation
+type versionAnalyzer struct {
+	// QUIC versions in long header packets received, in hex (e.g. "ff00001d")
+	Versions []string `json:"versions"`
+	// the number of version negotiation packets received plus quicly:version_switch events
+	NumVersionNegotiations int `json:"num_version_negotiations"`
+	// the number of long header packets received with a reserved (greased) version
+	NumGreasedVersions int `json:"num_greased_versions"`
+	// the number of reserved (greased) transport parameter IDs, 31*N+27, reported by events with
+	// "transport-parameter-id" or a list of "transport-parameter-ids"
+	NumGreasedTransportParams int `json:"num_greased_transport_params"`
+}
+
+func (a *versionAnalyzer) update(eventType interface{}, rawEvent h2ologEvent) {
+	switch eventType {
+	case "receive": // quicly:receive
+		packet, _ := rawEvent["bytes"].(string)
+		if _, version, ok := parseLongHeader(packet); ok {
+			a.updateVersion(version)
+		}
+	case "version-switch": // quicly:version_switch
+		a.NumVersionNegotiations++
+	}
+
+	if id, ok := eventInt64(rawEvent, "transport-parameter-id"); ok && isGreasedTransportParam(id) {
+		a.NumGreasedTransportParams++
+	}
+	if ids, ok := rawEvent["transport-parameter-ids"].([]interface{}); ok {
+		for _, value := range ids {
+			if number, ok := value.(json.Number); ok {
+				if id, err := number.Int64(); err == nil && isGreasedTransportParam(id) {
+					a.NumGreasedTransportParams++
+				}
+			}
+		}
+	}
+}
+
+// isGreasedTransportParam reports whether the transport parameter ID is reserved to exercise
+// the requirement that unknown ones are ignored (RFC 9000, Section 18.1)
+func isGreasedTransportParam(id int64) bool {
+	return id >= 27 && (id-27)%31 == 0
+}
+
+func (a *versionAnalyzer) updateVersion(version uint32) {
+	if version == 0 {
+		a.NumVersionNegotiations++
+		return
+	}
+	if version&0x0f0f0f0f == 0x0a0a0a0a {
+		a.NumGreasedVersions++
+	}
+
+	s := fmt.Sprintf("%08x", version)
+	for _, v := range a.Versions {
+		if v == s {
+			return
+		}
+	}
+	a.Versions = append(a.Versions, s)
+}
+
+func (a *versionAnalyzer) result() interface{} {
+	return a
+}
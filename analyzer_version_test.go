@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestVersionAnalyzer(t *testing.T) {
+	tests := []struct {
+		name                    string
+		events                  []string
+		wantVersions            []string
+		wantNegotiations        int
+		wantGreasedVersions     int
+		wantGreasedTransportIDs int
+	}{
+		{
+			name:         "a version",
+			events:       []string{`{"type":"receive","bytes":"c3ff00001d08bc6ace5c680ed855"}`, `{"type":"receive","bytes":"c3ff00001d08bc6ace5c680ed855"}`},
+			wantVersions: []string{"ff00001d"},
+		},
+		{
+			name:             "version negotiation",
+			events:           []string{`{"type":"receive","bytes":"c30000000008bc6ace5c680ed855"}`, `{"type":"version-switch","new-version":1}`},
+			wantVersions:     []string{},
+			wantNegotiations: 2,
+		},
+		{
+			name:                "greased version",
+			events:              []string{`{"type":"receive","bytes":"c30a1a2a3a08bc6ace5c680ed855"}`, `{"type":"receive","bytes":"c30000000108bc6ace5c680ed855"}`},
+			wantVersions:        []string{"0a1a2a3a", "00000001"},
+			wantGreasedVersions: 1,
+		},
+		{
+			name:         "short header",
+			events:       []string{`{"type":"receive","bytes":"43ff00001d08bc6ace5c680ed855"}`},
+			wantVersions: []string{},
+		},
+		{
+			name: "greased transport parameters",
+			events: []string{
+				`{"type":"transport-parameter-receive","transport-parameter-id":27}`,
+				`{"type":"transport-parameter-receive","transport-parameter-id":1}`,
+				`{"type":"transport-parameters-receive","transport-parameter-ids":[1,4,58,3127,26,28]}`,
+			},
+			wantVersions:            []string{},
+			wantGreasedTransportIDs: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := &versionAnalyzer{Versions: make([]string, 0)}
+			for _, event := range test.events {
+				rawEvent, err := decodeEvent(event)
+				if err != nil {
+					t.Fatal(err)
+				}
+				a.update(rawEvent["type"], rawEvent)
+			}
+			if len(a.Versions) != len(test.wantVersions) {
+				t.Errorf("versions are %v, want %v", a.Versions, test.wantVersions)
+			} else {
+				for i := range a.Versions {
+					if a.Versions[i] != test.wantVersions[i] {
+						t.Errorf("versions are %v, want %v", a.Versions, test.wantVersions)
+					}
+				}
+			}
+			if a.NumVersionNegotiations != test.wantNegotiations {
+				t.Errorf("num_version_negotiations is %d, want %d", a.NumVersionNegotiations, test.wantNegotiations)
+			}
+			if a.NumGreasedVersions != test.wantGreasedVersions {
+				t.Errorf("num_greased_versions is %d, want %d", a.NumGreasedVersions, test.wantGreasedVersions)
+			}
+			if a.NumGreasedTransportParams != test.wantGreasedTransportIDs {
+				t.Errorf("num_greased_transport_params is %d, want %d", a.NumGreasedTransportParams, test.wantGreasedTransportIDs)
+			}
+		})
+	}
+}
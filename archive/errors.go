@@ -0,0 +1,103 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	gcs "cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// Kinds of errors returned by this package and by the sinks of the collector, to be tested
+// with errors.Is, so that callers can decide what to do without matching error messages.
+var (
+	// ErrPermanent is a failure that retries won't fix, e.g. a missing object or a denied permission.
+	ErrPermanent = errors.New("permanent error")
+	// ErrRetryable is a transient failure, e.g. a network error or a server error.
+	ErrRetryable = errors.New("retryable error")
+	// ErrSchema is an object or an event that doesn't conform to the schema. It is also ErrPermanent.
+	ErrSchema = errors.New("schema error")
+	// ErrOversized is an object or a message that exceeds a size limit. It is also ErrPermanent.
+	ErrOversized = errors.New("oversized")
+)
+
+// Error is an error classified by one of the kinds.
+type Error struct {
+	// one of ErrPermanent, ErrRetryable, ErrSchema, and ErrOversized
+	Kind error
+	Err  error
+}
+
+// NewError returns err classified by the kind.
+func NewError(kind error, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the kind matches the target, where ErrSchema and ErrOversized are also ErrPermanent.
+func (e *Error) Is(target error) bool {
+	if target == e.Kind {
+		return true
+	}
+	return target == ErrPermanent && (e.Kind == ErrSchema || e.Kind == ErrOversized)
+}
+
+func schemaErrorf(format string, args ...interface{}) error {
+	return NewError(ErrSchema, fmt.Errorf(format, args...))
+}
+
+// Classify returns err classified by its cause, e.g. the status code of GCS, S3, or HTTP
+// responses, or as it is if it is already classified. Unknown errors are retryable.
+func Classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified *Error
+	if errors.As(err, &classified) {
+		return err
+	}
+
+	var apiError *googleapi.Error
+	if errors.As(err, &apiError) {
+		return NewError(KindOfStatus(apiError.Code), err)
+	}
+	// e.g. awserr.RequestFailure
+	var statusError interface{ StatusCode() int }
+	if errors.As(err, &statusError) {
+		return NewError(KindOfStatus(statusError.StatusCode()), err)
+	}
+
+	if errors.Is(err, gcs.ErrObjectNotExist) || errors.Is(err, gcs.ErrBucketNotExist) ||
+		errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) || errors.Is(err, context.Canceled) {
+		return NewError(ErrPermanent, err)
+	}
+	// e.g. network errors and timeouts
+	return NewError(ErrRetryable, err)
+}
+
+// KindOfStatus returns the kind of errors of a failed HTTP request by the status code, e.g. for
+// sinks of HTTP APIs.
+func KindOfStatus(code int) error {
+	switch {
+	case code == http.StatusRequestEntityTooLarge:
+		return ErrOversized
+	case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests, code >= 500:
+		return ErrRetryable
+	case code >= 400:
+		return ErrPermanent
+	}
+	return ErrRetryable
+}
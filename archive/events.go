@@ -0,0 +1,130 @@
+package archive
+
+import (
+	"context"
+	// encoding/json is used instead of goccy/go-json for its streaming tokenizer
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// EventReader reads the events in the payload of an object one by one,
+// without loading the whole object into memory.
+type EventReader struct {
+	name    string
+	reader  io.ReadCloser
+	decoder *stdjson.Decoder
+	// true after the opening bracket of the payload, or the root object of NDJSON, has been read
+	inPayload bool
+	// true if events follow the root object line by line
+	ndjson bool
+}
+
+// OpenEvents opens an object to read its events.
+func OpenEvents(ctx context.Context, store Store, name string) (*EventReader, error) {
+	reader, err := openObject(ctx, store, name)
+	if err != nil {
+		return nil, err
+	}
+	decoder := stdjson.NewDecoder(reader)
+	decoder.UseNumber()
+	return &EventReader{
+		name:    name,
+		reader:  reader,
+		decoder: decoder,
+	}, nil
+}
+
+// Next returns the next event, or Done if there are no more events.
+func (r *EventReader) Next() (map[string]interface{}, error) {
+	if !r.inPayload {
+		err := r.seekPayload()
+		if err != nil {
+			return nil, err
+		}
+		r.inPayload = true
+	}
+	if !r.decoder.More() {
+		if !r.ndjson {
+			return nil, Done
+		}
+		// the top level of NDJSON ends with EOF
+		token, err := r.decoder.Token()
+		if err == io.EOF {
+			return nil, Done
+		}
+		if err != nil {
+			return nil, r.decodeError(err)
+		}
+		return nil, schemaErrorf("%s: unexpected token after events: %v", r.name, token)
+	}
+	var event map[string]interface{}
+	err := r.decoder.Decode(&event)
+	if err != nil {
+		return nil, r.decodeError(err)
+	}
+	return event, nil
+}
+
+// seekPayload skips tokens until the opening bracket of the top-level "payload" array, or the
+// end of the root object in NDJSON
+func (r *EventReader) seekPayload() error {
+	token, err := r.decoder.Token()
+	if err != nil {
+		return r.decodeError(err)
+	}
+	if delim, ok := token.(stdjson.Delim); !ok || delim != '{' {
+		return schemaErrorf("%s: not a JSON object", r.name)
+	}
+	for r.decoder.More() {
+		token, err := r.decoder.Token()
+		if err != nil {
+			return r.decodeError(err)
+		}
+		if token == "payload" {
+			token, err = r.decoder.Token()
+			if err != nil {
+				return r.decodeError(err)
+			}
+			if delim, ok := token.(stdjson.Delim); !ok || delim != '[' {
+				return schemaErrorf("%s: payload is not an array", r.name)
+			}
+			return nil
+		}
+		// skip the value of other fields
+		var value stdjson.RawMessage
+		err = r.decoder.Decode(&value)
+		if err != nil {
+			return r.decodeError(err)
+		}
+		if token == "payload_format" && string(value) == `"`+PayloadFormatNDJSON+`"` {
+			r.ndjson = true
+		}
+	}
+	if r.ndjson {
+		// the closing brace of the root object
+		_, err = r.decoder.Token()
+		if err != nil {
+			return r.decodeError(err)
+		}
+		return nil
+	}
+	return schemaErrorf("%s: no payload", r.name)
+}
+
+// decodeError returns an error of the decoder, which is of the schema unless it is of reading
+// the object
+func (r *EventReader) decodeError(err error) error {
+	var syntaxError *stdjson.SyntaxError
+	var typeError *stdjson.UnmarshalTypeError
+	if errors.As(err, &syntaxError) || errors.As(err, &typeError) || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return schemaErrorf("%s: %v", r.name, err)
+	}
+	return Classify(fmt.Errorf("%s: %w", r.name, err))
+}
+
+// Close closes the underlying object.
+func (r *EventReader) Close() error {
+	return r.reader.Close()
+}
@@ -0,0 +1,125 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Done is returned by Iterator.Next when there are no more records.
+var Done = errors.New("no more records")
+
+// Iterator reads records one by one.
+type Iterator struct {
+	ctx   context.Context
+	store Store
+	names []string
+	err   error
+}
+
+// Records returns an iterator over the records whose names start with the prefix.
+func Records(ctx context.Context, store Store, prefix string) *Iterator {
+	names, err := store.List(ctx, prefix)
+	return &Iterator{
+		ctx:   ctx,
+		store: store,
+		names: names,
+		err:   Classify(err),
+	}
+}
+
+// Next returns the next record, or Done if there are no more records.
+func (it *Iterator) Next() (*Record, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if len(it.names) == 0 {
+		return nil, Done
+	}
+	name := it.names[0]
+	it.names = it.names[1:]
+
+	data, err := ReadObject(it.ctx, it.store, name)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRecord(name, data)
+}
+
+// ReadObject reads the content of an object, decompressing it if it is compressed.
+func ReadObject(ctx context.Context, store Store, name string) ([]byte, error) {
+	reader, err := openObject(ctx, store, name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, Classify(err)
+	}
+	return data, nil
+}
+
+type decompressedObject struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (object *decompressedObject) Close() error {
+	var err error
+	for _, closer := range object.closers {
+		if e := closer.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// zstd dictionaries to decompress objects
+var zstdDicts = make([][]byte, 0)
+
+// AddZstdDict adds a dictionary to decompress zstd-compressed objects.
+func AddZstdDict(dict []byte) {
+	zstdDicts = append(zstdDicts, dict)
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (reader zstdReadCloser) Close() error {
+	reader.Decoder.Close()
+	return nil
+}
+
+// openObject returns a reader of the content of an object, decompressing it if it is gzipped or zstd-compressed.
+func openObject(ctx context.Context, store Store, name string) (io.ReadCloser, error) {
+	reader, err := store.Open(ctx, name)
+	if err != nil {
+		return nil, Classify(err)
+	}
+
+	buffered := bufio.NewReader(reader)
+	magic, _ := buffered.Peek(4)
+	if len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			reader.Close()
+			return nil, schemaErrorf("%s: %v", name, err)
+		}
+		return &decompressedObject{Reader: gzipReader, closers: []io.Closer{gzipReader, reader}}, nil
+	}
+	if len(magic) == 4 && magic[0] == 0x28 && magic[1] == 0xb5 && magic[2] == 0x2f && magic[3] == 0xfd {
+		decoder, err := zstd.NewReader(buffered, zstd.WithDecoderDicts(zstdDicts...))
+		if err != nil {
+			reader.Close()
+			return nil, schemaErrorf("%s: %v", name, err)
+		}
+		return &decompressedObject{Reader: decoder, closers: []io.Closer{zstdReadCloser{decoder}, reader}}, nil
+	}
+	return &decompressedObject{Reader: buffered, closers: []io.Closer{reader}}, nil
+}
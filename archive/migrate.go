@@ -0,0 +1,47 @@
+package archive
+
+// migrations[v] upgrades a record from schema version v to v+1
+var migrations = map[int]func(record *Record){
+	1: migrateV1,
+}
+
+// Migrate upgrades a record to CurrentSchemaVersion, and reports whether it has been changed.
+// Records of invalid versions below 1, which ParseRecord rejects, are left as they are.
+func Migrate(record *Record) bool {
+	if record.SchemaVersion < 1 || record.SchemaVersion >= CurrentSchemaVersion {
+		return false
+	}
+	for record.SchemaVersion < CurrentSchemaVersion {
+		migrations[record.SchemaVersion](record)
+		record.SchemaVersion++
+	}
+	return true
+}
+
+// migrateV1 fills "role" and "h2o_conn_id", which version 1 objects may lack, from the payload.
+func migrateV1(record *Record) {
+	if _, ok := record.Fields["role"]; !ok {
+		role := ""
+		for _, event := range record.Payload {
+			if event["type"] == "accept" {
+				role = "server"
+				break
+			} else if event["type"] == "connect" {
+				role = "client"
+				break
+			}
+		}
+		record.Fields["role"] = role
+	}
+
+	if _, ok := record.Fields["h2o_conn_id"]; !ok {
+		var h2oConnID interface{} = -1
+		for _, event := range record.Payload {
+			if event["type"] == "h3s-accept" && event["conn-id"] != nil {
+				h2oConnID = event["conn-id"]
+				break
+			}
+		}
+		record.Fields["h2o_conn_id"] = h2oConnID
+	}
+}
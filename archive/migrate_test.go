@@ -0,0 +1,81 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestParseRecordSchemaVersion(t *testing.T) {
+	tests := []struct {
+		object  string
+		wantErr bool
+	}{
+		{`{"id":"a"}`, false},
+		{`{"schema_version":1,"id":"a"}`, false},
+		{fmt.Sprintf(`{"schema_version":%d,"id":"a"}`, CurrentSchemaVersion), false},
+		{`{"schema_version":0,"id":"a"}`, true},
+		{`{"schema_version":-1,"id":"a"}`, true},
+		{fmt.Sprintf(`{"schema_version":%d,"id":"a"}`, CurrentSchemaVersion+1), true},
+	}
+	for _, test := range tests {
+		_, err := ParseRecord("a.json", []byte(test.object))
+		if test.wantErr {
+			if !errors.Is(err, ErrSchema) {
+				t.Errorf("%s: the error is %v, want ErrSchema", test.object, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", test.object, err)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name          string
+		record        *Record
+		wantMigrated  bool
+		wantVersion   int
+		wantRole      interface{}
+		wantH2OConnID interface{}
+	}{
+		{
+			name: "version 1",
+			record: &Record{SchemaVersion: 1, Fields: map[string]interface{}{}, Payload: []map[string]interface{}{
+				{"type": "accept"}, {"type": "h3s-accept", "conn-id": 3},
+			}},
+			wantMigrated:  true,
+			wantVersion:   CurrentSchemaVersion,
+			wantRole:      "server",
+			wantH2OConnID: 3,
+		},
+		{
+			name:         "current version",
+			record:       &Record{SchemaVersion: CurrentSchemaVersion, Fields: map[string]interface{}{}},
+			wantMigrated: false,
+			wantVersion:  CurrentSchemaVersion,
+		},
+		{
+			name:         "invalid version",
+			record:       &Record{SchemaVersion: 0, Fields: map[string]interface{}{}},
+			wantMigrated: false,
+			wantVersion:  0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if migrated := Migrate(test.record); migrated != test.wantMigrated {
+				t.Errorf("Migrate() = %v, want %v", migrated, test.wantMigrated)
+			}
+			if test.record.SchemaVersion != test.wantVersion {
+				t.Errorf("the version is %d, want %d", test.record.SchemaVersion, test.wantVersion)
+			}
+			if role := test.record.Fields["role"]; role != test.wantRole {
+				t.Errorf("role is %v, want %v", role, test.wantRole)
+			}
+			if h2oConnID := test.record.Fields["h2o_conn_id"]; h2oConnID != test.wantH2OConnID {
+				t.Errorf("h2o_conn_id is %v, want %v", h2oConnID, test.wantH2OConnID)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+// Package archive reads per-connection objects stored by h2olog-collector-gcs.
+package archive
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	json "github.com/goccy/go-json"
+)
+
+// CurrentSchemaVersion is the latest schema version, which the collector writes.
+// Objects without "schema_version" are version 1.
+const CurrentSchemaVersion = 2
+
+// Record is a stored per-connection object.
+type Record struct {
+	// the object name
+	Name string `json:"-"`
+
+	SchemaVersion int       `json:"schema_version"`
+	ID            string    `json:"id"`
+	Host          string    `json:"host"`
+	StartTime     time.Time `json:"start_time"`
+	EndTime       time.Time `json:"end_time"`
+	NumEvents     uint64    `json:"num_events"`
+	ConnID        int64     `json:"conn_id"`
+	SentPn        int64     `json:"sent_pn"`
+	AckedPn       int64     `json:"acked_pn"`
+
+	// other metadata fields, e.g. the ones derived by analyzers
+	Fields map[string]interface{} `json:"-"`
+
+	// events that h2olog emitted
+	Payload []map[string]interface{} `json:"payload"`
+}
+
+// PayloadFormatNDJSON is "payload_format" of objects whose root object without "payload" is
+// the first line, followed by an event per line.
+const PayloadFormatNDJSON = "ndjson"
+
+// splitNDJSON returns the root object and the lines of events if data is in NDJSON
+func splitNDJSON(data []byte) ([]byte, []byte) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 || !bytes.Contains(data[:i], []byte(`"payload_format":"`+PayloadFormatNDJSON+`"`)) {
+		return data, nil
+	}
+	return data[:i], data[i+1:]
+}
+
+// ParseRecord decodes a stored object. Numbers in Fields and Payload are json.Number.
+func ParseRecord(name string, data []byte) (*Record, error) {
+	if bytes.HasPrefix(data, []byte("PAR1")) {
+		return nil, schemaErrorf("%s: objects in Parquet are not supported", name)
+	}
+	if bytes.HasPrefix(data, []byte("Obj\x01")) {
+		return nil, schemaErrorf("%s: objects in Avro are not supported", name)
+	}
+	header, lines := splitNDJSON(data)
+	var object map[string]json.RawMessage
+	err := json.Unmarshal(header, &object)
+	if err != nil {
+		return nil, schemaErrorf("%s: %v", name, err)
+	}
+	if _, ok := object["qlog_version"]; ok {
+		return nil, schemaErrorf("%s: objects in qlog are not supported", name)
+	}
+
+	record := &Record{
+		Name:          name,
+		SchemaVersion: 1,
+		Fields:        make(map[string]interface{}),
+	}
+	targets := map[string]interface{}{
+		"schema_version": &record.SchemaVersion,
+		"id":             &record.ID,
+		"host":           &record.Host,
+		"start_time":     &record.StartTime,
+		"end_time":       &record.EndTime,
+		"num_events":     &record.NumEvents,
+		"conn_id":        &record.ConnID,
+		"sent_pn":        &record.SentPn,
+		"acked_pn":       &record.AckedPn,
+		"payload":        &record.Payload,
+	}
+	for key, value := range object {
+		if target, ok := targets[key]; ok {
+			err = decode(value, target)
+		} else {
+			var field interface{}
+			err = decode(value, &field)
+			record.Fields[key] = field
+		}
+		if err != nil {
+			return nil, schemaErrorf("%s: invalid field %s: %v", name, key, err)
+		}
+	}
+
+	if record.SchemaVersion < 1 || record.SchemaVersion > CurrentSchemaVersion {
+		return nil, schemaErrorf("%s: unsupported schema version %d (not in 1..%d)", name, record.SchemaVersion, CurrentSchemaVersion)
+	}
+
+	if record.isNDJSON() {
+		for i, line := range bytes.Split(lines, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var event map[string]interface{}
+			err = decode(line, &event)
+			if err != nil {
+				return nil, schemaErrorf("%s: invalid event at line %d: %v", name, i+2, err)
+			}
+			record.Payload = append(record.Payload, event)
+		}
+	}
+	return record, nil
+}
+
+func (record *Record) isNDJSON() bool {
+	return record.Fields["payload_format"] == PayloadFormatNDJSON
+}
+
+func decode(data []byte, target interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(target)
+}
+
+type recordField struct {
+	key   string
+	value interface{}
+}
+
+// MarshalJSON encodes the record in the same layout as the collector writes: metadata, Fields, and then the payload,
+// which follows the root object line by line if "payload_format" is "ndjson".
+func (record *Record) MarshalJSON() ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	buffer.WriteByte('{')
+	fields := []recordField{
+		{"schema_version", record.SchemaVersion},
+		{"id", record.ID},
+		{"host", record.Host},
+		{"start_time", record.StartTime},
+		{"end_time", record.EndTime},
+		{"num_events", record.NumEvents},
+		{"conn_id", record.ConnID},
+		{"sent_pn", record.SentPn},
+		{"acked_pn", record.AckedPn},
+	}
+	keys := make([]string, 0, len(record.Fields))
+	for key := range record.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fields = append(fields, recordField{key, record.Fields[key]})
+	}
+	if !record.isNDJSON() {
+		fields = append(fields, recordField{"payload", record.Payload})
+	}
+
+	for i, field := range fields {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		key, _ := json.Marshal(field.key)
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			return nil, schemaErrorf("%s: invalid field %s: %v", record.Name, field.key, err)
+		}
+		buffer.Write(key)
+		buffer.WriteByte(':')
+		buffer.Write(value)
+	}
+	buffer.WriteByte('}')
+	if record.isNDJSON() {
+		buffer.WriteByte('\n')
+		for _, event := range record.Payload {
+			line, err := json.Marshal(event)
+			if err != nil {
+				return nil, schemaErrorf("%s: invalid event: %v", record.Name, err)
+			}
+			buffer.Write(line)
+			buffer.WriteByte('\n')
+		}
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,115 @@
+package archive
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	gcs "cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Store is a place where objects are stored, e.g. a local directory or a GCS bucket.
+type Store interface {
+	// List returns the names of objects that start with the prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Open returns a reader of the raw content of an object.
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// Write replaces the content of an object.
+	Write(ctx context.Context, name string, data []byte) error
+}
+
+type localStore struct {
+	dir string
+}
+
+// NewLocalStore returns a Store for a directory specified by -local.
+func NewLocalStore(dir string) Store {
+	return &localStore{dir: dir}
+}
+
+func (store *localStore) List(ctx context.Context, prefix string) ([]string, error) {
+	names := make([]string, 0)
+	err := filepath.Walk(store.dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isObjectFile(info.Name()) {
+			return nil
+		}
+		name, err := filepath.Rel(store.dir, filePath)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, Classify(err)
+}
+
+func (store *localStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(store.dir, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, Classify(err)
+	}
+	return file, nil
+}
+
+func (store *localStore) Write(ctx context.Context, name string, data []byte) error {
+	return Classify(os.WriteFile(filepath.Join(store.dir, filepath.FromSlash(name)), data, os.ModePerm))
+}
+
+func isObjectFile(fileName string) bool {
+	return strings.HasSuffix(fileName, ".json") || strings.HasSuffix(fileName, ".json.gz") || strings.HasSuffix(fileName, ".json.zst")
+}
+
+type gcsStore struct {
+	bucket *gcs.BucketHandle
+}
+
+// NewGCSStore returns a Store for a GCS bucket.
+func NewGCSStore(bucket *gcs.BucketHandle) Store {
+	return &gcsStore{bucket: bucket}
+}
+
+func (store *gcsStore) List(ctx context.Context, prefix string) ([]string, error) {
+	names := make([]string, 0)
+	it := store.bucket.Objects(ctx, &gcs.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, Classify(err)
+		}
+		names = append(names, attrs.Name)
+	}
+	return names, nil
+}
+
+func (store *gcsStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	reader, err := store.bucket.Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, Classify(err)
+	}
+	return reader, nil
+}
+
+func (store *gcsStore) Write(ctx context.Context, name string, data []byte) error {
+	writer := store.bucket.Object(name).NewWriter(ctx)
+	writer.ContentType = "application/json; utf-8"
+	_, err := writer.Write(data)
+	if err != nil {
+		writer.Close()
+		return Classify(err)
+	}
+	return Classify(writer.Close())
+}
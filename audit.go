@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	json "github.com/goccy/go-json"
+)
+
+// a line of the audit log, written once for each finalized connection
+type auditRecord struct {
+	// the time when the connection was finalized
+	Time time.Time `json:"time"`
+	// connection id
+	ConnID int64 `json:"conn_id"`
+	// object name, empty if it could not be built
+	ObjectName string `json:"object_name,omitempty"`
+	// the size of the serialized object in bytes, after compression if any
+	Bytes int `json:"bytes"`
+	// the size of the serialized object before compression
+	UncompressedBytes int `json:"uncompressed_bytes"`
+	// the total number of events
+	NumEvents uint64 `json:"num_events"`
+	// the number of events stored in the payload
+	NumStoredEvents int `json:"num_stored_events"`
+	// "ok", "error", "skipped" by -on-name-collision=skip, or "split" into chunks by -max-object-bytes
+	Result string `json:"result"`
+	// the error message if result is "error"
+	Error string `json:"error,omitempty"`
+	// the time spent in serialization and compression in milliseconds
+	SerializeMillis int64 `json:"serialize_ms"`
+	// the time spent in the storage in milliseconds
+	LatencyMillis int64 `json:"latency_ms"`
+}
+
+type auditLogger struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func openAuditLog(filePath string) (*auditLogger, error) {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLogger{file: file}, nil
+}
+
+// record appends a record to the audit log. It does nothing if the audit log is disabled.
+func (audit *auditLogger) record(record *auditRecord) {
+	if audit == nil {
+		return
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Cannot serialize the audit record: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	_, err = audit.file.Write(line)
+	if err != nil {
+		log.Printf("Cannot write the audit record: %v", err)
+	}
+}
+
+func (audit *auditLogger) close() error {
+	if audit == nil {
+		return nil
+	}
+	return audit.file.Close()
+}
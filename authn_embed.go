@@ -0,0 +1,12 @@
+//go:build authn
+// +build authn
+
+package main
+
+import _ "embed"
+
+// GCP credentials embedded at build time, used only if no other credentials are found.
+// The Makefile builds with -tags=authn if authn.json exists.
+//
+//go:embed authn.json
+var authnJson []byte
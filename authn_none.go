@@ -0,0 +1,7 @@
+//go:build !authn
+// +build !authn
+
+package main
+
+// no credentials are embedded without -tags=authn
+var authnJson []byte
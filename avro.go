@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	json "github.com/goccy/go-json"
+)
+
+// A minimal writer of Avro object container files with the null codec for objects in Avro,
+// which saves a dependency on an Avro library. The schema is generated from h2ologEventRoot,
+// with "fields" for the fields of analyzers and "payload" for events, whose values are in JSON.
+
+// how a field of h2ologEventRoot is encoded
+type avroKind int
+
+const (
+	avroLong avroKind = iota
+	avroBoolean
+	avroString
+	// time.Time as timestamp-millis
+	avroTimestamp
+	// other types as a nullable JSON string
+	avroJSON
+)
+
+type avroField struct {
+	name string
+	kind avroKind
+}
+
+var avroRootFields = avroFieldsOf(reflect.TypeOf(h2ologEventRoot{}))
+
+// avroSchema is the schema of objects in Avro
+var avroSchema = buildAvroSchema(avroRootFields)
+
+// avroFieldsOf returns the fields of a struct by their JSON names, except "payload"
+func avroFieldsOf(structType reflect.Type) []avroField {
+	fields := make([]avroField, 0, structType.NumField())
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" || name == "payload" {
+			continue
+		}
+		kind := avroJSON
+		switch {
+		case field.Type == reflect.TypeOf(time.Time{}):
+			kind = avroTimestamp
+		case field.Type.Kind() >= reflect.Int && field.Type.Kind() <= reflect.Uint64:
+			kind = avroLong
+		case field.Type.Kind() == reflect.Bool:
+			kind = avroBoolean
+		case field.Type.Kind() == reflect.String:
+			kind = avroString
+		}
+		fields = append(fields, avroField{name: name, kind: kind})
+	}
+	return fields
+}
+
+type avroSchemaField struct {
+	Name string      `json:"name"`
+	Type interface{} `json:"type"`
+	Doc  string      `json:"doc,omitempty"`
+}
+
+func buildAvroSchema(fields []avroField) string {
+	jsonMap := map[string]string{"type": "map", "values": "string"}
+	schemaFields := make([]avroSchemaField, 0, len(fields)+2)
+	for _, field := range fields {
+		schemaField := avroSchemaField{Name: field.name}
+		switch field.kind {
+		case avroLong:
+			schemaField.Type = "long"
+		case avroBoolean:
+			schemaField.Type = "boolean"
+		case avroString:
+			schemaField.Type = "string"
+		case avroTimestamp:
+			schemaField.Type = map[string]string{"type": "long", "logicalType": "timestamp-millis"}
+		default:
+			schemaField.Type = []string{"null", "string"}
+			schemaField.Doc = "in JSON"
+		}
+		schemaFields = append(schemaFields, schemaField)
+	}
+	schemaFields = append(schemaFields,
+		avroSchemaField{Name: "fields", Type: jsonMap, Doc: "the fields of analyzers, whose values are in JSON"},
+		avroSchemaField{Name: "payload", Type: map[string]interface{}{"type": "array", "items": jsonMap}, Doc: "events, whose values are in JSON"},
+	)
+	schema, err := json.Marshal(map[string]interface{}{
+		"type":      "record",
+		"name":      "Connection",
+		"namespace": "h2olog",
+		"fields":    schemaFields,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return string(schema)
+}
+
+// avroEncoder encodes values in the Avro binary encoding
+type avroEncoder struct {
+	bytes.Buffer
+}
+
+func (e *avroEncoder) long(v int64) {
+	var varint [binary.MaxVarintLen64]byte
+	e.Write(varint[:binary.PutVarint(varint[:], v)])
+}
+
+func (e *avroEncoder) string(s string) {
+	e.long(int64(len(s)))
+	e.WriteString(s)
+}
+
+func (e *avroEncoder) boolean(b bool) {
+	if b {
+		e.WriteByte(1)
+	} else {
+		e.WriteByte(0)
+	}
+}
+
+// jsonMap encodes a map of values in JSON in the order of keys
+func (e *avroEncoder) jsonMap(values map[string]interface{}) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) > 0 {
+		e.long(int64(len(keys)))
+		for _, key := range keys {
+			value, err := json.Marshal(values[key])
+			if err != nil {
+				return err
+			}
+			e.string(key)
+			e.string(string(value))
+		}
+	}
+	e.long(0)
+	return nil
+}
+
+// encodeAvroObject writes a connection as an Avro object container file of a record, given the
+// summary, the root object without "payload", and the events
+func encodeAvroObject(summary []byte, events []h2ologEvent) ([]byte, error) {
+	var root map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(summary))
+	decoder.UseNumber()
+	err := decoder.Decode(&root)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &avroEncoder{}
+	for _, field := range avroRootFields {
+		value := root[field.name]
+		delete(root, field.name)
+		switch field.kind {
+		case avroLong:
+			number, _ := value.(json.Number)
+			v, _ := number.Int64()
+			record.long(v)
+		case avroBoolean:
+			b, _ := value.(bool)
+			record.boolean(b)
+		case avroString:
+			s, _ := value.(string)
+			record.string(s)
+		case avroTimestamp:
+			s, _ := value.(string)
+			t, _ := time.Parse(time.RFC3339Nano, s)
+			record.long(t.Unix()*1000 + int64(t.Nanosecond())/int64(time.Millisecond))
+		default:
+			if value == nil {
+				record.long(0)
+				continue
+			}
+			data, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			record.long(1)
+			record.string(string(data))
+		}
+	}
+	// the fields of analyzers
+	err = record.jsonMap(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) > 0 {
+		record.long(int64(len(events)))
+		for _, event := range events {
+			err = record.jsonMap(event)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	record.long(0)
+
+	// a sync marker derived from the record, so that outputs are deterministic
+	hash := sha256.Sum256(record.Bytes())
+	sync := hash[:16]
+
+	file := &avroEncoder{}
+	file.WriteString("Obj\x01")
+	file.long(2)
+	file.string("avro.schema")
+	file.string(avroSchema)
+	file.string("avro.codec")
+	file.string("null")
+	file.long(0)
+	file.Write(sync)
+	file.long(1)
+	file.long(int64(record.Len()))
+	file.Write(record.Bytes())
+	file.Write(sync)
+	return file.Bytes(), nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	json "github.com/goccy/go-json"
+	"github.com/linkedin/goavro/v2"
+)
+
+// readAvro reads the records of an Avro object container file by a reference reader
+func readAvro(t *testing.T, data []byte) []map[string]interface{} {
+	t.Helper()
+	ocf, err := goavro.NewOCFReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("cannot open the file: %v", err)
+	}
+	var records []map[string]interface{}
+	for ocf.Scan() {
+		record, err := ocf.Read()
+		if err != nil {
+			t.Fatalf("cannot read a record: %v", err)
+		}
+		records = append(records, record.(map[string]interface{}))
+	}
+	if err := ocf.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// decodeJSON decodes a JSON value in the string, keeping numbers as json.Number
+func decodeJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(s))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("cannot decode %s: %v", s, err)
+	}
+	return value
+}
+
+// checkAvroRecord compares a record read from Avro with the root object and the events
+func checkAvroRecord(t *testing.T, record map[string]interface{}, root map[string]interface{}, events []interface{}) {
+	t.Helper()
+	analyzerFields := make(map[string]interface{})
+	for key, value := range root {
+		analyzerFields[key] = value
+	}
+	for _, field := range avroRootFields {
+		value := root[field.name]
+		delete(analyzerFields, field.name)
+		var want interface{}
+		switch field.kind {
+		case avroLong:
+			want = int64(0)
+			if value != nil {
+				want = int64OrNil(value)
+			}
+		case avroBoolean:
+			want = value == true
+		case avroString:
+			want, _ = value.(string)
+			if value == nil {
+				want = ""
+			}
+		case avroTimestamp:
+			s, _ := value.(string)
+			wantTime, _ := time.Parse(time.RFC3339Nano, s)
+			if got, ok := record[field.name].(time.Time); !ok || !got.Equal(wantTime.Truncate(time.Millisecond)) {
+				t.Errorf("%s is %v, want %v", field.name, record[field.name], wantTime)
+			}
+			continue
+		default:
+			union, _ := record[field.name].(map[string]interface{})
+			if value == nil {
+				if record[field.name] != nil {
+					t.Errorf("%s is %v, want null", field.name, record[field.name])
+				}
+				continue
+			}
+			if s, ok := union["string"].(string); !ok || !reflect.DeepEqual(decodeJSON(t, s), value) {
+				t.Errorf("%s is %v, want %v", field.name, record[field.name], value)
+			}
+			continue
+		}
+		if record[field.name] != want {
+			t.Errorf("%s is %#v, want %#v", field.name, record[field.name], want)
+		}
+	}
+
+	fields := record["fields"].(map[string]interface{})
+	if len(fields) != len(analyzerFields) {
+		t.Errorf("%d fields of analyzers, want %d", len(fields), len(analyzerFields))
+	}
+	for key, value := range analyzerFields {
+		s, _ := fields[key].(string)
+		if !reflect.DeepEqual(decodeJSON(t, s), value) {
+			t.Errorf("the field %s is %v, want %v", key, fields[key], value)
+		}
+	}
+
+	payload := record["payload"].([]interface{})
+	if len(payload) != len(events) {
+		t.Fatalf("%d events, want %d", len(payload), len(events))
+	}
+	for i, item := range payload {
+		event := item.(map[string]interface{})
+		want := events[i].(map[string]interface{})
+		if len(event) != len(want) {
+			t.Errorf("event %d has %d fields, want %d", i, len(event), len(want))
+		}
+		for key, value := range want {
+			s, _ := event[key].(string)
+			if !reflect.DeepEqual(decodeJSON(t, s), value) {
+				t.Errorf("%s of event %d is %v, want %v", key, i, event[key], value)
+			}
+		}
+	}
+}
+
+func TestAvroObject(t *testing.T) {
+	tests := []struct {
+		name    string
+		summary string
+		events  string
+	}{
+		{
+			name:    "minimal",
+			summary: `{"schema_version":3,"id":"a","host":"h","start_time":"2021-04-21T07:05:58.368Z","end_time":"2021-04-21T07:05:58.368Z","conn_id":1}`,
+			events:  `[]`,
+		},
+		{
+			name:    "nullable and analyzer fields",
+			summary: `{"schema_version":3,"id":"b","host":"h","start_time":"2021-04-21T07:05:58.368Z","end_time":"2021-04-21T07:06:00.001Z","conn_id":-1,"incomplete":true,"duplicate_accepts":[{"type":"accept","time":1}],"rtt":{"smoothed":10},"sni":"example.com"}`,
+			events:  `[{"type":"accept","conn":1,"time":1618988758368},{"type":"free","conn":1,"time":1618988760001,"note":"日本語"}]`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := decodeJSON(t, test.summary).(map[string]interface{})
+			events := decodeJSON(t, test.events).([]interface{})
+			rawEvents := make([]h2ologEvent, len(events))
+			for i, event := range events {
+				rawEvents[i] = event.(map[string]interface{})
+			}
+			data, err := encodeAvroObject([]byte(test.summary), rawEvents)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records := readAvro(t, data)
+			if len(records) != 1 {
+				t.Fatalf("%d records, want 1", len(records))
+			}
+			checkAvroRecord(t, records[0], root, events)
+		})
+	}
+}
+
+// TestAvroObjects compares objects in Avro with those in JSON for the same input
+func TestAvroObjects(t *testing.T) {
+	jsonObjects := collectTestObjects(t, payloadFormatJSON)
+	avroObjects := collectTestObjects(t, payloadFormatAvro)
+	if len(avroObjects) != len(jsonObjects) {
+		t.Fatalf("%d objects in Avro, want %d", len(avroObjects), len(jsonObjects))
+	}
+	for name, jsonObject := range jsonObjects {
+		avroName := strings.TrimSuffix(name, ".json") + ".avro"
+		avroObject, ok := avroObjects[avroName]
+		if !ok {
+			t.Errorf("%s is missing", avroName)
+			continue
+		}
+		t.Run(avroName, func(t *testing.T) {
+			root := decodeJSON(t, string(jsonObject)).(map[string]interface{})
+			events := root["payload"].([]interface{})
+			delete(root, "payload")
+			records := readAvro(t, avroObject)
+			if len(records) != 1 {
+				t.Fatalf("%d records, want 1", len(records))
+			}
+			checkAvroRecord(t, records[0], root, events)
+		})
+	}
+}
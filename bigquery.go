@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+	"cloud.google.com/go/bigquery/storage/managedwriter/adapt"
+	json "github.com/goccy/go-json"
+	bigqueryv2 "google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/option"
+	storagepb "google.golang.org/genproto/googleapis/cloud/bigquery/storage/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/gfx/h2olog-collector-gcs/archive"
+)
+
+const bigQueryScope = "https://www.googleapis.com/auth/bigquery"
+
+// a BigQuery table to which it streams a summary row per object (-bigquery-table).
+// Rows are appended to the default stream of the table by the Storage Write API, which
+// commits them at once and at least once.
+type bigQueryTable struct {
+	client  *managedwriter.Client
+	stream  *managedwriter.ManagedStream
+	project string
+	dataset string
+	table   string
+	// the message of a row, built from the schema of the table
+	descriptor protoreflect.MessageDescriptor
+	// the top-level TIMESTAMP columns, which are RFC 3339 strings in rows and microseconds in
+	// messages
+	timestampColumns []string
+	// true to include the payload as a JSON column (-bigquery-payload)
+	withPayload bool
+}
+
+var bigQuery *bigQueryTable
+
+// spec returns "project.dataset.table", or "" if table is nil
+func (table *bigQueryTable) spec() string {
+	if table == nil {
+		return ""
+	}
+	return table.project + "." + table.dataset + "." + table.table
+}
+
+// newBigQueryTable parses "project.dataset.table", authenticates with the credentials
+// resolved by resolveCredentials, and opens the default stream of the table with the message
+// of its schema
+func newBigQueryTable(ctx context.Context, spec string, withPayload bool) (*bigQueryTable, error) {
+	names := strings.Split(spec, ".")
+	if len(names) != 3 || names[0] == "" || names[1] == "" || names[2] == "" {
+		return nil, fmt.Errorf("not project.dataset.table: %s", spec)
+	}
+
+	credentials, err := findCredentials(ctx, bigQueryScope)
+	if err != nil {
+		return nil, err
+	}
+	table := &bigQueryTable{
+		project:     names[0],
+		dataset:     names[1],
+		table:       names[2],
+		withPayload: withPayload,
+	}
+
+	service, err := bigqueryv2.NewService(ctx, option.WithCredentials(credentials))
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := service.Tables.Get(table.project, table.dataset, table.table).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	if metadata.Schema == nil {
+		return nil, fmt.Errorf("the table has no schema: %s", spec)
+	}
+	schema, err := storageTableSchema(metadata.Schema.Fields)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range schema {
+		if field.Type == storagepb.TableFieldSchema_TIMESTAMP && field.Mode != storagepb.TableFieldSchema_REPEATED {
+			table.timestampColumns = append(table.timestampColumns, field.Name)
+		}
+	}
+	descriptor, err := adapt.StorageSchemaToProto2Descriptor(&storagepb.TableSchema{Fields: schema}, "root")
+	if err != nil {
+		return nil, err
+	}
+	var ok bool
+	table.descriptor, ok = descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("the schema is not of a message: %s", spec)
+	}
+	normalized, err := adapt.NormalizeDescriptor(table.descriptor)
+	if err != nil {
+		return nil, err
+	}
+
+	table.client, err = managedwriter.NewClient(ctx, table.project, option.WithCredentials(credentials))
+	if err != nil {
+		return nil, err
+	}
+	table.stream, err = table.client.NewManagedStream(ctx,
+		managedwriter.WithDestinationTable(fmt.Sprintf("projects/%s/datasets/%s/tables/%s", table.project, table.dataset, table.table)),
+		managedwriter.WithType(managedwriter.DefaultStream),
+		managedwriter.WithSchemaDescriptor(normalized))
+	if err != nil {
+		table.client.Close()
+		return nil, err
+	}
+	return table, nil
+}
+
+// storageTableSchema converts the fields of the table from the REST API to those of the Storage
+// Write API, where JSON columns take strings
+func storageTableSchema(fields []*bigqueryv2.TableFieldSchema) ([]*storagepb.TableFieldSchema, error) {
+	var result []*storagepb.TableFieldSchema
+	for _, field := range fields {
+		converted := &storagepb.TableFieldSchema{
+			Name: field.Name,
+			Mode: storagepb.TableFieldSchema_NULLABLE,
+		}
+		switch field.Mode {
+		case "REQUIRED":
+			converted.Mode = storagepb.TableFieldSchema_REQUIRED
+		case "REPEATED":
+			converted.Mode = storagepb.TableFieldSchema_REPEATED
+		}
+		switch field.Type {
+		case "STRING", "JSON":
+			converted.Type = storagepb.TableFieldSchema_STRING
+		case "INTEGER", "INT64":
+			converted.Type = storagepb.TableFieldSchema_INT64
+		case "FLOAT", "FLOAT64":
+			converted.Type = storagepb.TableFieldSchema_DOUBLE
+		case "BOOLEAN", "BOOL":
+			converted.Type = storagepb.TableFieldSchema_BOOL
+		case "TIMESTAMP":
+			converted.Type = storagepb.TableFieldSchema_TIMESTAMP
+		case "RECORD", "STRUCT":
+			converted.Type = storagepb.TableFieldSchema_STRUCT
+			var err error
+			converted.Fields, err = storageTableSchema(field.Fields)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			// the fields of objects are not in the other types
+			return nil, fmt.Errorf("unsupported type of column %s: %s", field.Name, field.Type)
+		}
+		result = append(result, converted)
+	}
+	return result, nil
+}
+
+// insert appends the row to the default stream and waits for the result
+func (table *bigQueryTable) insert(ctx context.Context, row []byte) error {
+	row, err := table.convertTimestamps(row)
+	if err != nil {
+		return archive.NewError(archive.ErrSchema, err)
+	}
+	message := dynamicpb.NewMessage(table.descriptor)
+	// the table may have only some of the fields, e.g. without those of analyzers
+	err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(row, message)
+	if err != nil {
+		return archive.NewError(archive.ErrSchema, err)
+	}
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return archive.NewError(archive.ErrSchema, err)
+	}
+	result, err := table.stream.AppendRows(ctx, [][]byte{data})
+	if err != nil {
+		return classifyGRPCError(err)
+	}
+	_, err = result.GetResult(ctx)
+	return classifyGRPCError(err)
+}
+
+// convertTimestamps replaces RFC 3339 strings of the TIMESTAMP columns in the row with
+// microseconds since the epoch, which the Storage Write API takes
+func (table *bigQueryTable) convertTimestamps(row []byte) ([]byte, error) {
+	if len(table.timestampColumns) == 0 {
+		return row, nil
+	}
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(row, &fields)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range table.timestampColumns {
+		var value string
+		if json.Unmarshal(fields[name], &value) != nil {
+			// null, missing, or already a number
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not in RFC 3339: %v", name, err)
+		}
+		fields[name] = json.RawMessage(fmt.Sprint(t.UnixNano() / int64(time.Microsecond)))
+	}
+	return json.Marshal(fields)
+}
+
+// classifyGRPCError returns err of the Storage Write API classified by its status code
+func classifyGRPCError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.Canceled) {
+		return archive.NewError(archive.ErrPermanent, err)
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return archive.Classify(err)
+	}
+	switch s.Code() {
+	case codes.InvalidArgument:
+		return archive.NewError(archive.ErrSchema, err)
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Internal:
+		return archive.NewError(archive.ErrRetryable, err)
+	}
+	return archive.NewError(archive.ErrPermanent, err)
+}
+
+// close closes the stream after the rows in flight are appended
+func (table *bigQueryTable) close() {
+	err := table.stream.Close()
+	if err != nil {
+		log.Printf("Failed to close the BigQuery stream: %v", err)
+	}
+	table.client.Close()
+}
+
+// insertBigQueryRow inserts the row of an uploaded object, logging errors, as the object is
+// already stored
+func insertBigQueryRow(ctx context.Context, objectName string, row []byte) {
+	err := bigQuery.insert(ctx, row)
+	if err != nil {
+		log.Printf("Failed to insert a BigQuery row of \"%s\": %v", objectName, err)
+		metricBigQueryErrors.Add(1)
+		return
+	}
+	metricBigQueryRows.Add(1)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	json "github.com/goccy/go-json"
+)
+
+// batching of connections into messages of message-bus sinks, Kafka and Pub/Sub
+var (
+	// max number of connections in a message, or 0 to send a message per connection (-bus-batch-conns)
+	busBatchConns int
+	// max size of a message of a batch, or 0 for the limit of the sink (-bus-batch-bytes)
+	busBatchBytes int
+	// max delay of a connection in a partial batch (-bus-batch-delay)
+	busBatchDelay = time.Second
+)
+
+// the version of busBatchEnvelope
+const busBatchVersion = 1
+
+// the value of a message of a batch, marked by "batch: 1" in the headers or the attributes
+type busBatchEnvelope struct {
+	BatchVersion int              `json:"batch_version"`
+	Host         string           `json:"host"`
+	NumRecords   int              `json:"num_records"`
+	Records      []busBatchRecord `json:"records"`
+}
+
+// a connection in a batch, whose object is in "record" if it is plain JSON, or in "data" in
+// base64 otherwise
+type busBatchRecord struct {
+	Object          string          `json:"object"`
+	Key             string          `json:"key"`
+	ContentEncoding string          `json:"content_encoding,omitempty"`
+	PayloadFormat   string          `json:"payload_format,omitempty"`
+	Record          json.RawMessage `json:"record,omitempty"`
+	Data            []byte          `json:"data,omitempty"`
+}
+
+// messageKey returns the key of a message of a connection on the buses, which is the dcid of the
+// connection, or the object name for quicly:connect, which has no dcid
+func messageKey(objectName string, entry *logEntry) string {
+	if entry.nameEvent != nil {
+		if dcid := entry.nameEvent["dcid"]; dcid != nil {
+			return fmt.Sprint(dcid)
+		}
+	}
+	return objectName
+}
+
+// the estimated size of the fields of a record in the envelope except the payload
+const busBatchRecordOverhead = 256
+
+// busBatcher buffers connections for a sink, and sends them as a message when the batch has
+// -bus-batch-conns connections, when it would exceed the size, or after -bus-batch-delay
+type busBatcher struct {
+	ctx      context.Context
+	maxBytes int
+	send     func(ctx context.Context, records []busBatchRecord)
+
+	mutex   sync.Mutex
+	records []busBatchRecord
+	// the estimated size of the envelope
+	size  int
+	timer *time.Timer
+}
+
+// newBusBatcher returns a batcher of messages up to maxBytes unless -bus-batch-bytes is
+// smaller, or nil if -bus-batch-conns is not given
+func newBusBatcher(ctx context.Context, maxBytes int, send func(ctx context.Context, records []busBatchRecord)) *busBatcher {
+	if busBatchConns <= 1 {
+		return nil
+	}
+	if busBatchBytes > 0 && busBatchBytes < maxBytes {
+		maxBytes = busBatchBytes
+	}
+	return &busBatcher{
+		ctx:      ctx,
+		maxBytes: maxBytes,
+		send:     send,
+	}
+}
+
+// estimatedRecordSize returns the size of a connection in the envelope, where data in base64
+// is 4/3 of the payload
+func estimatedRecordSize(objectName string, payload []byte) int {
+	return len(objectName) + busBatchRecordOverhead + (len(payload)+2)/3*4
+}
+
+// add buffers the connection, and returns false if it's too large for a batch, which is to be
+// sent alone
+func (batcher *busBatcher) add(objectName string, entry *logEntry, payload []byte, contentEncoding string) bool {
+	size := estimatedRecordSize(objectName, payload)
+	if size > batcher.maxBytes/2 {
+		return false
+	}
+	record := busBatchRecord{
+		Object:          objectName,
+		Key:             messageKey(objectName, entry),
+		ContentEncoding: contentEncoding,
+	}
+	if payloadFormat != payloadFormatJSON {
+		record.PayloadFormat = payloadFormat
+	}
+	if contentEncoding == "" && payloadFormat == payloadFormatJSON {
+		record.Record = payload
+	} else {
+		record.Data = payload
+	}
+
+	var batches [][]busBatchRecord
+	batcher.mutex.Lock()
+	if len(batcher.records) > 0 && batcher.size+size > batcher.maxBytes {
+		batches = append(batches, batcher.take())
+	}
+	batcher.records = append(batcher.records, record)
+	batcher.size += size
+	if len(batcher.records) >= busBatchConns {
+		batches = append(batches, batcher.take())
+	} else if batcher.timer == nil {
+		batcher.timer = time.AfterFunc(busBatchDelay, batcher.flush)
+	}
+	batcher.mutex.Unlock()
+
+	for _, records := range batches {
+		batcher.send(batcher.ctx, records)
+	}
+	return true
+}
+
+// take returns the buffered connections and resets the batch. The caller must hold the mutex.
+func (batcher *busBatcher) take() []busBatchRecord {
+	records := batcher.records
+	batcher.records = nil
+	batcher.size = 0
+	if batcher.timer != nil {
+		batcher.timer.Stop()
+		batcher.timer = nil
+	}
+	return records
+}
+
+// flush sends the buffered connections, if any. It does nothing if batcher is nil.
+func (batcher *busBatcher) flush() {
+	if batcher == nil {
+		return
+	}
+	batcher.mutex.Lock()
+	records := batcher.take()
+	batcher.mutex.Unlock()
+	if len(records) > 0 {
+		batcher.send(batcher.ctx, records)
+	}
+}
+
+// encodeBusBatch returns the value of a message of the connections
+func encodeBusBatch(records []busBatchRecord) ([]byte, error) {
+	return json.Marshal(busBatchEnvelope{
+		BatchVersion: busBatchVersion,
+		Host:         host,
+		NumRecords:   len(records),
+		Records:      records,
+	})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBusBatcher(t *testing.T) {
+	defer func(conns int, maxBytes int, delay time.Duration) {
+		busBatchConns = conns
+		busBatchBytes = maxBytes
+		busBatchDelay = delay
+	}(busBatchConns, busBatchBytes, busBatchDelay)
+	// batches are sent only when they are full or flushed
+	busBatchDelay = time.Hour
+
+	// a record of a payload of 300 bytes takes 2+256+400 bytes
+	recordSize := estimatedRecordSize("o1", make([]byte, 300))
+	tests := []struct {
+		name       string
+		batchConns int
+		batchBytes int
+		maxBytes   int
+		payloads   []int
+		// the objects of the messages sent, the last of which is sent by flush
+		want [][]string
+		// the objects too large for a batch
+		wantAlone []string
+	}{
+		{
+			name:       "by connections",
+			batchConns: 3,
+			maxBytes:   1 << 20,
+			payloads:   []int{10, 10, 10, 10, 10, 10, 10},
+			want:       [][]string{{"o1", "o2", "o3"}, {"o4", "o5", "o6"}, {"o7"}},
+		},
+		{
+			name:       "by size",
+			batchConns: 100,
+			maxBytes:   2000,
+			payloads:   []int{300, 300, 300, 300, 300},
+			want:       [][]string{{"o1", "o2", "o3"}, {"o4", "o5"}},
+		},
+		{
+			name:       "exact fit",
+			batchConns: 100,
+			maxBytes:   recordSize * 2,
+			payloads:   []int{300, 300, 300},
+			want:       [][]string{{"o1", "o2"}, {"o3"}},
+		},
+		{
+			name:       "by connections before size",
+			batchConns: 2,
+			maxBytes:   recordSize * 2,
+			payloads:   []int{300, 300, 300},
+			want:       [][]string{{"o1", "o2"}, {"o3"}},
+		},
+		{
+			name:       "too large for a batch",
+			batchConns: 100,
+			maxBytes:   2000,
+			payloads:   []int{300, 1200, 300},
+			want:       [][]string{{"o1", "o3"}},
+			wantAlone:  []string{"o2"},
+		},
+		{
+			name:       "-bus-batch-bytes",
+			batchConns: 100,
+			batchBytes: 1400,
+			maxBytes:   1 << 20,
+			payloads:   []int{300, 300, 300, 300, 300},
+			want:       [][]string{{"o1", "o2"}, {"o3", "o4"}, {"o5"}},
+		},
+		{
+			name:       "-bus-batch-bytes larger than the limit of the sink",
+			batchConns: 100,
+			batchBytes: 1 << 20,
+			maxBytes:   2000,
+			payloads:   []int{300, 300, 300, 300, 300},
+			want:       [][]string{{"o1", "o2", "o3"}, {"o4", "o5"}},
+		},
+		{
+			name:       "empty",
+			batchConns: 100,
+			maxBytes:   2000,
+			want:       nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			busBatchConns = test.batchConns
+			busBatchBytes = test.batchBytes
+			var sent [][]string
+			batcher := newBusBatcher(context.Background(), test.maxBytes, func(ctx context.Context, records []busBatchRecord) {
+				objects := make([]string, 0, len(records))
+				for _, record := range records {
+					objects = append(objects, record.Object)
+				}
+				sent = append(sent, objects)
+			})
+			var alone []string
+			for i, size := range test.payloads {
+				objectName := fmt.Sprintf("o%d", i+1)
+				if !batcher.add(objectName, &logEntry{}, make([]byte, size), "zstd") {
+					alone = append(alone, objectName)
+				}
+			}
+			batcher.flush()
+			if !reflect.DeepEqual(sent, test.want) {
+				t.Errorf("sent %v, want %v", sent, test.want)
+			}
+			if !reflect.DeepEqual(alone, test.wantAlone) {
+				t.Errorf("%v are sent alone, want %v", alone, test.wantAlone)
+			}
+		})
+	}
+}
+
+func TestBusBatcherRecords(t *testing.T) {
+	defer func(conns int, delay time.Duration, format string) {
+		busBatchConns = conns
+		busBatchDelay = delay
+		payloadFormat = format
+	}(busBatchConns, busBatchDelay, payloadFormat)
+	busBatchConns = 100
+	busBatchDelay = time.Hour
+
+	tests := []struct {
+		name            string
+		format          string
+		contentEncoding string
+		nameEvent       h2ologEvent
+		want            busBatchRecord
+	}{
+		{
+			name:   "plain JSON",
+			format: payloadFormatJSON,
+			want:   busBatchRecord{Object: "o", Key: "o", Record: []byte(`{}`)},
+		},
+		{
+			name:            "compressed",
+			format:          payloadFormatJSON,
+			contentEncoding: "zstd",
+			want:            busBatchRecord{Object: "o", Key: "o", ContentEncoding: "zstd", Data: []byte(`{}`)},
+		},
+		{
+			name:   "another format",
+			format: payloadFormatNDJSON,
+			want:   busBatchRecord{Object: "o", Key: "o", PayloadFormat: payloadFormatNDJSON, Data: []byte(`{}`)},
+		},
+		{
+			name:      "keyed by DCID",
+			format:    payloadFormatJSON,
+			nameEvent: h2ologEvent{"type": "accept", "dcid": "bc6ace5c680ed855"},
+			want:      busBatchRecord{Object: "o", Key: "bc6ace5c680ed855", Record: []byte(`{}`)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payloadFormat = test.format
+			var sent []busBatchRecord
+			batcher := newBusBatcher(context.Background(), 1<<20, func(ctx context.Context, records []busBatchRecord) {
+				sent = append(sent, records...)
+			})
+			batcher.add("o", &logEntry{nameEvent: test.nameEvent}, []byte(`{}`), test.contentEncoding)
+			batcher.flush()
+			if len(sent) != 1 || !reflect.DeepEqual(sent[0], test.want) {
+				t.Errorf("sent %+v, want %+v", sent, test.want)
+			}
+		})
+	}
+}
+
+func TestBusBatcherFlushesAfterDelay(t *testing.T) {
+	defer func(conns int, delay time.Duration) {
+		busBatchConns = conns
+		busBatchDelay = delay
+	}(busBatchConns, busBatchDelay)
+	busBatchConns = 100
+	busBatchDelay = 10 * time.Millisecond
+
+	sent := make(chan []busBatchRecord, 1)
+	batcher := newBusBatcher(context.Background(), 1<<20, func(ctx context.Context, records []busBatchRecord) {
+		sent <- records
+	})
+	batcher.add("o1", &logEntry{}, []byte(`{}`), "")
+	batcher.add("o2", &logEntry{}, []byte(`{}`), "")
+	select {
+	case records := <-sent:
+		if len(records) != 2 {
+			t.Errorf("sent %d records, want 2", len(records))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the batch is not sent after -bus-batch-delay")
+	}
+}
+
+func TestNewBusBatcherWithoutBatching(t *testing.T) {
+	defer func(conns int) { busBatchConns = conns }(busBatchConns)
+	for _, conns := range []int{0, 1} {
+		busBatchConns = conns
+		batcher := newBusBatcher(context.Background(), 1<<20, nil)
+		if batcher != nil {
+			t.Errorf("a batcher for -bus-batch-conns=%d", conns)
+		}
+		// nil-safe
+		batcher.flush()
+	}
+}
+
+func TestEncodeBusBatch(t *testing.T) {
+	defer func(savedHost string) { host = savedHost }(host)
+	host = "test"
+	data, err := encodeBusBatch([]busBatchRecord{{Object: "o", Key: "k", Record: []byte(`{"id":"o"}`)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"batch_version":1,"host":"test","num_records":1,"records":[{"object":"o","key":"k","record":{"id":"o"}}]}`
+	if got := strings.TrimSpace(string(data)); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	json "github.com/goccy/go-json"
+
+	"github.com/gfx/h2olog-collector-gcs/archive"
+)
+
+// a row per event in the ClickHouse table
+type clickHouseRow struct {
+	host   string
+	object string
+	connID int64
+	typ    string
+	// in milliseconds
+	time uint64
+	// the packet number, or nil for events without "pn"
+	pn interface{}
+	// the event in JSON
+	raw string
+}
+
+// a ClickHouse table into which it inserts a row per event of uploaded objects in batches
+// (-clickhouse-dsn), by the native protocol, where a batch is sent as a block
+type clickHouseTable struct {
+	db *sql.DB
+	// the query to prepare for the rows of a batch
+	insertQuery string
+	batchSize   int
+
+	mutex sync.Mutex
+	batch []clickHouseRow
+}
+
+var clickHouse *clickHouseTable
+
+// newClickHouseTable parses a DSN of the native protocol with the table as a parameter, e.g.
+// "tcp://localhost:9000?username=default&database=default&table=h2olog_events"
+func newClickHouseTable(ctx context.Context, dsn string, batchSize int, flushInterval time.Duration) (*clickHouseTable, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "tcp" {
+		return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+	query := u.Query()
+	tableName := query.Get("table")
+	if tableName == "" {
+		tableName = "h2olog_events"
+	}
+	query.Del("table")
+	u.RawQuery = query.Encode()
+
+	db, err := sql.Open("clickhouse", u.String())
+	if err != nil {
+		return nil, err
+	}
+	table := &clickHouseTable{
+		db:          db,
+		insertQuery: fmt.Sprintf("INSERT INTO %s (host, object, conn_id, type, time, pn, raw) VALUES (?, ?, ?, ?, ?, ?, ?)", tableName),
+		batchSize:   batchSize,
+	}
+	go func() {
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			table.flush(ctx)
+		}
+	}()
+	return table, nil
+}
+
+// add buffers the rows of the events of an uploaded object, inserting them when the batch is full
+func (table *clickHouseTable) add(ctx context.Context, objectName string, entry *logEntry) {
+	table.mutex.Lock()
+	for _, rawEvent := range entry.events {
+		raw, err := json.Marshal(rawEvent)
+		if err != nil {
+			log.Printf("Cannot serialize an event for ClickHouse: %v", err)
+			continue
+		}
+		row := clickHouseRow{
+			host:   entry.host,
+			object: objectName,
+			connID: entry.connID,
+			raw:    string(raw),
+		}
+		row.typ, _ = rawEvent["type"].(string)
+		timeMillis, _ := eventInt64(rawEvent, "time")
+		row.time = uint64(timeMillis)
+		if pn, ok := eventInt64(rawEvent, "pn"); ok {
+			row.pn = pn
+		}
+		table.batch = append(table.batch, row)
+	}
+	full := len(table.batch) >= table.batchSize
+	table.mutex.Unlock()
+
+	if full {
+		table.flush(ctx)
+	}
+}
+
+// flush inserts the buffered rows
+func (table *clickHouseTable) flush(ctx context.Context) {
+	table.mutex.Lock()
+	if len(table.batch) == 0 {
+		table.mutex.Unlock()
+		return
+	}
+	rows := table.batch
+	table.batch = nil
+	table.mutex.Unlock()
+
+	err := table.insert(ctx, rows)
+	if err != nil {
+		log.Printf("Failed to insert %d rows into ClickHouse: %v", len(rows), err)
+		metricClickHouseErrors.Add(1)
+		return
+	}
+	metricClickHouseRows.Add(int64(len(rows)))
+	if debug {
+		log.Printf("[D] Inserted %d rows into ClickHouse", len(rows))
+	}
+}
+
+// insert sends the rows as a block, which the driver builds from the statement executed in a
+// transaction and sends on commit
+func (table *clickHouseTable) insert(ctx context.Context, rows []clickHouseRow) error {
+	tx, err := table.db.BeginTx(ctx, nil)
+	if err != nil {
+		return classifyClickHouseError(err)
+	}
+	stmt, err := tx.PrepareContext(ctx, table.insertQuery)
+	if err != nil {
+		tx.Rollback()
+		return classifyClickHouseError(err)
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		_, err = stmt.ExecContext(ctx, row.host, row.object, row.connID, row.typ, row.time, row.pn, row.raw)
+		if err != nil {
+			tx.Rollback()
+			return archive.NewError(archive.ErrSchema, err)
+		}
+	}
+	return classifyClickHouseError(tx.Commit())
+}
+
+// classifyClickHouseError returns err classified as ErrPermanent if the server refused the
+// query, e.g. for a missing table, or by archive.Classify otherwise, e.g. for network errors
+func classifyClickHouseError(err error) error {
+	var exception *clickhouse.Exception
+	if errors.As(err, &exception) {
+		return archive.NewError(archive.ErrPermanent, err)
+	}
+	return archive.Classify(err)
+}
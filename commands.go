@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	json "github.com/goccy/go-json"
+
+	"github.com/gfx/h2olog-collector-gcs/archive"
+)
+
+// a subcommand, which runs instead of collecting logs from STDIN
+type subcommand struct {
+	usage string
+	run   func(ctx context.Context, store archive.Store, args []string) error
+	// true if it runs without -bucket nor -local, where store is nil
+	storeOptional bool
+}
+
+var subcommands = map[string]subcommand{
+	"events": {
+		usage: "events NAME: print the events of a stored object as JSON lines",
+		run:   runEvents,
+	},
+	"train-zstd-dict": {
+		usage: "train-zstd-dict OUTPUT [PREFIX]: train a zstd dictionary for -zstd-dict from stored objects (requires the zstd command)",
+		run:   runTrainZstdDict,
+	},
+	"convert": {
+		usage: "convert [-to parquet] [-batch-size N] OUTPUT_DIR [PREFIX]: rewrite stored objects into columnar files of events in OUTPUT_DIR",
+		run:   runConvert,
+	},
+	"migrate": {
+		usage: "migrate [PREFIX]: rewrite stored objects of older schema versions to the current one",
+		run:   runMigrate,
+	},
+	"support-bundle": {
+		usage:         "support-bundle OUTPUT: write a tar.gz of the version, the effective flags, the latest audit log, and the metrics of -metrics-addr for bug reports",
+		run:           runSupportBundle,
+		storeOptional: true,
+	},
+}
+
+// runEvents prints the events of an object in the same format as h2olog emits
+func runEvents(ctx context.Context, store archive.Store, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: events NAME")
+	}
+	reader, err := archive.OpenEvents(ctx, store, args[0])
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer := bufio.NewWriter(os.Stdout)
+	defer writer.Flush()
+	for {
+		event, err := reader.Next()
+		if err == archive.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		writer.Write(line)
+		writer.WriteByte('\n')
+	}
+}
+
+// runMigrate rewrites objects to the current schema version
+func runMigrate(ctx context.Context, store archive.Store, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: migrate [PREFIX]")
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+
+	numMigrated := 0
+	numSkipped := 0
+	it := archive.Records(ctx, store, prefix)
+	for {
+		record, err := it.Next()
+		if err == archive.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !archive.Migrate(record) {
+			numSkipped++
+			continue
+		}
+
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasSuffix(record.Name, ".gz"):
+			data, err = gzipBytes(data)
+			if err != nil {
+				return err
+			}
+		case strings.HasSuffix(record.Name, ".zst"):
+			// with the dictionary of -zstd-dict if any, which the object is read with
+			if zstdEncoder == nil {
+				if err := setupZstdEncoder(); err != nil {
+					return err
+				}
+			}
+			data, _ = compressPayload(data, compressZstd)
+		}
+		err = store.Write(ctx, record.Name, data)
+		if err != nil {
+			return err
+		}
+		numMigrated++
+		if debug {
+			log.Printf("[D] Migrated \"%s\"", record.Name)
+		}
+	}
+	log.Printf("Migrated %d objects to schema version %d (%d objects are up to date)", numMigrated, archive.CurrentSchemaVersion, numSkipped)
+	return nil
+}
+
+// the max number of objects used as samples by train-zstd-dict
+const maxZstdDictSamples = 1000
+
+// runTrainZstdDict writes stored objects into a temporary directory as samples, and runs `zstd --train`
+func runTrainZstdDict(ctx context.Context, store archive.Store, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: train-zstd-dict OUTPUT [PREFIX]")
+	}
+	output := args[0]
+	prefix := ""
+	if len(args) == 2 {
+		prefix = args[1]
+	}
+
+	sampleDir, err := os.MkdirTemp("", "h2olog-zstd-samples")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(sampleDir)
+
+	names, err := store.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	if len(names) > maxZstdDictSamples {
+		names = names[len(names)-maxZstdDictSamples:]
+	}
+
+	samples := make([]string, 0, len(names))
+	for i, name := range names {
+		data, err := archive.ReadObject(ctx, store, name)
+		if err != nil {
+			return err
+		}
+		sample := filepath.Join(sampleDir, fmt.Sprintf("%d.json", i))
+		err = os.WriteFile(sample, data, 0644)
+		if err != nil {
+			return err
+		}
+		samples = append(samples, sample)
+	}
+	if len(samples) == 0 {
+		return fmt.Errorf("no objects found")
+	}
+
+	command := exec.CommandContext(ctx, "zstd", append([]string{"--train", "-q", "-o", output}, samples...)...)
+	command.Stdout = os.Stderr
+	command.Stderr = os.Stderr
+	err = command.Run()
+	if err != nil {
+		return err
+	}
+	log.Printf("Trained a zstd dictionary from %d objects into %s", len(samples), output)
+	return nil
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	writer := gzip.NewWriter(buffer)
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	return buffer.Bytes(), err
+}
+
+func printSubcommands() {
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Subcommands (with -bucket or -local):\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", subcommands[name].usage)
+	}
+}
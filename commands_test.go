@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	json "github.com/goccy/go-json"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/gfx/h2olog-collector-gcs/archive"
+)
+
+func TestMigrate(t *testing.T) {
+	defer func(encoder *zstd.Encoder) { zstdEncoder = encoder }(zstdEncoder)
+	zstdEncoder = nil
+
+	// a version 1 object without "role"
+	object := []byte(`{"schema_version":1,"id":"test-1","conn_id":1,"payload":[{"type":"accept","conn":1,"time":1}]}`)
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzipped, err := gzipBytes(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"test-1.json":     object,
+		"test-2.json.gz":  gzipped,
+		"test-3.json.zst": encoder.EncodeAll(object, nil),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := runMigrate(context.Background(), archive.NewLocalStore(dir), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for name := range files {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// decompressed by the suffix, which fails if the content doesn't match it
+		var reader io.Reader = bytes.NewReader(data)
+		switch filepath.Ext(name) {
+		case ".gz":
+			if reader, err = gzip.NewReader(reader); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		case ".zst":
+			decoder, err := zstd.NewReader(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer decoder.Close()
+			reader = decoder
+		}
+		var migrated struct {
+			SchemaVersion int    `json:"schema_version"`
+			Role          string `json:"role"`
+		}
+		if err := json.NewDecoder(reader).Decode(&migrated); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if migrated.SchemaVersion != archive.CurrentSchemaVersion || migrated.Role != "server" {
+			t.Errorf("%s is not migrated: %+v", name, migrated)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/gfx/h2olog-collector-gcs/archive"
+)
+
+// content encodings of objects (-compress)
+const (
+	compressNone = "none"
+	compressZstd = "zstd"
+	compressGzip = "gzip"
+)
+
+// the content encoding of objects, or "" for plain JSON
+var compression string
+
+// the zstd encoder with the dictionary given by -zstd-dict if any, or nil if zstd is disabled
+var zstdEncoder *zstd.Encoder
+
+// setupCompression sets up -compress. dictPath is a dictionary trained by the train-zstd-dict
+// subcommand, which is optional for zstd.
+func setupCompression(method string, dictPath string) error {
+	if dictPath != "" && method != compressZstd {
+		return fmt.Errorf("-zstd-dict requires -compress=zstd")
+	}
+	switch method {
+	case compressNone:
+		compression = ""
+		return nil
+	case compressGzip:
+		compression = "gzip"
+		return nil
+	case compressZstd:
+		compression = "zstd"
+	default:
+		return fmt.Errorf("unknown compression: %s", method)
+	}
+
+	options := make([]zstd.EOption, 0, 1)
+	if dictPath != "" {
+		dict, err := os.ReadFile(dictPath)
+		if err != nil {
+			return err
+		}
+		archive.AddZstdDict(dict)
+		options = append(options, zstd.WithEncoderDict(dict))
+	}
+	return setupZstdEncoder(options...)
+}
+
+// setupZstdEncoder creates zstdEncoder, e.g. for -sink-formats with zstd
+func setupZstdEncoder(options ...zstd.EOption) error {
+	// EncodeAll is safe for concurrent use, so an encoder is shared by uploads
+	var err error
+	zstdEncoder, err = zstd.NewWriter(nil, options...)
+	return err
+}
+
+// compressPayload compresses a serialized object with the content encoding, typically
+// compression, and returns the content encoding of the result
+func compressPayload(payload []byte, contentEncoding string) ([]byte, string) {
+	switch contentEncoding {
+	case "zstd":
+		return zstdEncoder.EncodeAll(payload, make([]byte, 0, len(payload)/4)), contentEncoding
+	case "gzip":
+		compressed, err := gzipBytes(payload)
+		if err != nil {
+			log.Fatalf("Cannot compress the payload: %v", err)
+		}
+		return compressed, contentEncoding
+	default:
+		return payload, ""
+	}
+}
+
+// fileSuffix returns the suffix of local files for the content encoding and the payload format
+func fileSuffix(contentEncoding string, payloadFormat string) string {
+	suffix := ".json"
+	switch payloadFormat {
+	case payloadFormatParquet:
+		return ".parquet"
+	case payloadFormatAvro:
+		return ".avro"
+	case payloadFormatQlog:
+		suffix = ".qlog"
+	}
+	switch contentEncoding {
+	case "zstd":
+		return suffix + ".zst"
+	case "gzip":
+		return suffix + ".gz"
+	default:
+		return suffix
+	}
+}
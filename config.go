@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// loadConfig sets flags from a YAML or TOML file (-config), whose keys are flag names, e.g.
+// "max-num-events: 1000". Lists are joined with commas. Flags already given in the command
+// line or environment variables take precedence over the file.
+func loadConfig(filePath string) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return fmt.Errorf("unknown config format: %s", filePath)
+	}
+	if err != nil {
+		return err
+	}
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	for name, value := range values {
+		if name == "config" {
+			return fmt.Errorf("-config cannot be nested")
+		}
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown flag in %s: %s", filePath, name)
+		}
+		if given[name] {
+			continue
+		}
+		err := flag.Set(name, configValueString(value))
+		if err != nil {
+			return fmt.Errorf("invalid value of %s in %s: %v", name, filePath, err)
+		}
+	}
+	return nil
+}
+
+func configValueString(value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		items := make([]string, 0, len(list))
+		for _, item := range list {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+// the prefix of environment variables for flags, e.g. H2OLOG_COLLECT_MAX_NUM_EVENTS for -max-num-events
+const envPrefix = "H2OLOG_COLLECT_"
+
+// envName returns the environment variable for the flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadEnv sets flags from H2OLOG_COLLECT_* environment variables. Flags given in the command
+// line take precedence over environment variables, which take precedence over -config.
+func loadEnv() error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || given[f.Name] || err != nil {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value of %s: %v", envName(f.Name), setErr)
+		}
+	})
+	return err
+}
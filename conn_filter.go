@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// filters of connections to track by the client address (-filter-client-cidr) and by SNI
+// (-filter-sni-glob), or nil to track all
+var (
+	clientCIDRFilter *cidrFilter
+	sniGlobFilter    *globFilter
+)
+
+// cidrFilter allows client addresses in any of allow, if given, and not in any of deny
+type cidrFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// parseCIDRFilter parses comma-separated CIDRs or addresses, those prefixed with "!" denied,
+// e.g. "203.0.113.0/24,!203.0.113.8"
+func parseCIDRFilter(s string) (*cidrFilter, error) {
+	filter := &cidrFilter{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		denied := strings.HasPrefix(item, "!")
+		item = strings.TrimPrefix(item, "!")
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			// by the literal form, as net.ParseCIDR takes the prefix of an IPv4-mapped IPv6
+			// address, e.g. ::ffff:203.0.113.1, in 128 bits
+			if strings.Contains(item, ":") {
+				item += "/128"
+			} else {
+				item += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		if denied {
+			filter.deny = append(filter.deny, ipNet)
+		} else {
+			filter.allow = append(filter.allow, ipNet)
+		}
+	}
+	return filter, nil
+}
+
+// match reports whether the address is allowed. An unknown address, nil, is allowed only if
+// there are no allowed CIDRs. It returns true if filter is nil.
+func (filter *cidrFilter) match(ip net.IP) bool {
+	if filter == nil {
+		return true
+	}
+	if ip == nil {
+		return len(filter.allow) == 0
+	}
+	for _, ipNet := range filter.deny {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(filter.allow) == 0 {
+		return true
+	}
+	for _, ipNet := range filter.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// globFilter allows SNI matching any of allow, if given, and none of deny, in path.Match syntax
+type globFilter struct {
+	allow []string
+	deny  []string
+}
+
+// parseGlobFilter parses comma-separated glob patterns, those prefixed with "!" denied,
+// e.g. "*.example.com,!internal.example.com"
+func parseGlobFilter(s string) (*globFilter, error) {
+	filter := &globFilter{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		denied := strings.HasPrefix(item, "!")
+		item = strings.TrimPrefix(item, "!")
+		if item == "" {
+			continue
+		}
+		if _, err := path.Match(item, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern \"%s\": %v", item, err)
+		}
+		if denied {
+			filter.deny = append(filter.deny, item)
+		} else {
+			filter.allow = append(filter.allow, item)
+		}
+	}
+	return filter, nil
+}
+
+// match reports whether the SNI is allowed, case-insensitively. Connections without SNI are
+// allowed only if there are no allowed patterns. It returns true if filter is nil.
+func (filter *globFilter) match(sni string) bool {
+	if filter == nil {
+		return true
+	}
+	if sni == "" {
+		return len(filter.allow) == 0
+	}
+	sni = strings.ToLower(sni)
+	for _, pattern := range filter.deny {
+		if matched, _ := path.Match(pattern, sni); matched {
+			return false
+		}
+	}
+	if len(filter.allow) == 0 {
+		return true
+	}
+	for _, pattern := range filter.allow {
+		if matched, _ := path.Match(pattern, sni); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClientIP returns the IP address of "remote-addr", which may have a port, or nil
+func parseClientIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(addr)
+}
+
+// filterConn decides whether the connection is tracked once quicly:accept or quicly:connect
+// names it and the fields that the filters need are known, or at quicly:free with what is known.
+// decided is false while it waits for the fields.
+func filterConn(entry *logEntry, final bool) (tracked bool, decided bool) {
+	if entry.nameEvent == nil && !final {
+		return true, false
+	}
+	if !final && ((clientCIDRFilter != nil && entry.clientAddr == "") || (sniGlobFilter != nil && entry.sni == "")) {
+		return true, false
+	}
+	var ip net.IP
+	if entry.clientAddr != "" {
+		ip = parseClientIP(entry.clientAddr)
+	}
+	return clientCIDRFilter.match(ip) && sniGlobFilter.match(entry.sni), true
+}
+
+// awaitingFilter reports whether -filter-client-cidr or -filter-sni-glob has not decided whether
+// to track the connection yet, in which case it must not be uploaded
+func (entry *logEntry) awaitingFilter() bool {
+	return (clientCIDRFilter != nil || sniGlobFilter != nil) && !entry.filterDecided
+}
+
+// untrackEntry drops the connection rejected by the filters, whose events are ignored until
+// quicly:free. The caller must hold connsMutex.
+func untrackEntry(entry *logEntry) {
+	entry.processed = true
+	entry.untracked = true
+	atomic.AddInt64(&numLiveConns, -1)
+	if key := (connKey{entry.source, entry.h2oConnID}); h2oConns[key] == entry {
+		delete(h2oConns, key)
+	}
+	entry.releaseBuffer()
+	entry.estimatedSize = 0
+	entry.events = nil
+	entry.analyzers = nil
+	entry.source.acker.release(entry)
+	metricConnsUntracked.Add(1)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCIDRFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		addr   string
+		want   bool
+	}{
+		{"203.0.113.0/24", "203.0.113.5", true},
+		{"203.0.113.0/24", "198.51.100.1", false},
+		{"203.0.113.0/24", "", false},
+		{"!203.0.113.8", "203.0.113.8", false},
+		{"!203.0.113.8", "203.0.113.9", true},
+		{"!203.0.113.8", "", true},
+		{"203.0.113.0/24,!203.0.113.8", "203.0.113.8", false},
+		{"203.0.113.0/24,!203.0.113.8", "203.0.113.9", true},
+		{"203.0.113.0/24,!203.0.113.8", "198.51.100.1", false},
+		{"198.51.100.0/24,203.0.113.0/24", "203.0.113.1", true},
+		{" 203.0.113.1 , ,", "203.0.113.1", true},
+		{" 203.0.113.1 , ,", "203.0.113.2", false},
+		{"2001:db8::/32", "2001:db8::1", true},
+		{"2001:db8::/32", "::1", false},
+		{"2001:db8::1", "2001:db8::1", true},
+		{"2001:db8::1", "2001:db8::2", false},
+		{"203.0.113.0/24", "2001:db8::1", false},
+		{"::ffff:203.0.113.1", "203.0.113.1", true},
+		{"::ffff:203.0.113.1", "203.0.113.2", false},
+		{"!::ffff:203.0.113.1", "203.0.113.2", true},
+		{"", "203.0.113.1", true},
+	}
+	for _, test := range tests {
+		filter, err := parseCIDRFilter(test.filter)
+		if err != nil {
+			t.Errorf("parseCIDRFilter(%q): %v", test.filter, err)
+			continue
+		}
+		var ip net.IP
+		if test.addr != "" {
+			ip = net.ParseIP(test.addr)
+		}
+		if got := filter.match(ip); got != test.want {
+			t.Errorf("%q.match(%q) = %v, want %v", test.filter, test.addr, got, test.want)
+		}
+	}
+}
+
+func TestCIDRFilterErrors(t *testing.T) {
+	for _, s := range []string{"203.0.113.0/33", "example.com", "!bogus", "203.0.113.0/24,foo"} {
+		if _, err := parseCIDRFilter(s); err == nil {
+			t.Errorf("no error for %q", s)
+		}
+	}
+}
+
+func TestNilCIDRFilter(t *testing.T) {
+	var filter *cidrFilter
+	if !filter.match(net.ParseIP("203.0.113.1")) || !filter.match(nil) {
+		t.Error("nil filter rejects addresses")
+	}
+}
+
+func TestGlobFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		sni    string
+		want   bool
+	}{
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "WWW.Example.COM", true},
+		{"*.example.com", "example.com", false},
+		// path.Match, whose * matches dots as well
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "", false},
+		{"!internal.example.com", "internal.example.com", false},
+		{"!internal.example.com", "www.example.com", true},
+		{"!internal.example.com", "", true},
+		{"*.example.com,!internal.example.com", "internal.example.com", false},
+		{"*.example.com,!internal.example.com", "www.example.com", true},
+		{"*.example.com,!INTERNAL.example.com", "Internal.Example.com", false},
+		{"example.com,example.net", "example.net", true},
+		{"api-?.example.com", "api-1.example.com", true},
+		{"api-?.example.com", "api-10.example.com", false},
+		{"", "www.example.com", true},
+	}
+	for _, test := range tests {
+		filter, err := parseGlobFilter(test.filter)
+		if err != nil {
+			t.Errorf("parseGlobFilter(%q): %v", test.filter, err)
+			continue
+		}
+		if got := filter.match(test.sni); got != test.want {
+			t.Errorf("%q.match(%q) = %v, want %v", test.filter, test.sni, got, test.want)
+		}
+	}
+}
+
+func TestGlobFilterErrors(t *testing.T) {
+	for _, s := range []string{"[", "*.example.com,!a[b"} {
+		if _, err := parseGlobFilter(s); err == nil {
+			t.Errorf("no error for %q", s)
+		}
+	}
+}
+
+func TestParseClientIP(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"203.0.113.1:443", "203.0.113.1"},
+		{"203.0.113.1", "203.0.113.1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"bogus", ""},
+		{"bogus:443", ""},
+	}
+	for _, test := range tests {
+		got := parseClientIP(test.addr)
+		if test.want == "" {
+			if got != nil {
+				t.Errorf("parseClientIP(%q) = %v, want nil", test.addr, got)
+			}
+		} else if !got.Equal(net.ParseIP(test.want)) {
+			t.Errorf("parseClientIP(%q) = %v, want %s", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestFilterConn(t *testing.T) {
+	defer func(cidr *cidrFilter, glob *globFilter) {
+		clientCIDRFilter = cidr
+		sniGlobFilter = glob
+	}(clientCIDRFilter, sniGlobFilter)
+
+	accept := h2ologEvent{"type": "accept"}
+	tests := []struct {
+		name        string
+		cidr        string
+		glob        string
+		nameEvent   h2ologEvent
+		clientAddr  string
+		sni         string
+		final       bool
+		wantTracked bool
+		wantDecided bool
+	}{
+		{name: "no filters", nameEvent: accept, wantTracked: true, wantDecided: true},
+		{name: "not named yet", cidr: "203.0.113.0/24", clientAddr: "203.0.113.1:443", wantTracked: true},
+		{name: "not named at free", final: true, wantTracked: true, wantDecided: true},
+		{name: "waiting for the address", cidr: "203.0.113.0/24", nameEvent: accept, wantTracked: true},
+		{name: "allowed address", cidr: "203.0.113.0/24", nameEvent: accept, clientAddr: "203.0.113.1:443", wantTracked: true, wantDecided: true},
+		{name: "denied address", cidr: "203.0.113.0/24", nameEvent: accept, clientAddr: "198.51.100.1:443", wantDecided: true},
+		{name: "unknown address at free", cidr: "203.0.113.0/24", nameEvent: accept, final: true, wantDecided: true},
+		{name: "unknown address at free with deny only", cidr: "!203.0.113.0/24", nameEvent: accept, final: true, wantTracked: true, wantDecided: true},
+		{name: "waiting for SNI", glob: "*.example.com", nameEvent: accept, clientAddr: "203.0.113.1:443", wantTracked: true},
+		{name: "allowed SNI", glob: "*.example.com", nameEvent: accept, sni: "www.example.com", wantTracked: true, wantDecided: true},
+		{name: "denied SNI", glob: "*.example.com", nameEvent: accept, sni: "example.net", wantDecided: true},
+		{name: "waiting for SNI with the address", cidr: "203.0.113.0/24", glob: "*.example.com", nameEvent: accept, clientAddr: "203.0.113.1:443", wantTracked: true},
+		{name: "both allowed", cidr: "203.0.113.0/24", glob: "*.example.com", nameEvent: accept, clientAddr: "203.0.113.1:443", sni: "www.example.com", wantTracked: true, wantDecided: true},
+		{name: "address denied and SNI allowed", cidr: "203.0.113.0/24", glob: "*.example.com", nameEvent: accept, clientAddr: "198.51.100.1:443", sni: "www.example.com", wantDecided: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clientCIDRFilter = nil
+			sniGlobFilter = nil
+			var err error
+			if test.cidr != "" {
+				if clientCIDRFilter, err = parseCIDRFilter(test.cidr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.glob != "" {
+				if sniGlobFilter, err = parseGlobFilter(test.glob); err != nil {
+					t.Fatal(err)
+				}
+			}
+			entry := &logEntry{nameEvent: test.nameEvent, clientAddr: test.clientAddr, sni: test.sni}
+			tracked, decided := filterConn(entry, test.final)
+			if tracked != test.wantTracked || decided != test.wantDecided {
+				t.Errorf("filterConn() = (%v, %v), want (%v, %v)", tracked, decided, test.wantTracked, test.wantDecided)
+			}
+		})
+	}
+}
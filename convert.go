@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	json "github.com/goccy/go-json"
+
+	"github.com/gfx/h2olog-collector-gcs/archive"
+)
+
+// the columns of a table of events, a row per event
+var eventParquetColumns = []parquetColumn{
+	{name: "object", physicalType: parquetByteArray},
+	{name: "host", physicalType: parquetByteArray},
+	{name: "conn_id", physicalType: parquetInt64},
+	{name: "type", physicalType: parquetByteArray},
+	{name: "time", physicalType: parquetInt64, optional: true},
+	{name: "pn", physicalType: parquetInt64, optional: true},
+	// the event in JSON
+	{name: "raw", physicalType: parquetByteArray},
+}
+
+// eventParquetRow returns a row of eventParquetColumns
+func eventParquetRow(objectName string, host string, connID int64, rawEvent h2ologEvent) ([]interface{}, error) {
+	raw, err := json.Marshal(rawEvent)
+	if err != nil {
+		return nil, err
+	}
+	eventType, _ := rawEvent["type"].(string)
+	row := []interface{}{objectName, host, connID, eventType, nil, nil, string(raw)}
+	if time, ok := eventInt64(rawEvent, "time"); ok {
+		row[4] = time
+	}
+	if pn, ok := eventInt64(rawEvent, "pn"); ok {
+		row[5] = pn
+	}
+	return row, nil
+}
+
+// runConvert rewrites stored objects into columnar files in a local directory, batching
+// objects into a file
+func runConvert(ctx context.Context, store archive.Store, args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	to := flags.String("to", "parquet", "The format of output files: parquet")
+	batchSize := flags.Int("batch-size", 1000, "Number of objects per output file")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return fmt.Errorf("usage: convert [-to parquet] [-batch-size N] OUTPUT_DIR [PREFIX]")
+	}
+	if *to != "parquet" {
+		return fmt.Errorf("unsupported format: %s", *to)
+	}
+	outputDir := flags.Arg(0)
+	prefix := flags.Arg(1)
+	err = os.MkdirAll(outputDir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	numFiles := 0
+	numObjects := 0
+	rows := make([][]interface{}, 0)
+	batched := 0
+	flush := func() error {
+		if batched == 0 {
+			return nil
+		}
+		err := writeParquetFile(filepath.Join(outputDir, fmt.Sprintf("part-%05d.parquet", numFiles)), rows)
+		if err != nil {
+			return err
+		}
+		numFiles++
+		rows = rows[:0]
+		batched = 0
+		return nil
+	}
+
+	it := archive.Records(ctx, store, prefix)
+	for {
+		record, err := it.Next()
+		if err == archive.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		for _, rawEvent := range record.Payload {
+			row, err := eventParquetRow(record.Name, record.Host, record.ConnID, rawEvent)
+			if err != nil {
+				return err
+			}
+			rows = append(rows, row)
+		}
+		numObjects++
+		batched++
+		if debug {
+			log.Printf("[D] Converted \"%s\"", record.Name)
+		}
+		if batched >= *batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	log.Printf("Converted %d objects into %d files in %s", numObjects, numFiles, outputDir)
+	return nil
+}
+
+func writeParquetFile(filePath string, rows [][]interface{}) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer, err := newParquetWriter(file, eventParquetColumns)
+	if err != nil {
+		return err
+	}
+	err = writer.writeRowGroup(rows)
+	if err != nil {
+		return err
+	}
+	err = writer.close()
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
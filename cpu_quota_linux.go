@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cpuQuota returns the CPU limit of the cgroup of the process in the number of CPUs,
+// or 0 if there is no limit
+func cpuQuota() float64 {
+	// cgroup v2: "$MAX $PERIOD" or "max $PERIOD"
+	if data, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 && fields[0] != "max" {
+			return divideQuota(fields[0], fields[1])
+		}
+		return 0
+	}
+	// cgroup v1, where the quota is -1 if there is no limit
+	quota, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	if err != nil {
+		return 0
+	}
+	period, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err != nil {
+		return 0
+	}
+	return divideQuota(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+func divideQuota(quota string, period string) float64 {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return q / p
+}
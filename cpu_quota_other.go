@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// cpuQuota returns 0, as cgroups are only on Linux
+func cpuQuota() float64 {
+	return 0
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	gcs "cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+)
+
+// the JSON of the resolved credentials, used to sign URLs; it may be empty with
+// Application Default Credentials from the metadata server
+var credentialsJSON []byte
+
+// resolveCredentials returns the client option of GCP credentials from, in the order of
+// precedence, -credentials-file, GOOGLE_APPLICATION_CREDENTIALS or other Application Default
+// Credentials, and authn.json embedded at build time.
+func resolveCredentials(ctx context.Context, filePath string) (option.ClientOption, error) {
+	if filePath != "" {
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		credentialsJSON = data
+		return option.WithCredentialsJSON(data), nil
+	}
+
+	// this also reads GOOGLE_APPLICATION_CREDENTIALS
+	credentials, err := google.FindDefaultCredentials(ctx, gcs.ScopeReadWrite)
+	if err == nil {
+		credentialsJSON = credentials.JSON
+		return option.WithCredentials(credentials), nil
+	}
+	if os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") != "" {
+		return nil, err
+	}
+
+	if len(authnJson) > 0 {
+		if debug {
+			log.Printf("[D] Using the embedded authn.json, as no other credentials are found: %v", err)
+		}
+		credentialsJSON = authnJson
+		return option.WithCredentialsJSON(authnJson), nil
+	}
+	return nil, fmt.Errorf("no credentials found: %v", err)
+}
+
+// findCredentials returns the credentials resolved by resolveCredentials for a scope of other
+// Google APIs than GCS
+func findCredentials(ctx context.Context, scope string) (*google.Credentials, error) {
+	if len(credentialsJSON) > 0 {
+		return google.CredentialsFromJSON(ctx, credentialsJSON, scope)
+	}
+	return google.FindDefaultCredentials(ctx, scope)
+}
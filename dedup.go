@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// reasons of duplicate finalizations suppressed, the keys of the metric duplicates_suppressed
+const (
+	// quicly:accept or quicly:connect to a finalized connection, i.e. a connection ID reused
+	// while the finalized one is still in connToLogs
+	dupReusedConnID = "reused_conn_id"
+	// quicly:free to a finalized connection
+	dupRepeatedFree = "repeated_free"
+	// the object exists in the sinks with -on-name-collision=skip or -exactly-once
+	dupObjectExists = "object_exists"
+	// a spooled object which has been stored
+	dupSpoolReplay = "spool_replay"
+	// the object has been uploaded within -dedup-window
+	dupRecentUpload = "recent_upload"
+)
+
+// recentUploadCache remembers the names of the objects uploaded as final within the window
+// (-dedup-window), so that uploads of the same objects are skipped without asking the sinks,
+// e.g. those of connections finalized again or replayed from the spool. Snapshots are not
+// remembered, as final objects overwrite them.
+type recentUploadCache struct {
+	mutex  sync.Mutex
+	window time.Duration
+	names  map[string]time.Time
+	// the names in the order of uploads, to expire them
+	order []string
+}
+
+var recentUploads *recentUploadCache
+
+func newRecentUploadCache(window time.Duration) *recentUploadCache {
+	return &recentUploadCache{
+		window: window,
+		names:  make(map[string]time.Time),
+	}
+}
+
+// seen reports whether the object has been uploaded within the window. It returns false if
+// cache is nil.
+func (cache *recentUploadCache) seen(objectName string) bool {
+	if cache == nil {
+		return false
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	uploadedAt, ok := cache.names[objectName]
+	return ok && time.Since(uploadedAt) < cache.window
+}
+
+// add remembers the uploaded object, expiring those beyond the window. It does nothing if
+// cache is nil.
+func (cache *recentUploadCache) add(objectName string) {
+	if cache == nil {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	now := time.Now()
+	for len(cache.order) > 0 {
+		name := cache.order[0]
+		if now.Sub(cache.names[name]) < cache.window {
+			break
+		}
+		delete(cache.names, name)
+		cache.order = cache.order[1:]
+	}
+	if _, ok := cache.names[objectName]; !ok {
+		cache.order = append(cache.order, objectName)
+	}
+	cache.names[objectName] = now
+	metricDedupCacheSize.Set(int64(len(cache.names)))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// the header of encrypted objects, followed by the key ID, the content encoding of the
+// plaintext, and a newline. The header is authenticated as additional data.
+const encryptedObjectMagic = "h2olog-encrypted:v1:"
+
+// a rule to encrypt objects by SNI with a key of the tenant, e.g. "*.example.com=/etc/keys/example"
+type encryptionRule struct {
+	// a glob pattern of SNI in path.Match syntax; "*" also matches connections without SNI
+	sniPattern string
+	// the base name of the key file, recorded in objects to tell which key to decrypt them with
+	keyID string
+	aead  cipher.AEAD
+}
+
+var encryptionRules []encryptionRule // -encryption-keys=rules
+
+// parseEncryptionRules parses comma-separated rules of SNI patterns and key files,
+// e.g. "api.example.com=/etc/keys/api,*=/etc/keys/default". A key file has a 256-bit key
+// in 64 hex digits.
+func parseEncryptionRules(s string) ([]encryptionRule, error) {
+	rules := make([]encryptionRule, 0)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pair := strings.SplitN(item, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("no key file in rule '%s'", item)
+		}
+		if _, err := path.Match(pair[0], ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern in rule '%s': %v", item, err)
+		}
+		aead, err := loadEncryptionKey(pair[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key in rule '%s': %v", item, err)
+		}
+		rules = append(rules, encryptionRule{sniPattern: pair[0], keyID: filepath.Base(pair[1]), aead: aead})
+	}
+	return rules, nil
+}
+
+func loadEncryptionKey(filePath string) (cipher.AEAD, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("the key must be 256 bits, but it is %d bits", len(key)*8)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// selectEncryptionRule returns the first rule that matches the SNI, or nil
+func selectEncryptionRule(sni string) *encryptionRule {
+	for i, rule := range encryptionRules {
+		if rule.sniPattern == "*" {
+			return &encryptionRules[i]
+		}
+		if matched, _ := path.Match(rule.sniPattern, sni); matched && sni != "" {
+			return &encryptionRules[i]
+		}
+	}
+	return nil
+}
+
+// encryptPayload encrypts the payload by AES-256-GCM with the key for the SNI, returning the
+// encrypted object and its content encoding, which is "" as the plaintext encoding is in the
+// header. It returns the payload as is if no rule matches.
+func encryptPayload(sni string, payload []byte, contentEncoding string) ([]byte, string, error) {
+	rule := selectEncryptionRule(sni)
+	if rule == nil {
+		return payload, contentEncoding, nil
+	}
+	header := encryptedObjectMagic + rule.keyID + ":" + contentEncoding + "\n"
+	nonce := make([]byte, rule.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	object := make([]byte, 0, len(header)+len(nonce)+len(payload)+rule.aead.Overhead())
+	object = append(object, header...)
+	object = append(object, nonce...)
+	object = rule.aead.Seal(object, nonce, payload, []byte(header))
+	return object, "", nil
+}
+
+// contentTypeOf returns the content type of an object to store
+func contentTypeOf(data []byte, payloadFormat string) string {
+	if bytes.HasPrefix(data, []byte(encryptedObjectMagic)) {
+		return "application/octet-stream"
+	}
+	if bytes.HasPrefix(data, []byte("PAR1")) {
+		return "application/vnd.apache.parquet"
+	}
+	if bytes.HasPrefix(data, []byte("Obj\x01")) {
+		return "application/avro"
+	}
+	if payloadFormat == payloadFormatQlog {
+		return "application/qlog+json; utf-8"
+	}
+	if payloadFormat == payloadFormatNDJSON {
+		return "application/x-ndjson; utf-8"
+	}
+	return "application/json; utf-8"
+}
@@ -0,0 +1,34 @@
+package main
+
+import "strings"
+
+// event types to keep in payloads (-include-events), or nil to keep all
+var includeEvents map[string]bool
+
+// event types to drop from payloads (-exclude-events)
+var excludeEvents map[string]bool
+
+// parseEventTypes parses comma-separated event types, e.g. "packet-received,packet-sent"
+func parseEventTypes(s string) map[string]bool {
+	eventTypes := make(map[string]bool)
+	for _, eventType := range strings.Split(s, ",") {
+		eventType = strings.TrimSpace(eventType)
+		if eventType != "" {
+			eventTypes[eventType] = true
+		}
+	}
+	return eventTypes
+}
+
+// isEventFiltered reports whether an event of the type is dropped from the payload by
+// -include-events or -exclude-events. Those to name and to finalize the object are always kept.
+func isEventFiltered(eventType string) bool {
+	switch eventType {
+	case "accept", "connect", "free":
+		return false
+	}
+	if includeEvents != nil && !includeEvents[eventType] {
+		return true
+	}
+	return excludeEvents[eventType]
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"google.golang.org/api/googleapi"
+)
+
+// -exactly-once stores one object per connection, keyed by the object name made of the dcid and
+// the time of quicly:accept, so that inputs resent by -input-ack clients and other collectors
+// reading the same input never overwrite nor duplicate the first object. Names are resolved with
+// -on-name-collision=skip, and writes to GCS, S3, and local files are conditional on the absence of
+// the object to close the race between the check and the write. Live connections are not flushed except to
+// -final-flush-local, as incomplete objects would take the names of the final ones.
+var exactlyOnce bool // -exactly-once
+
+// errObjectExists is returned by storageManager.write if another writer has stored the object
+// with -exactly-once
+var errObjectExists = errors.New("the object already exists")
+
+// isPreconditionFailed returns true if a conditional write to GCS failed as the object exists
+func isPreconditionFailed(err error) bool {
+	var apiError *googleapi.Error
+	return errors.As(err, &apiError) && apiError.Code == http.StatusPreconditionFailed
+}
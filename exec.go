@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// backoff of restarting the command of -exec, which is reset once it runs for maxExecBackoff
+const (
+	minExecBackoff = time.Second
+	maxExecBackoff = time.Minute
+)
+
+// the process of -exec, guarded by its mutex
+var managedCommand struct {
+	sync.Mutex
+	cmd      *exec.Cmd
+	stopping bool
+}
+
+// runManagedCommand runs the command line by the shell, reading its STDOUT as h2olog events.
+// It restarts the command with backoff when it exits, until stopManagedCommand is called.
+func runManagedCommand(ctx context.Context, storage *storageManager, commandLine string, latch *sync.WaitGroup) {
+	backoff := minExecBackoff
+	for {
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", commandLine)
+		cmd.Stderr = os.Stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			log.Fatalf("Cannot create a pipe for -exec: %v", err)
+		}
+
+		managedCommand.Lock()
+		if managedCommand.stopping {
+			managedCommand.Unlock()
+			return
+		}
+		err = cmd.Start()
+		if err == nil {
+			managedCommand.cmd = cmd
+		}
+		managedCommand.Unlock()
+
+		startTime := time.Now()
+		if err != nil {
+			log.Printf("Cannot start \"%s\": %v", commandLine, err)
+		} else {
+			log.Printf("Started \"%s\" (pid=%d)", commandLine, cmd.Process.Pid)
+			// a new process numbers connections from scratch, so it is a new source
+			source := newInputSource("exec", stdout)
+			readJSONLine(ctx, storage, source, latch)
+			err = cmd.Wait()
+
+			connsMutex.Lock()
+			forgetProcessedConns(source)
+			connsMutex.Unlock()
+		}
+
+		managedCommand.Lock()
+		managedCommand.cmd = nil
+		stopping := managedCommand.stopping
+		managedCommand.Unlock()
+		if stopping || ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(startTime) >= maxExecBackoff {
+			backoff = minExecBackoff
+		}
+		log.Printf("\"%s\" exited (%v); restarting in %v", commandLine, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > maxExecBackoff {
+			backoff = maxExecBackoff
+		}
+	}
+}
+
+// stopManagedCommand terminates the process of -exec and stops restarting it
+func stopManagedCommand() {
+	managedCommand.Lock()
+	defer managedCommand.Unlock()
+	managedCommand.stopping = true
+	if managedCommand.cmd != nil {
+		managedCommand.cmd.Process.Signal(syscall.SIGTERM)
+	}
+}
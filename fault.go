@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errInjectedFault is returned by storageManager.write when -inject-faults decides to fail
+var errInjectedFault = errors.New("injected fault")
+
+// faultInjector makes writes to the sinks fail or slow down for testing (-inject-faults).
+// It is deterministic for a seed as long as writes are issued in the same order.
+type faultInjector struct {
+	mutex sync.Mutex
+	rand  *rand.Rand
+
+	// the probability in [0, 1] that a write fails
+	errorRate float64
+	// the delay added to a write with the probability latencyRate
+	latency     time.Duration
+	latencyRate float64
+	// every outagePeriod, all the writes fail for the first outageDuration
+	outageDuration time.Duration
+	outagePeriod   time.Duration
+	startTime      time.Time
+}
+
+// parseFaultInjector parses comma-separated settings,
+// e.g. "seed=42,error-rate=0.1,latency=500ms,latency-rate=0.5,outage=10s/1m"
+func parseFaultInjector(s string) (*faultInjector, error) {
+	var seed int64
+	faults := &faultInjector{
+		latencyRate: 1,
+		startTime:   now(),
+	}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pair := strings.SplitN(item, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("no value in '%s'", item)
+		}
+		var err error
+		switch pair[0] {
+		case "seed":
+			seed, err = strconv.ParseInt(pair[1], 10, 64)
+		case "error-rate":
+			faults.errorRate, err = strconv.ParseFloat(pair[1], 64)
+		case "latency":
+			faults.latency, err = time.ParseDuration(pair[1])
+		case "latency-rate":
+			faults.latencyRate, err = strconv.ParseFloat(pair[1], 64)
+		case "outage":
+			durations := strings.SplitN(pair[1], "/", 2)
+			if len(durations) != 2 {
+				return nil, fmt.Errorf("outage must be DURATION/PERIOD: '%s'", item)
+			}
+			faults.outageDuration, err = time.ParseDuration(durations[0])
+			if err == nil {
+				faults.outagePeriod, err = time.ParseDuration(durations[1])
+			}
+			if err == nil && faults.outagePeriod <= 0 {
+				err = fmt.Errorf("the period must be positive")
+			}
+		default:
+			return nil, fmt.Errorf("unknown setting '%s'", pair[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid '%s': %v", item, err)
+		}
+	}
+	faults.rand = rand.New(rand.NewSource(seed))
+	return faults, nil
+}
+
+// inject sleeps and returns an error according to the settings. It does nothing if faults is nil.
+func (faults *faultInjector) inject(ctx context.Context, objectName string) error {
+	if faults == nil {
+		return nil
+	}
+
+	faults.mutex.Lock()
+	delay := faults.latency > 0 && faults.rand.Float64() < faults.latencyRate
+	fail := faults.rand.Float64() < faults.errorRate
+	faults.mutex.Unlock()
+
+	if delay {
+		select {
+		case <-time.After(faults.latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if faults.outagePeriod > 0 && now().Sub(faults.startTime)%faults.outagePeriod < faults.outageDuration {
+		fail = true
+	}
+	if fail {
+		if debug {
+			log.Printf("[D] Injected a fault to \"%s\"", objectName)
+		}
+		return errInjectedFault
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	json "github.com/goccy/go-json"
+)
+
+// true to embed "field_dictionary" in objects (-field-dictionary)
+var embedFieldDictionary bool
+
+// a dictionary of the fields of events in an object by event type, e.g.
+// {"accept": {"dcid": "string", "time": "number", ...}, ...}, to help downstream schema
+// inference. A field with values of different kinds is "mixed".
+type fieldDictionary map[string]map[string]string
+
+// observe adds the fields of the event to the dictionary
+func (dictionary fieldDictionary) observe(rawEvent h2ologEvent) {
+	eventType, _ := rawEvent["type"].(string)
+	fields := dictionary[eventType]
+	if fields == nil {
+		fields = make(map[string]string, len(rawEvent))
+		dictionary[eventType] = fields
+	}
+	for name, value := range rawEvent {
+		kind := jsonKindOf(value)
+		if known, ok := fields[name]; !ok {
+			fields[name] = kind
+		} else if known != kind {
+			fields[name] = "mixed"
+		}
+	}
+}
+
+// clone returns a copy of the dictionary, which the caller can read while the connection
+// continues to observe events
+func (dictionary fieldDictionary) clone() fieldDictionary {
+	if dictionary == nil {
+		return nil
+	}
+	copied := make(fieldDictionary, len(dictionary))
+	for eventType, fields := range dictionary {
+		copiedFields := make(map[string]string, len(fields))
+		for name, kind := range fields {
+			copiedFields[name] = kind
+		}
+		copied[eventType] = copiedFields
+	}
+	return copied
+}
+
+// jsonKindOf returns the JSON type of a decoded or an added value of an event
+func jsonKindOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number, float64, int, int64, uint64:
+		return "number"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
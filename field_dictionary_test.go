@@ -0,0 +1,27 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFieldDictionaryClone(t *testing.T) {
+	dictionary := make(fieldDictionary)
+	dictionary.observe(h2ologEvent{"type": "accept", "dcid": "bc6ace5c680ed855"})
+	copied := dictionary.clone()
+	if !reflect.DeepEqual(copied, dictionary) {
+		t.Fatalf("the copy is %v, want %v", copied, dictionary)
+	}
+
+	// the copy doesn't change while the connection continues
+	dictionary.observe(h2ologEvent{"type": "accept", "dcid": 1})
+	dictionary.observe(h2ologEvent{"type": "free"})
+	want := fieldDictionary{"accept": {"type": "string", "dcid": "string"}}
+	if !reflect.DeepEqual(copied, want) {
+		t.Errorf("the copy is %v, want %v", copied, want)
+	}
+
+	if fieldDictionary(nil).clone() != nil {
+		t.Error("a copy of nil is not nil")
+	}
+}
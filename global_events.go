@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gfx/h2olog-collector-gcs/archive"
+	json "github.com/goccy/go-json"
+)
+
+// what to do with events without "conn" (-connless-events)
+const (
+	// discard them, only counting them in metrics
+	connlessDrop = "drop"
+	// store them in a "global" object per -global-events-window
+	connlessGlobal = "global"
+	// add them to the connection of the most recent event
+	connlessAttach = "attach"
+)
+
+var connlessEvents = connlessDrop // -connless-events=mode
+
+// the root object of global events
+type globalEventsRoot struct {
+	SchemaVersion int       `json:"schema_version"`
+	ID            string    `json:"id"`
+	Host          string    `json:"host"`
+	StartTime     time.Time `json:"start_time"`
+	EndTime       time.Time `json:"end_time"`
+	NumEvents     int       `json:"num_events"`
+	// always true to tell global objects from connection objects
+	Global bool `json:"global"`
+
+	CaptureDescription string `json:"capture_description,omitempty"`
+	PayloadFormat      string `json:"payload_format,omitempty"`
+
+	// "payload" is written by writePayload
+}
+
+// globalEventsBuffer collects events without "conn", i.e. process-scope events, into an object
+// per time window of event timestamps. It is guarded by connsMutex.
+type globalEventsBuffer struct {
+	window time.Duration
+	// the beginning of the current window in milliseconds
+	windowStart int64
+	events      []h2ologEvent
+	// the wall clock time when the first event of the current window was added
+	bufferedAt time.Time
+}
+
+var globalEvents = &globalEventsBuffer{window: time.Minute} // -global-events-window=duration
+
+// add appends the event, uploading the events of the previous window if the event is in a new window
+func (buffer *globalEventsBuffer) add(ctx context.Context, storage *storageManager, latch *sync.WaitGroup, rawEvent h2ologEvent) {
+	timeMillis, _ := eventInt64(rawEvent, "time")
+	if len(buffer.events) > 0 && timeMillis >= buffer.windowStart+buffer.window.Milliseconds() {
+		buffer.flush(ctx, storage, latch)
+	}
+	if len(buffer.events) == 0 {
+		buffer.windowStart = timeMillis - timeMillis%buffer.window.Milliseconds()
+		buffer.bufferedAt = time.Now()
+	}
+	buffer.events = append(buffer.events, rawEvent)
+}
+
+// flushPeriodically uploads the buffered events once they are held for a window, so that
+// process-scope events are stored even if no more events come to close the window
+func (buffer *globalEventsBuffer) flushPeriodically(ctx context.Context, storage *storageManager, latch *sync.WaitGroup) {
+	go func() {
+		ticker := time.NewTicker(buffer.window / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			connsMutex.Lock()
+			if len(buffer.events) > 0 && time.Since(buffer.bufferedAt) >= buffer.window {
+				buffer.flush(ctx, storage, latch)
+			}
+			connsMutex.Unlock()
+		}
+	}()
+}
+
+// flush uploads the buffered events in background, through the upload workers if any
+func (buffer *globalEventsBuffer) flush(ctx context.Context, storage *storageManager, latch *sync.WaitGroup) {
+	if len(buffer.events) == 0 {
+		return
+	}
+	events := buffer.events
+	windowStart := buffer.windowStart
+	buffer.events = nil
+
+	startBackgroundUpload(ctx, latch, func() {
+		uploadGlobalEvents(storage, windowStart, events)
+	})
+}
+
+func uploadGlobalEvents(storage *storageManager, windowStart int64, events []h2ologEvent) {
+	objectName := timePrefix(millisToTime(windowStart)) + fmt.Sprintf("%s-global-%d", host, windowStart)
+	format := payloadFormat
+	if !isRecordPayloadFormat(format) {
+		// global objects are in JSON, as objects in the other formats are for connections
+		format = payloadFormatJSON
+	}
+	root := globalEventsRoot{
+		SchemaVersion:      archive.CurrentSchemaVersion,
+		ID:                 objectName,
+		Host:               host,
+		NumEvents:          len(events),
+		Global:             true,
+		CaptureDescription: captureDescription,
+		PayloadFormat:      payloadFormatField(format),
+	}
+	if startTime, ok := eventInt64(events[0], "time"); ok {
+		root.StartTime = millisToTime(startTime)
+	}
+	if endTime, ok := eventInt64(events[len(events)-1], "time"); ok {
+		root.EndTime = millisToTime(endTime)
+	}
+
+	metadata, err := json.Marshal(root)
+	if err != nil {
+		log.Fatalf("Cannot serialize global events: %v", err)
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0, len(metadata)+len(events)*256))
+	buffer.Write(metadata[:len(metadata)-1])
+	err = writePayload(buffer, events, format)
+	if err != nil {
+		log.Fatalf("Cannot serialize global events: %v", err)
+	}
+	payload := buffer.Bytes()
+	payload, contentEncoding := compressPayload(payload, compression)
+	// process-scope events have no SNI, which only the "*" rule matches
+	payload, contentEncoding, err = encryptPayload("", payload, contentEncoding)
+	if err != nil {
+		log.Fatalf("Cannot encrypt global events: %v", err)
+	}
+
+	attrs := objectAttrs{contentEncoding: contentEncoding, payloadFormat: format}
+	err = storage.write(objectName, payload, attrs)
+	if err != nil && !isObjectError(err) && spool != nil && spool.add(objectName, payload, attrs) == nil {
+		log.Printf("Spooled global events as \"%s\" after failing to write them (events=%v, bytes=%v): %v",
+			objectName, len(events), len(payload), err)
+	} else if err != nil {
+		log.Printf("Failed to write global events as \"%s\" (events=%v, bytes=%v): %v",
+			objectName, len(events), len(payload), err)
+	} else if debug {
+		log.Printf("[D] Wrote global events as \"%s\" (events=%v, bytes=%v)", objectName, len(events), len(payload))
+	}
+}
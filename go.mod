@@ -3,13 +3,23 @@ module github.com/gfx/h2olog-collector-gcs
 go 1.16
 
 require (
+	cloud.google.com/go/bigquery v1.25.0
 	cloud.google.com/go/storage v1.14.0
-	github.com/goccy/go-json v0.4.13
+	github.com/BurntSushi/toml v0.3.1
+	github.com/ClickHouse/clickhouse-go v1.5.4
+	github.com/aws/aws-sdk-go v1.38.25
+	github.com/goccy/go-json v0.10.5
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
 	github.com/hashicorp/golang-lru v0.5.4
-	golang.org/x/mod v0.4.2 // indirect
-	golang.org/x/net v0.0.0-20210420210106-798c2154c571 // indirect
-	golang.org/x/sys v0.0.0-20210420205809-ac73e9fd8988 // indirect
-	google.golang.org/api v0.45.0
-	google.golang.org/genproto v0.0.0-20210420162539-3c870d7478d2 // indirect
+	github.com/klauspost/compress v1.13.6
+	github.com/linkedin/goavro/v2 v2.15.0
+	github.com/segmentio/kafka-go v0.4.16
+	github.com/xitongsys/parquet-go v1.6.2
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
+	golang.org/x/oauth2 v0.0.0-20211005180243-6b3c2da341f1
+	google.golang.org/api v0.60.0
+	google.golang.org/genproto v0.0.0-20211118181313-81c1377c94b1
+	google.golang.org/grpc v1.40.0
+	google.golang.org/protobuf v1.27.1
+	gopkg.in/yaml.v2 v2.4.0
 )
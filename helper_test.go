@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collectTestObjects processes test/test.jsonl in the payload format like
+// `-deterministic -host=test -local=dir`, and returns the stored objects by their file names
+func collectTestObjects(t *testing.T, format string) map[string][]byte {
+	t.Helper()
+	defer func(savedFormat string, savedHost string, savedNow func() time.Time) {
+		payloadFormat = savedFormat
+		host = savedHost
+		now = savedNow
+		deterministic = false
+	}(payloadFormat, host, now)
+	payloadFormat = format
+	host = "test"
+	now = func() time.Time { return time.Unix(0, 0) }
+	deterministic = true
+
+	input, err := os.Open("test/test.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+
+	dir := t.TempDir()
+	ctx := context.Background()
+	storage := &storageManager{
+		ctx:         ctx,
+		localDirs:   []string{dir},
+		maxAttempts: 1,
+	}
+	latch := &sync.WaitGroup{}
+	readJSONLine(ctx, storage, newInputSource("test.jsonl", input), latch)
+	latch.Wait()
+	storage.wait()
+
+	objects := make(map[string][]byte)
+	err = filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, filePath)
+		objects[filepath.ToSlash(name)] = data
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) == 0 {
+		t.Fatal("no objects are stored")
+	}
+	return objects
+}
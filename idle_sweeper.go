@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// idleTimeoutSweeper finalizes connections that never see quicly:free (-idle-timeout).
+// The current time is that of the latest event plus the wall clock time since it was
+// received, so that it works both for live input and for -replay.
+type idleTimeoutSweeper struct {
+	timeout time.Duration
+	// guarded by connsMutex
+	latestEventTime time.Time
+	latestEventAt   time.Time
+}
+
+var idleSweeper = &idleTimeoutSweeper{}
+
+// observe records the time of an event. The caller must hold connsMutex.
+func (sweeper *idleTimeoutSweeper) observe(eventTime time.Time) {
+	if eventTime.After(sweeper.latestEventTime) {
+		sweeper.latestEventTime = eventTime
+		sweeper.latestEventAt = time.Now()
+	}
+}
+
+func (sweeper *idleTimeoutSweeper) start(ctx context.Context, storage *storageManager, latch *sync.WaitGroup) {
+	go func() {
+		ticker := time.NewTicker(sweeper.timeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			connsMutex.Lock()
+			sweeper.sweep(ctx, storage, latch)
+			connsMutex.Unlock()
+		}
+	}()
+}
+
+// sweep finalizes idle connections. The caller must hold connsMutex.
+func (sweeper *idleTimeoutSweeper) sweep(ctx context.Context, storage *storageManager, latch *sync.WaitGroup) {
+	if sweeper.latestEventTime.IsZero() {
+		return
+	}
+	deadline := sweeper.latestEventTime.Add(time.Since(sweeper.latestEventAt)).Add(-sweeper.timeout)
+	for _, key := range connToLogs.Keys() {
+		value, ok := connToLogs.Peek(key)
+		if !ok {
+			continue
+		}
+		entry := value.(*logEntry)
+		if entry.processed || entry.endTime.IsZero() || !entry.endTime.Before(deadline) {
+			continue
+		}
+		if debug {
+			log.Printf("[D] Finalizing idle connID=%d (endTime=%v)", entry.connID, entry.endTime)
+		}
+		entry.forciblyClosed = true
+		finalizeEntry(ctx, storage, latch, entry)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// host labels by the names of input sources, which override -host (-source-hosts)
+var sourceHosts = map[string]string{}
+
+// an input stream of h2olog events
+type inputSource struct {
+	// a label of the source, e.g. "stdin" or a file path
+	name string
+	// the host label of objects from the source
+	host   string
+	reader io.Reader
+	// the key of the metric input_lag_ms, which is the name unless the name changes per stream,
+	// e.g. the remote address of -listen-tcp, where it is the host label shared by the streams
+	// from the host, or "" not to record the lag, e.g. of -replay
+	lagLabel string
+	// the offset in bytes after the last processed line, updated atomically
+	offset int64
+	// paces events by their timestamps if non-nil
+	pacer *replayPacer
+	// the connection of the most recent event for connlessAttach, guarded by connsMutex
+	lastConnID int64
+	// acknowledges the sender of the stream with -input-ack if non-nil
+	acker *inputAcker
+	// the entry of the most recent event, which saves lookups in connToLogs as events of
+	// a connection come in runs. It is cleared when the entry leaves connToLogs.
+	lastEntry *logEntry
+	// set once the stream is stopped to hand it off by soft restart, updated atomically
+	handoff int32
+	// the bytes read but not processed when the stream is stopped by soft restart
+	remainder []byte
+}
+
+// the key of connToLogs and h2oConns, as connection IDs are unique only in an input source
+type connKey struct {
+	source *inputSource
+	connID int64
+}
+
+func newInputSource(name string, reader io.Reader) *inputSource {
+	sourceHost, ok := sourceHosts[name]
+	if !ok {
+		sourceHost = host
+	}
+	return &inputSource{
+		name:       name,
+		host:       sourceHost,
+		lagLabel:   name,
+		reader:     reader,
+		lastConnID: -1,
+	}
+}
+
+// parseSourceHosts parses comma-separated pairs of a source name and a host label,
+// e.g. "/var/log/h2o-1.jsonl=web1,/var/log/h2o-2.jsonl=web2"
+func parseSourceHosts(s string) (map[string]string, error) {
+	hosts := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.LastIndex(item, "=")
+		if i <= 0 || i == len(item)-1 {
+			return nil, fmt.Errorf("'%s' is not NAME=HOST", item)
+		}
+		hosts[item[:i]] = item[i+1:]
+	}
+	return hosts, nil
+}
+
+func (source *inputSource) processedOffset() int64 {
+	return atomic.LoadInt64(&source.offset)
+}
+
+// newScanner returns a line scanner of the source. advanced is called with the length of each
+// line including its newline, so that the caller can update the offset after processing it.
+func (source *inputSource) newScanner(advanced func(n int)) *bufio.Scanner {
+	scanner := bufio.NewScanner(source.reader)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if source.handedOff() && bytes.IndexByte(data, '\n') < 0 {
+			// the rest of the stream is read by the new process
+			source.remainder = append([]byte(nil), data...)
+			return 0, nil, errHandedOff
+		}
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil {
+			advanced(advance)
+		}
+		return advance, token, err
+	})
+	return scanner
+}
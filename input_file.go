@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// the interval to check the input files for appended data, rotation, and truncation with -follow
+const followPollInterval = 250 * time.Millisecond
+
+// readFiles reads the input files given as arguments concurrently until all of them are read,
+// where "-" is STDIN. With follow, it keeps reading them like `tail -F`, so it never returns.
+func readFiles(ctx context.Context, storage *storageManager, paths []string, follow bool, latch *sync.WaitGroup) {
+	sources := make([]*inputSource, 0, len(paths))
+	for _, path := range paths {
+		if path == "-" {
+			sources = append(sources, newInputSource("stdin", os.Stdin))
+			continue
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Cannot open %s, which is neither an input file nor a subcommand: %v", path, err)
+		}
+		defer file.Close()
+
+		var reader io.Reader = file
+		if follow {
+			reader = &followReader{ctx: ctx, path: path, file: file}
+		}
+		sources = append(sources, newInputSource(path, reader))
+	}
+
+	inputs := make([]func(), 0, len(sources))
+	for _, source := range sources {
+		source := source
+		inputs = append(inputs, func() {
+			readJSONLine(ctx, storage, source, latch)
+			if debug {
+				log.Printf("[D] Finished reading %s", source.name)
+			}
+		})
+	}
+	readInputs(inputs)
+}
+
+// readInputs runs the functions to read inputs concurrently, and waits for all of them
+func readInputs(inputs []func()) {
+	done := &sync.WaitGroup{}
+	for _, input := range inputs {
+		done.Add(1)
+		go func(input func()) {
+			defer done.Done()
+			input()
+		}(input)
+	}
+	done.Wait()
+}
+
+// followReader reads a file like `tail -F`: at the end of the file, it waits for appended data,
+// reopens the path if the file is rotated, and rewinds if the file is truncated.
+// It never returns io.EOF, but the error of ctx once it is canceled.
+type followReader struct {
+	ctx  context.Context
+	path string
+	file *os.File
+	// the offset in the current file
+	offset int64
+}
+
+func (reader *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := reader.file.Read(p)
+		reader.offset += int64(n)
+		if n > 0 {
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		select {
+		case <-time.After(followPollInterval):
+		case <-reader.ctx.Done():
+			return 0, reader.ctx.Err()
+		}
+		reader.reopenIfRotated()
+	}
+}
+
+// reopenIfRotated switches to the new file at the path if the current one is rotated,
+// or rewinds the current one if it is truncated
+func (reader *followReader) reopenIfRotated() {
+	current, err := reader.file.Stat()
+	if err != nil {
+		return
+	}
+	if current.Size() > reader.offset {
+		// data is appended, which must be read before switching to a rotated file
+		return
+	}
+	if current.Size() < reader.offset {
+		_, err = reader.file.Seek(0, io.SeekStart)
+		if err != nil {
+			log.Printf("Cannot rewind %s: %v", reader.path, err)
+			return
+		}
+		reader.offset = 0
+		log.Printf("Rewound %s as it was truncated", reader.path)
+		return
+	}
+
+	info, err := os.Stat(reader.path)
+	if err != nil || os.SameFile(info, current) {
+		// not rotated, or the new file is not created yet
+		return
+	}
+	file, err := os.Open(reader.path)
+	if err != nil {
+		return
+	}
+	reader.file.Close()
+	reader.file = file
+	reader.offset = 0
+	log.Printf("Reopened %s as it was rotated", reader.path)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	stdjson "encoding/json"
+	"strings"
+
+	json "github.com/goccy/go-json"
+)
+
+// JSON parsers to decode input lines (-json-parser). They produce the same json.Number,
+// so the rest of the pipeline doesn't depend on the choice.
+const (
+	// github.com/goccy/go-json, which is the fastest
+	jsonParserGoccy = "goccy"
+	// encoding/json of the standard library, which is slower but the reference implementation
+	jsonParserStd = "std"
+	// goccy, retrying with std for lines that goccy fails to decode
+	jsonParserAuto = "auto"
+)
+
+var jsonParser = jsonParserGoccy // -json-parser=name
+
+// decodeEvent decodes an input line by the parser of -json-parser
+func decodeEvent(line string) (h2ologEvent, error) {
+	switch jsonParser {
+	case jsonParserStd:
+		return decodeEventStd(line)
+	case jsonParserAuto:
+		rawEvent, err := decodeEventGoccy(line)
+		if err != nil {
+			if rawEvent, stdErr := decodeEventStd(line); stdErr == nil {
+				metricJSONParserFallbacks.Add(1)
+				return rawEvent, nil
+			}
+		}
+		return rawEvent, err
+	default:
+		return decodeEventGoccy(line)
+	}
+}
+
+func decodeEventGoccy(line string) (h2ologEvent, error) {
+	var rawEvent h2ologEvent
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	err := decoder.Decode(&rawEvent)
+	return rawEvent, err
+}
+
+func decodeEventStd(line string) (h2ologEvent, error) {
+	var rawEvent h2ologEvent
+	decoder := stdjson.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	err := decoder.Decode(&rawEvent)
+	return rawEvent, err
+}
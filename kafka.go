@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/gfx/h2olog-collector-gcs/archive"
+)
+
+// a Kafka topic to which it publishes the payload of each uploaded object as a message keyed by
+// the dcid (-kafka-brokers, -kafka-topic), so that consumers can process connections in real time
+type kafkaProducer struct {
+	writer *kafka.Writer
+	// nil unless -bus-batch-conns is given
+	batch *busBatcher
+}
+
+var kafkaSink *kafkaProducer
+
+// the default max.message.bytes of Kafka brokers
+const kafkaMaxMessageBytes = 1024 * 1024
+
+// newKafkaProducer creates a producer for comma-separated brokers. Messages are partitioned by
+// the hash of their keys, so that those of a dcid go to the same partition.
+// With -bus-batch-conns, batches are keyed by the first connection in them.
+func newKafkaProducer(ctx context.Context, brokers string, topic string) (*kafkaProducer, error) {
+	var addrs []string
+	for _, broker := range strings.Split(brokers, ",") {
+		broker = strings.TrimSpace(broker)
+		if broker != "" {
+			addrs = append(addrs, broker)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no brokers are given")
+	}
+	if topic == "" {
+		return nil, fmt.Errorf("no topic is given")
+	}
+	producer := &kafkaProducer{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(addrs...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			BatchTimeout: 10 * time.Millisecond,
+			BatchBytes:   kafkaMaxMessageBytes,
+			WriteTimeout: 30 * time.Second,
+		},
+	}
+	// room for the key and the headers
+	producer.batch = newBusBatcher(ctx, kafkaMaxMessageBytes-1024, producer.publishBatch)
+	return producer, nil
+}
+
+// publish sends the payload as it is stored, with the object name and its content encoding in
+// the headers, or adds it to the batch with -bus-batch-conns
+func (producer *kafkaProducer) publish(ctx context.Context, objectName string, entry *logEntry, payload []byte, contentEncoding string) {
+	if producer.batch != nil && producer.batch.add(objectName, entry, payload, contentEncoding) {
+		return
+	}
+	message := kafka.Message{
+		Key:   []byte(messageKey(objectName, entry)),
+		Value: payload,
+		Headers: []kafka.Header{
+			{Key: "object", Value: []byte(objectName)},
+			{Key: "content-encoding", Value: []byte(contentEncoding)},
+		},
+	}
+	var err error
+	if len(payload) > kafkaMaxMessageBytes {
+		err = archive.NewError(archive.ErrOversized, fmt.Errorf("the payload has %d bytes (> %d)", len(payload), kafkaMaxMessageBytes))
+	} else {
+		err = producer.writer.WriteMessages(ctx, message)
+	}
+	if err != nil {
+		log.Printf("Failed to publish \"%s\" to Kafka: %v", objectName, err)
+		metricKafkaErrors.Add(1)
+		return
+	}
+	metricKafkaMessages.Add(1)
+	if debug {
+		log.Printf("[D] Published \"%s\" to Kafka (bytes=%v)", objectName, len(payload))
+	}
+}
+
+// publishBatch sends the connections as a message of busBatchEnvelope marked by "batch: 1"
+func (producer *kafkaProducer) publishBatch(ctx context.Context, records []busBatchRecord) {
+	value, err := encodeBusBatch(records)
+	if err == nil {
+		err = producer.writer.WriteMessages(ctx, kafka.Message{
+			Key:     []byte(records[0].Key),
+			Value:   value,
+			Headers: []kafka.Header{{Key: "batch", Value: []byte("1")}},
+		})
+	}
+	if err != nil {
+		log.Printf("Failed to publish a batch of %d objects to Kafka: %v", len(records), err)
+		metricKafkaErrors.Add(1)
+		return
+	}
+	metricKafkaMessages.Add(1)
+	metricBusBatchedRecords.Add("kafka", int64(len(records)))
+	if debug {
+		log.Printf("[D] Published a batch of %d objects to Kafka (bytes=%v)", len(records), len(value))
+	}
+}
+
+// close flushes pending messages and closes the connections to the brokers
+func (producer *kafkaProducer) close() {
+	producer.batch.flush()
+	err := producer.writer.Close()
+	if err != nil {
+		log.Printf("Failed to close the Kafka producer: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	json "github.com/goccy/go-json"
+)
+
+// readConfirmedObjects returns the names of objects recorded as "ok" in the audit log
+func readConfirmedObjects(auditLogPath string) (map[string]bool, error) {
+	file, err := os.Open(auditLogPath)
+	if os.IsNotExist(err) {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	confirmed := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record auditRecord
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			// a line may be truncated by a crash
+			continue
+		}
+		if record.Result == "ok" && record.ObjectName != "" {
+			confirmed[record.ObjectName] = true
+		}
+	}
+	return confirmed, scanner.Err()
+}
+
+// uploadLeftovers uploads objects in the local directories that are not confirmed in the
+// audit log to the other sinks, e.g. those whose uploads failed or were interrupted by a
+// crash (-upload-leftovers). It returns the number of uploaded objects.
+func uploadLeftovers(storage *storageManager, auditLogPath string) (int, error) {
+	confirmed, err := readConfirmedObjects(auditLogPath)
+	if err != nil {
+		return 0, err
+	}
+
+	numUploaded := 0
+	for _, dir := range storage.localDirs {
+		err := filepath.WalkDir(dir, func(filePath string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			relPath, err := filepath.Rel(dir, filePath)
+			if err != nil {
+				return err
+			}
+			objectName, contentEncoding := parseLocalFileName(filepath.ToSlash(relPath))
+			if objectName == "" || confirmed[objectName] {
+				return nil
+			}
+			data, err := os.ReadFile(filePath)
+			if err != nil {
+				return err
+			}
+
+			record := &auditRecord{
+				Time:       now().UTC(),
+				ObjectName: objectName,
+				Bytes:      len(data),
+				Result:     "ok",
+			}
+			// local files are uploaded as they are, even if -sink-formats differ
+			attrs := objectAttrs{
+				contentEncoding: contentEncoding,
+				payloadFormat:   sinkFormatOf(sinkLocal).payloadFormat,
+			}
+			writes := &sinkWrites{}
+			err = storage.writeRemote(objectName, data, attrs, writes)
+			if err == nil {
+				err = writes.result()
+			}
+			if err == errObjectExists {
+				// e.g. stored by a previous run with -exactly-once
+				record.Result = "skipped"
+			} else if err != nil {
+				log.Printf("Failed to upload the leftover \"%s\": %v", filePath, err)
+				record.Result = "error"
+				record.Error = err.Error()
+			} else {
+				numUploaded++
+			}
+			auditLog.record(record)
+			return nil
+		})
+		if err != nil {
+			return numUploaded, err
+		}
+	}
+	return numUploaded, nil
+}
+
+// parseLocalFileName returns the object name and the content encoding of a local file path,
+// or "" if it is not an object
+func parseLocalFileName(fileName string) (string, string) {
+	for _, format := range []string{payloadFormatParquet, payloadFormatAvro} {
+		if objectName := strings.TrimSuffix(fileName, fileSuffix("", format)); objectName != fileName {
+			return objectName, ""
+		}
+	}
+	for _, format := range []string{payloadFormatJSON, payloadFormatQlog} {
+		for _, contentEncoding := range []string{"", "zstd", "gzip"} {
+			if objectName := strings.TrimSuffix(fileName, fileSuffix(contentEncoding, format)); objectName != fileName {
+				return objectName, contentEncoding
+			}
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// listenUnix accepts connections on a Unix domain socket one by one, reading each of them
+// as a stream of h2olog events until it is closed. It returns once ctx is canceled or the
+// socket is handed off by soft restart.
+func listenUnix(ctx context.Context, storage *storageManager, socketPath string, latch *sync.WaitGroup) {
+	listener, err := softRestart.listen("unix", socketPath, func() {
+		// remove the socket left by the previous run, which makes bind(2) fail
+		if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(socketPath)
+		}
+	})
+	if err != nil {
+		log.Fatalf("Cannot listen on %s: %v", socketPath, err)
+	}
+	defer softRestart.stopListening()
+	defer listener.Close()
+	defer closeOnCancel(ctx, listener)()
+	log.Printf("Listening on %s", socketPath)
+
+	// the stream of the previous process is read before accepting another
+	for _, stream := range softRestart.takeInheritedStreams("unix") {
+		source := stream.resume()
+		softRestart.addStream(source, stream.conn)
+		readUnixStream(ctx, storage, socketPath, source, stream.conn, latch)
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if softRestart.startedHandoff() {
+				return
+			}
+			log.Fatalf("Cannot accept a connection on %s: %v", socketPath, err)
+		}
+		if debug {
+			log.Printf("[D] Accepted a connection on %s", socketPath)
+		}
+		source := newInputSource(socketPath, conn)
+		softRestart.addStream(source, conn)
+		readUnixStream(ctx, storage, socketPath, source, conn, latch)
+	}
+}
+
+// readUnixStream reads a connection of -listen-unix until it is closed or handed off
+func readUnixStream(ctx context.Context, storage *storageManager, socketPath string, source *inputSource, conn net.Conn, latch *sync.WaitGroup) {
+	stop := closeOnCancel(ctx, conn)
+	handedOff := readSocket(ctx, storage, "unix", source, conn, latch)
+	stop()
+	conn.Close()
+	if handedOff {
+		return
+	}
+	if debug {
+		log.Printf("[D] Closed a connection on %s", socketPath)
+	}
+
+	connsMutex.Lock()
+	forgetProcessedConns(source)
+	connsMutex.Unlock()
+}
+
+// listenTCP accepts connections from remote hosts and reads them concurrently as streams of
+// h2olog events. Objects from a connection are labeled by the host given by -source-hosts for
+// the remote address, or by the name or the address of the remote host. It returns once ctx is
+// canceled or the socket is handed off by soft restart.
+func listenTCP(ctx context.Context, storage *storageManager, address string, latch *sync.WaitGroup) {
+	listener, err := softRestart.listen("tcp", address, nil)
+	if err != nil {
+		log.Fatalf("Cannot listen on %s: %v", address, err)
+	}
+	defer softRestart.stopListening()
+	defer listener.Close()
+	defer closeOnCancel(ctx, listener)()
+	log.Printf("Listening on %s", listener.Addr())
+
+	for _, stream := range softRestart.takeInheritedStreams("tcp") {
+		source := stream.resume()
+		softRestart.addStream(source, stream.conn)
+		log.Printf("Resumed a connection from %s (host=%s)", source.name, source.host)
+		go readTCPStream(ctx, storage, source, stream.conn, latch)
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if softRestart.startedHandoff() {
+				return
+			}
+			log.Fatalf("Cannot accept a connection on %s: %v", address, err)
+		}
+		remoteAddr := conn.RemoteAddr().String()
+		source := newInputSource(remoteAddr, conn)
+		source.host = remoteHostLabel(remoteAddr)
+		source.lagLabel = source.host
+		log.Printf("Accepted a connection from %s (host=%s)", remoteAddr, source.host)
+		// registered before the accept loop returns, so that soft restart waits for it
+		softRestart.addStream(source, conn)
+		go readTCPStream(ctx, storage, source, conn, latch)
+	}
+}
+
+// readTCPStream reads a connection of -listen-tcp until it is closed or handed off
+func readTCPStream(ctx context.Context, storage *storageManager, source *inputSource, conn net.Conn, latch *sync.WaitGroup) {
+	defer conn.Close()
+	defer closeOnCancel(ctx, conn)()
+	if readSocket(ctx, storage, "tcp", source, conn, latch) {
+		return
+	}
+	log.Printf("Closed a connection from %s", source.name)
+
+	connsMutex.Lock()
+	forgetProcessedConns(source)
+	connsMutex.Unlock()
+}
+
+// readSocket reads a connection of a socket input registered by softRestart.addStream,
+// acknowledging it with -input-ack. It returns true if the connection is handed off to a new
+// process by soft restart, which continues the stream.
+func readSocket(ctx context.Context, storage *storageManager, network string, source *inputSource, conn net.Conn, latch *sync.WaitGroup) bool {
+	defer softRestart.removeStream(source)
+	if !inputAck {
+		readJSONLine(ctx, storage, source, latch)
+		return softRestart.takeStream(network, source, conn)
+	}
+	if source.acker == nil {
+		source.acker = newInputAcker(conn)
+	}
+	stop := source.acker.start(source)
+	readJSONLine(ctx, storage, source, latch)
+	stop()
+	return softRestart.takeStream(network, source, conn)
+}
+
+// closeOnCancel closes c once ctx is canceled, so that blocking accepts and reads return.
+// The returned function stops watching ctx.
+func closeOnCancel(ctx context.Context, c io.Closer) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// remoteHostLabel returns the host label of objects from a remote address
+func remoteHostLabel(remoteAddr string) string {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	if label, ok := sourceHosts[ip]; ok {
+		return label
+	}
+	if names, err := net.LookupAddr(ip); err == nil && len(names) > 0 {
+		return strings.TrimSuffix(names[0], ".")
+	}
+	return ip
+}
+
+// forgetProcessedConns removes the finalized connections of a source from connToLogs at the
+// end of the stream, as no more events come to them. The caller must hold connsMutex.
+func forgetProcessedConns(source *inputSource) {
+	for _, key := range connToLogs.Keys() {
+		value, ok := connToLogs.Peek(key)
+		if ok && key.(connKey).source == source && value.(*logEntry).processed {
+			connToLogs.Remove(key)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// durability policies of local files (-local-durability)
+const (
+	// leave flushing to the OS
+	durabilityNone = "none"
+	// fsync(2) each file
+	durabilityFsync = "fsync"
+	// fsync(2) each file and its directory, so that the new entry survives a crash
+	durabilityDirsync = "dirsync"
+)
+
+// writeLocalFile writes a file with the durability policy. With createOnly, it returns
+// errObjectExists if the file exists.
+func writeLocalFile(filePath string, data []byte, durability string, createOnly bool) error {
+	if (durability == durabilityNone || durability == "") && !createOnly {
+		return os.WriteFile(filePath, data, os.ModePerm)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if createOnly {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	}
+	file, err := os.OpenFile(filePath, flags, os.ModePerm)
+	if createOnly && os.IsExist(err) {
+		return errObjectExists
+	}
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil && durability != durabilityNone && durability != "" {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil && createOnly {
+		// not to take a partial file for the object in the next attempt
+		os.Remove(filePath)
+	}
+	if err != nil || durability != durabilityDirsync {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(filePath))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
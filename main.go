@@ -1,23 +1,25 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	_ "embed"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"os"
-	"path"
+	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	gcs "cloud.google.com/go/storage"
 	json "github.com/goccy/go-json"
 	lru "github.com/hashicorp/golang-lru"
-	"google.golang.org/api/option"
+
+	"github.com/gfx/h2olog-collector-gcs/archive"
 )
 
 const capacityOfEvents = 4096 // a hint for better performance
@@ -25,11 +27,35 @@ const capacityOfEvents = 4096 // a hint for better performance
 var maxNumEvents int64 = 100_000 // -max-num-events
 var host = mustHostname()        // -host=s
 var debug bool                   // -debug
+var auditLog *auditLogger        // -audit-log=path
+var captureDescription string    // -capture-description=s
+var notify *notifier             // -notify-webhook=url
+var signedURLTTL time.Duration   // -signed-url-ttl=duration
+
+var uploadOrder *uploadOrderBuffer // -upload-order-buffer=n
+var uploadLimit *uploadLimiter     // -upload-rate=n
+
+var storageClassRules []storageClassRule // -storage-class-rules=rules
+
+var idleGapThreshold = time.Second // -idle-gap-threshold=duration
+
+// -deterministic runs uploads one by one and fixes the clock, so that the same input always
+// produces the same objects
+var deterministic bool
+
+// the clock for timestamps in outputs other than events, fixed by -deterministic
+var now = time.Now
 
-var connToLogs = mustLruMap(10000)
+var connToLogs = mustLruMap(10000, onEvicted)
 
-//go:embed authn.json
-var authnJson []byte
+// guards connToLogs and its entries against flushAll
+var connsMutex sync.Mutex
+
+var maxLiveConns int64 // -max-live-conns-hard-limit
+var numLiveConns int64 // the number of entries not processed yet, updated atomically
+
+// the sum of the estimated sizes of payloads not uploaded yet, updated atomically
+var bufferedBytes int64
 
 //go:embed VERSION
 var version string
@@ -41,6 +67,8 @@ type h2ologEvent = map[string]interface{}
 type h2ologEventRoot struct {
 	// metadata
 
+	// archive.CurrentSchemaVersion
+	SchemaVersion int `json:"schema_version"`
 	// object name
 	ID string `json:"id"`
 	// the guessed hostname or the one specified by -host
@@ -53,175 +81,534 @@ type h2ologEventRoot struct {
 	NumEvents uint64 `json:"num_events"`
 	// connection id
 	ConnID int64 `json:"conn_id"`
+	// h2o's connection id associated by h2o:h3s_accept, or -1 if unknown
+	H2OConnID int64 `json:"h2o_conn_id"`
+	// "server" for quicly:accept, "client" for quicly:connect, or "" if unknown
+	Role string `json:"role"`
 	// quicly:packet_sent.pn
 	SentPn int64 `json:"sent_pn"`
 	// quicly:packet_acked.pn
 	AckedPn int64 `json:"acked_pn"`
+	// true if the object was uploaded before quicly:free, e.g. by flushAll
+	Incomplete bool `json:"incomplete,omitempty"`
+	// true if the connection was finalized without quicly:free, by -idle-timeout or -max-memory-mb
+	ForciblyClosed bool `json:"forcibly_closed,omitempty"`
+	// true if the connection was evicted from the LRU cache of live connections
+	Evicted bool `json:"evicted,omitempty"`
+	// true if the payload has only the events to identify the connection by -payload-retention
+	PayloadOmitted bool `json:"payload_omitted,omitempty"`
+	// how the events were captured, e.g. the command line of h2olog
+	CaptureDescription string `json:"capture_description,omitempty"`
+	// the input source of the events, e.g. "stdin", a file path, or a remote address
+	Source string `json:"source"`
+	// quicly:accept or quicly:connect events after the first one, which names the object
+	DuplicateAccepts []duplicateAccept `json:"duplicate_accepts,omitempty"`
+	// the fields of events in the payload by event type with -field-dictionary
+	FieldDictionary fieldDictionary `json:"field_dictionary,omitempty"`
+	// the 1-based index of the object in the parts of a connection split by -split-window
+	Part int `json:"part,omitempty"`
+	// true if the part is followed by another part of the connection
+	Continued bool `json:"continued,omitempty"`
+	// "ndjson" if the events follow the root object line by line with -payload-format=ndjson
+	PayloadFormat string `json:"payload_format,omitempty"`
+	// "trimmed" or "split" if the object exceeded -max-object-bytes
+	OversizeAction string `json:"oversize_action,omitempty"`
+	// the number of events dropped from the payload of a trimmed object
+	TrimmedEvents int `json:"trimmed_events,omitempty"`
+	// the 1-based index of the chunk and the number of chunks of a split object
+	Chunk     int `json:"chunk,omitempty"`
+	NumChunks int `json:"num_chunks,omitempty"`
+	// the table of -bigquery-table, which has the summary row of the object by "id"
+	SummaryTable string `json:"summary_table,omitempty"`
+	// the objects of the connections that carried the same request ID in -correlation-header,
+	// which received it earlier (downstream) or later (upstream)
+	DownstreamObjects []string `json:"downstream_objects,omitempty"`
+	UpstreamObjects   []string `json:"upstream_objects,omitempty"`
+
+	// fields of analyzers are inserted here (see analyzer.go)
+
+	// logs that h2olog emitted, which is serialized after the fields of analyzers
+	Payload []map[string]interface{} `json:"payload,omitempty"`
+}
 
-	// logs that h2olog emitted
-	Payload []map[string]interface{} `json:"payload"`
+// an extra quicly:accept or quicly:connect in a connection, e.g. in edge cases of retry or migration
+type duplicateAccept struct {
+	Type string      `json:"type"`
+	Dcid interface{} `json:"dcid,omitempty"`
+	Time interface{} `json:"time"`
 }
 
 // value of connToLogs
 type logEntry struct {
 	connID    int64
+	source    *inputSource
+	host      string // the host label of the input source
 	startTime time.Time
 	endTime   time.Time
 	sentPn    int64 // the last packet number of "packet-sent"
 	ackedPn   int64 // the last packet number of "packet-acked"
+	sni       string
+	role      string // "server" or "client"
+	h2oConnID int64  // h2o:h3s_accept.conn_id
 	processed bool
 	numEvents uint64
+	// "remote-addr" of the client, which -filter-client-cidr checks
+	clientAddr string
+	// true once -filter-client-cidr and -filter-sni-glob decide whether to track the connection
+	filterDecided bool
+	// true if the connection is rejected by the filters, which is processed without uploads
+	untracked bool
+	// true if the entry is created beyond -max-live-conns-hard-limit, which buffers no payload
+	summaryOnly bool
+	// true if the entry is a snapshot uploaded before quicly:free
+	incomplete bool
+	// true if the entry is finalized by -idle-timeout or -max-memory-mb
+	forciblyClosed bool
+	// true if the entry is evicted from connToLogs
+	evicted bool
+	// true if the connection has 5xx responses or reset streams
+	hasErrors bool
+	// true if the payload is dropped by -payload-retention
+	payloadOmitted bool
+	// the estimated size of the payload in JSON, to decide things without serialization
+	estimatedSize int
+	// the first quicly:accept or quicly:connect, which names the object
+	nameEvent        h2ologEvent
+	duplicateAccepts []duplicateAccept
+	// the fields of the events in the payload with -field-dictionary
+	fieldDictionary fieldDictionary
+	// the index of the part with -split-window, or 0 if the connection is not split
+	part int
+	// true if the entry is a part followed by another part
+	continued bool
+	// the time of the first event of the current part
+	partStartTime time.Time
+	// the time in milliseconds of the request of a snapshot by the admin API, or 0
+	snapshotTime int64
+	// how the object is made to fit in -max-object-bytes, or "" if it fits
+	oversizeAction string
+	trimmedEvents  int
+	// the index of the chunk of an object split by -max-object-bytes, and the number of the chunks
+	chunk     int
+	numChunks int
+	// the objects of the connections linked by -correlation-header
+	downstreamObjects []string
+	upstreamObjects   []string
 
-	events []h2ologEvent
+	events    []h2ologEvent
+	analyzers []analyzer
+
+	// events skipped since the last appended event, which is recorded as a gap marker
+	gapSkipped  uint64
+	gapFromTime int64
+	gapToTime   int64
 }
 
-type storageManager struct {
-	ctx      context.Context
-	bucket   *gcs.BucketHandle
-	localDir *string
+// skipEvent records an event dropped from the payload
+func (entry *logEntry) skipEvent(timeMillis int64) {
+	if entry.gapSkipped == 0 {
+		entry.gapFromTime = timeMillis
+	}
+	entry.gapSkipped++
+	entry.gapToTime = timeMillis
 }
 
-func (storage *storageManager) write(objectName string, data []byte) error {
-	if storage.localDir != nil {
-		filePath := path.Join(*storage.localDir, objectName+".json")
-		err := os.WriteFile(filePath, data, os.ModePerm)
-		if err != nil {
-			return err
+// appendEvent appends an event to the payload, preceded by a gap marker if events have been skipped
+// the estimated sizes in JSON of a gap marker and of "conn_seq" added to each event
+const (
+	estimatedGapMarkerSize = 96
+	estimatedConnSeqSize   = 20
+)
+
+// appendEvent appends the event whose size in JSON is given, which is added to the estimated size of the payload
+func (entry *logEntry) appendEvent(rawEvent h2ologEvent, size int) {
+	if entry.gapSkipped > 0 {
+		gapMarker := h2ologEvent{
+			"type":      "__gap__",
+			"skipped":   entry.gapSkipped,
+			"from_time": entry.gapFromTime,
+			"to_time":   entry.gapToTime,
 		}
+		entry.events = append(entry.events, gapMarker)
+		entry.observeFields(gapMarker)
+		entry.gapSkipped = 0
+		entry.addEstimatedSize(estimatedGapMarkerSize)
 	}
-	if storage.bucket != nil {
-		object := storage.bucket.Object(objectName)
-		writer := object.NewWriter(storage.ctx)
-		writer.ContentType = "application/json; utf-8"
-		_, err := writer.Write(data)
-		if err != nil {
-			return err
-		}
-		err = writer.Close()
-		if err != nil {
-			// TODO: handle temporary server errors
-			return err
-		}
+	entry.events = append(entry.events, rawEvent)
+	entry.observeFields(rawEvent)
+	// +1 for the comma
+	entry.addEstimatedSize(size + estimatedConnSeqSize + 1)
+}
+
+// observeFields adds the fields of an event in the payload to the field dictionary with -field-dictionary
+func (entry *logEntry) observeFields(rawEvent h2ologEvent) {
+	if !embedFieldDictionary {
+		return
+	}
+	if entry.fieldDictionary == nil {
+		entry.fieldDictionary = make(fieldDictionary)
 	}
-	return nil
+	entry.fieldDictionary.observe(rawEvent)
+}
+
+func (entry *logEntry) addEstimatedSize(size int) {
+	entry.estimatedSize += size
+	atomic.AddInt64(&bufferedBytes, int64(size))
+}
+
+// releaseBuffer subtracts the estimated size of the entry from bufferedBytes after it is uploaded
+func (entry *logEntry) releaseBuffer() {
+	atomic.AddInt64(&bufferedBytes, -int64(entry.estimatedSize))
 }
 
-func mustLruMap(n int) *lru.Cache {
-	lruMap, err := lru.New(n)
+func mustLruMap(n int, onEvicted func(key interface{}, value interface{})) *lru.Cache {
+	lruMap, err := lru.NewWithEvict(n, onEvicted)
 	if err != nil {
 		panic(err)
 	}
 	return lruMap
 }
 
+// uploads an entry evicted from connToLogs before quicly:free, set up in main()
+var uploadEvicted func(entry *logEntry)
+
+func onEvicted(key interface{}, value interface{}) {
+	entry := value.(*logEntry)
+	if entry.source.lastEntry == entry {
+		entry.source.lastEntry = nil
+	}
+	if entry.processed {
+		return
+	}
+	metricConnsEvicted.Add(1)
+	if uploadEvicted != nil {
+		entry.evicted = true
+		uploadEvicted(entry)
+	} else {
+		atomic.AddInt64(&numLiveConns, -1)
+	}
+}
+
 func millisToTime(millis int64) time.Time {
 	sec := millis / 1000
 	nsec := (millis - (sec * 1000)) * 1000000
 	return time.Unix(sec, nsec).UTC()
 }
 
-func clientOption() option.ClientOption {
-	return option.WithCredentialsJSON(authnJson)
-}
-
-func readJSONLine(ctx context.Context, storage *storageManager, reader io.Reader, latch *sync.WaitGroup) {
-	scanner := bufio.NewScanner(reader)
+func readJSONLine(ctx context.Context, storage *storageManager, source *inputSource, latch *sync.WaitGroup) {
+	// the length of the current line, which is added to the offset of the source after processing it
+	var lineLength int
+	scanner := source.newScanner(func(n int) {
+		atomic.AddInt64(&source.offset, int64(lineLength))
+		lineLength = n
+	})
+	acquireInputLag(source.lagLabel)
+	defer func() {
+		atomic.AddInt64(&source.offset, int64(lineLength))
+		releaseInputLag(source.lagLabel)
+	}()
 
-	for scanner.Scan() {
+	// stop reading once ctx is canceled, e.g. by -drain-timeout
+	for ctx.Err() == nil && scanner.Scan() {
 		line := scanner.Text()
 
-		var rawEvent map[string]interface{}
-		decoder := json.NewDecoder(strings.NewReader(line))
-		decoder.UseNumber()
-		err := decoder.Decode(&rawEvent)
+		rawEvent, err := decodeEvent(line)
 		if err != nil {
 			s := strings.TrimRight(line, "\n")
 			log.Printf("Cannot parse JSON string '%s': %v", s, err)
 			continue
 		}
 
-		if rawEvent["conn"] == nil {
-			continue
+		if source.pacer != nil {
+			source.pacer.wait(ctx, rawEvent)
 		}
 
-		connID, err := rawEvent["conn"].(json.Number).Int64()
+		memory.wait(ctx, storage, latch)
+
+		connsMutex.Lock()
+		handleEvent(ctx, storage, source, latch, rawEvent, len(line))
+		connsMutex.Unlock()
+	}
+}
+
+// handleEvent adds the event to its connection and finalizes the connection on quicly:free.
+// size is the length of the event in JSON. The caller must hold connsMutex.
+func handleEvent(ctx context.Context, storage *storageManager, source *inputSource, latch *sync.WaitGroup, rawEvent h2ologEvent, size int) {
+	var connID int64
+	if rawEvent["conn"] == nil {
+		metricConnlessEvents.Add(1)
+		observeH2OEvent(source, rawEvent)
+		switch connlessEvents {
+		case connlessGlobal:
+			globalEvents.add(ctx, storage, latch, rawEvent)
+			return
+		case connlessAttach:
+			if source.lastConnID < 0 {
+				return
+			}
+			connID = source.lastConnID
+		default:
+			return
+		}
+	} else {
+		var err error
+		connID, err = rawEvent["conn"].(json.Number).Int64()
 		if err != nil {
 			log.Fatalf("Unexpected connection ID: %v", rawEvent["conn"])
 		}
+		source.lastConnID = connID
+	}
 
-		value, ok := connToLogs.Get(connID)
-		var entry *logEntry
-		if ok {
-			entry = value.(*logEntry)
+	var entry *logEntry
+	key := connKey{source, connID}
+	if source.lastEntry != nil && source.lastEntry.connID == connID {
+		entry = source.lastEntry
+	} else if value, ok := connToLogs.Get(key); ok {
+		entry = value.(*logEntry)
+	} else {
+		entry = &logEntry{
+			connID:    connID,
+			source:    source,
+			host:      source.host,
+			startTime: time.Time{},
+			endTime:   time.Time{},
+			h2oConnID: -1,
+			sentPn:    -1,
+			ackedPn:   -1,
+			processed: false,
+			numEvents: 0,
+			events:    nil,
+			analyzers: newAnalyzers(),
+		}
+		if maxLiveConns > 0 && atomic.LoadInt64(&numLiveConns) >= maxLiveConns {
+			entry.summaryOnly = true
+			metricLiveConnsGuardTriggered.Add(1)
 		} else {
-			entry = &logEntry{
-				connID:    connID,
-				startTime: time.Time{},
-				endTime:   time.Time{},
-				sentPn:    -1,
-				ackedPn:   -1,
-				processed: false,
-				numEvents: 0,
-				events:    make([]h2ologEvent, 0, capacityOfEvents),
+			entry.events = make([]h2ologEvent, 0, capacityOfEvents)
+		}
+		atomic.AddInt64(&numLiveConns, 1)
+		metricConnsCreated.Add(1)
+		connToLogs.Add(key, entry)
+		source.acker.track(entry, source.processedOffset())
+	}
+	source.lastEntry = entry
+
+	if entry.processed {
+		if entry.untracked {
+			if rawEvent["type"] == "free" {
+				// forget it, so that the connection ID can be reused
+				connToLogs.Remove(key)
 			}
-			connToLogs.Add(connID, entry)
+			return
+		}
+		if entry.forciblyClosed {
+			// e.g. the trailing quicly:free of an idle connection, which is not a duplicate
+			metricEventsAfterForcedClose.Add(1)
+			return
+		}
+		switch rawEvent["type"] {
+		case "accept", "connect":
+			metricDuplicatesSuppressed.Add(dupReusedConnID, 1)
+		case "free":
+			metricDuplicatesSuppressed.Add(dupRepeatedFree, 1)
 		}
+		return
+	}
 
-		if entry.processed {
-			continue
+	timeMillis, err := rawEvent["time"].(json.Number).Int64()
+	if err == nil {
+		setInputLag(source.lagLabel, time.Now().UnixNano()/int64(time.Millisecond)-timeMillis)
+
+		time := millisToTime(timeMillis)
+		idleSweeper.observe(time)
+		if entry.startTime.IsZero() {
+			entry.startTime = time
 		}
 
-		timeMillis, err := rawEvent["time"].(json.Number).Int64()
-		if err == nil {
-			time := millisToTime(timeMillis)
-			if entry.startTime.IsZero() {
-				entry.startTime = time
-			}
+		// fill endTime with the recently-received time
+		entry.endTime = time
+	}
 
-			// fill endTime with the recently-received time
-			entry.endTime = time
+	if entry.sni == "" {
+		if sni, ok := rawEvent["sni"].(string); ok {
+			entry.sni = sni
 		}
+	}
+	if entry.clientAddr == "" {
+		if clientAddr, ok := rawEvent["remote-addr"].(string); ok {
+			entry.clientAddr = clientAddr
+		}
+	}
 
-		eventType := rawEvent["type"]
+	eventType := rawEvent["type"]
 
-		if eventType == "packet-sent" { // quicly:packet_sent
-			pn, err := rawEvent["pn"].(json.Number).Int64()
-			if err == nil {
-				entry.sentPn = pn
+	if eventType == "accept" || eventType == "connect" { // quicly:accept or quicly:connect
+		if entry.nameEvent == nil {
+			// the first one wins, so that the object name doesn't depend on which events are kept
+			entry.nameEvent = rawEvent
+			if eventType == "accept" {
+				entry.role = "server"
+			} else {
+				entry.role = "client"
 			}
-		} else if eventType == "packet-acked" { // quicly:packet_acked
-			pn, err := rawEvent["pn"].(json.Number).Int64()
-			if err == nil {
-				entry.ackedPn = pn
+		} else {
+			entry.duplicateAccepts = append(entry.duplicateAccepts, duplicateAccept{
+				Type: eventType.(string),
+				Dcid: rawEvent["dcid"],
+				Time: rawEvent["time"],
+			})
+			metricDuplicateAccepts.Add(1)
+			if debug {
+				log.Printf("[D] Recorded a duplicate %s in connID=%d, which does not rename the object", eventType, connID)
 			}
 		}
+	}
 
-		entry.numEvents++ // num skipped = entry.numEvents - len(entry.events)
+	if entry.awaitingFilter() {
+		tracked, decided := filterConn(entry, eventType == "free")
+		if decided {
+			entry.filterDecided = true
+			if !tracked {
+				if debug {
+					log.Printf("[D] Untracked connID=%d by the filters (sni=%s, remote-addr=%s)", connID, entry.sni, entry.clientAddr)
+				}
+				untrackEntry(entry)
+				if eventType == "free" {
+					connToLogs.Remove(key)
+				}
+				return
+			}
+		}
+	}
 
-		// +1 is reserved for quicly:free, which is always recorded.
-		if (len(entry.events)+1) < int(maxNumEvents) || eventType == "free" {
-			entry.events = append(entry.events, rawEvent)
+	if eventType == "h3s-accept" { // h2o:h3s_accept
+		if h2oConnID, ok := eventInt64(rawEvent, "conn-id"); ok {
+			entry.h2oConnID = h2oConnID
+			h2oConns[connKey{source, h2oConnID}] = entry
 		}
+	}
 
-		if eventType == "free" {
-			if debug {
-				log.Printf("[D] processing: connID=%d, type=%v, sentPn=%d, ackedPn=%d, numEvents=%d, len(events)=%d",
-					connID, eventType, entry.sentPn, entry.ackedPn, entry.numEvents, len(entry.events))
-			}
+	if eventType == "reset-stream-send" || eventType == "reset-stream-receive" {
+		// an aborted request
+		entry.hasErrors = true
+	}
+
+	if eventType == "packet-sent" { // quicly:packet_sent
+		pn, err := rawEvent["pn"].(json.Number).Int64()
+		if err == nil {
+			entry.sentPn = pn
+		}
+	} else if eventType == "packet-acked" { // quicly:packet_acked
+		pn, err := rawEvent["pn"].(json.Number).Int64()
+		if err == nil {
+			entry.ackedPn = pn
+		}
+	}
+
+	for _, analyzer := range entry.analyzers {
+		analyzer.update(eventType, rawEvent)
+	}
+
+	// a sequence number in the connection, with which consumers can detect missing or reordered events
+	rawEvent["conn_seq"] = entry.numEvents
+	entry.numEvents++ // skipped events are recorded as "__gap__" markers in entry.events
+
+	// +1 is reserved for quicly:free, which is always recorded.
+	if typeName, _ := eventType.(string); isEventFiltered(typeName) {
+		// filtered events are counted in numEvents, but not recorded as gaps
+		metricEventsFiltered.Add(1)
+	} else if entry.summaryOnly {
+		// keep only the events required to build the object name and to finalize it
+		if eventType == "accept" || eventType == "connect" || eventType == "free" {
+			entry.appendEvent(rawEvent, size)
+		} else {
+			entry.skipEvent(timeMillis)
+		}
+	} else if (len(entry.events)+1) < int(maxNumEvents) || eventType == "free" {
+		entry.appendEvent(rawEvent, size)
+	} else {
+		entry.skipEvent(timeMillis)
+	}
+
+	if splitWindow > 0 && eventType != "free" {
+		maybeSplitEntry(ctx, storage, latch, entry)
+	}
+
+	if eventType == "free" {
+		if debug {
+			log.Printf("[D] processing: connID=%d, type=%v, sentPn=%d, ackedPn=%d, numEvents=%d, len(events)=%d",
+				connID, eventType, entry.sentPn, entry.ackedPn, entry.numEvents, len(entry.events))
+		}
+
+		metricConnsFreed.Add(1)
+		finalizeEntry(ctx, storage, latch, entry)
+	}
+}
 
-			entry.processed = true
+// finalizeEntry marks the entry as processed and uploads it. The caller must hold connsMutex.
+func finalizeEntry(ctx context.Context, storage *storageManager, latch *sync.WaitGroup, entry *logEntry) {
+	if entry.awaitingFilter() {
+		// finalized before the filters decide, e.g. by -idle-timeout, with what is known
+		entry.filterDecided = true
+		if tracked, _ := filterConn(entry, true); !tracked {
+			untrackEntry(entry)
+			return
+		}
+	}
+	entry.processed = true
+	atomic.AddInt64(&numLiveConns, -1)
+	if key := (connKey{entry.source, entry.h2oConnID}); h2oConns[key] == entry {
+		delete(h2oConns, key)
+	}
+	notifyAnomalies(entry)
+	applyPayloadRetention(entry)
+
+	if uploadOrder != nil {
+		uploadOrder.add(entry)
+	} else {
+		startUpload(ctx, latch, storage, entry)
+	}
+}
+
+// flushAll uploads snapshots of all the live connections synchronously, marked as incomplete.
+// The connections continue, and their final objects overwrite the snapshots unless
+// -on-name-collision says otherwise. The caller must hold connsMutex.
+func flushAll(ctx context.Context, storage *storageManager) {
+	latch := &sync.WaitGroup{}
+	numFlushed := 0
+	for _, key := range connToLogs.Keys() {
+		value, ok := connToLogs.Peek(key)
+		if !ok {
+			continue
+		}
+		entry := value.(*logEntry)
+		if entry.processed || len(entry.events) == 0 || entry.awaitingFilter() {
+			continue
+		}
 
-			latch.Add(1)
-			go uploadEvents(ctx, latch, storage, entry)
+		// the analyzers are copied, as the connection continues after the snapshot
+		analyzers, err := freezeAnalyzers(entry.analyzers)
+		if err != nil {
+			log.Printf("Cannot flush connID=%d: %v", entry.connID, err)
+			continue
 		}
+		snapshot := *entry
+		snapshot.analyzers = analyzers
+		snapshot.events = entry.events[:len(entry.events):len(entry.events)]
+		snapshot.incomplete = true
+		latch.Add(1)
+		uploadEvents(ctx, latch, storage, &snapshot)
+		numFlushed++
 	}
+	log.Printf("Flushed %d live connections", numFlushed)
 }
 
 // build a unique GCS object name from events
 func buildObjectName(entry *logEntry) (string, error) {
-	// find the quicly:accept event, which probably exists in the first few events.
-	for _, rawEvent := range entry.events {
-		if rawEvent["type"] == "accept" {
+	// the first quicly:accept or quicly:connect event names the object, even if there are duplicates
+	if rawEvent := entry.nameEvent; rawEvent != nil {
+		eventType := rawEvent["type"]
+		if eventType == "accept" {
 			dcid := rawEvent["dcid"]
 			if dcid == nil {
 				panic("No dcid is set in quicly:accept")
@@ -230,52 +617,324 @@ func buildObjectName(entry *logEntry) (string, error) {
 			if time == nil {
 				panic("No time is set in quicly:accept")
 			}
-			return fmt.Sprintf("%s-%v-%v", host, dcid, time), nil
+			if objectNameTemplate != nil {
+				return executeObjectNameTemplate(newObjectNameFields(entry, fmt.Sprint(dcid), time))
+			}
+			return fmt.Sprintf("%s-%v-%v", entry.host, dcid, time), nil
+		} else if eventType == "connect" {
+			// quicly:connect has no dcid, so the connection id is used instead
+			time := rawEvent["time"]
+			if time == nil {
+				panic("No time is set in quicly:connect")
+			}
+			if objectNameTemplate != nil {
+				return executeObjectNameTemplate(newObjectNameFields(entry, "", time))
+			}
+			return fmt.Sprintf("%s-client%d-%v", entry.host, entry.connID, time), nil
 		}
 	}
-	return "", fmt.Errorf("no quicly:accept is found in events (first event type=%s, events=%v)",
+	if len(entry.events) == 0 {
+		return "", fmt.Errorf("no quicly:accept nor quicly:connect is found (no events)")
+	}
+	return "", fmt.Errorf("no quicly:accept nor quicly:connect is found in events (first event type=%s, events=%v)",
 		entry.events[0]["type"], len(entry.events))
 }
 
-func serializeEvents(ID string, entry *logEntry) ([]byte, error) {
-	rawEvents := entry.events
-	return json.Marshal(h2ologEventRoot{
-		ID:        ID,
-		Host:      host,
-		StartTime: entry.startTime,
-		EndTime:   entry.endTime,
+func newObjectNameFields(entry *logEntry, dcid string, acceptTime interface{}) objectNameFields {
+	fields := objectNameFields{
+		Host:      entry.host,
+		DCID:      dcid,
 		ConnID:    entry.connID,
-		SentPn:    entry.sentPn,
-		AckedPn:   entry.ackedPn,
-		NumEvents: entry.numEvents,
-		Payload:   rawEvents,
+		StartTime: entry.startTime,
+		SNI:       entry.sni,
+		Role:      entry.role,
+	}
+	if number, ok := acceptTime.(json.Number); ok {
+		fields.AcceptTime, _ = number.Int64()
+	}
+	return fields
+}
+
+// serializeEvents returns the object with the payload in the format and the length of its
+// summary part, which is followed by the payload, so that sinks of summaries can share the
+// serialization (see summary_row.go). The length is 0 for Parquet.
+func serializeEvents(ID string, entry *logEntry, format string) ([]byte, int, error) {
+	rawEvents := entry.events
+	buffer, err := serializeSummary(ID, entry, format)
+	if err != nil {
+		return nil, 0, err
+	}
+	if format == payloadFormatParquet {
+		buffer.WriteByte('}')
+		data, err := encodeParquetObject(buffer.Bytes(), entry.connID, rawEvents)
+		return data, 0, err
+	}
+	if format == payloadFormatAvro {
+		buffer.WriteByte('}')
+		data, err := encodeAvroObject(buffer.Bytes(), rawEvents)
+		return data, 0, err
+	}
+	if format == payloadFormatQlog {
+		buffer.WriteByte('}')
+		data, err := encodeQlogObject(ID, buffer.Bytes(), entry, rawEvents)
+		return data, 0, err
+	}
+	summaryLength := buffer.Len()
+	err = writePayload(buffer, rawEvents, format)
+	if err != nil {
+		return nil, 0, err
+	}
+	return buffer.Bytes(), summaryLength, nil
+}
+
+// serializeSummary returns the root object without the payload and the closing brace, with the
+// fields of analyzers flattened into it
+func serializeSummary(ID string, entry *logEntry, format string) (*bytes.Buffer, error) {
+	metadata, err := json.Marshal(h2ologEventRoot{
+		SchemaVersion:      archive.CurrentSchemaVersion,
+		ID:                 ID,
+		Host:               entry.host,
+		StartTime:          entry.startTime,
+		EndTime:            entry.endTime,
+		ConnID:             entry.connID,
+		H2OConnID:          entry.h2oConnID,
+		Role:               entry.role,
+		SentPn:             entry.sentPn,
+		AckedPn:            entry.ackedPn,
+		NumEvents:          entry.numEvents,
+		Incomplete:         entry.incomplete,
+		ForciblyClosed:     entry.forciblyClosed,
+		Evicted:            entry.evicted,
+		PayloadOmitted:     entry.payloadOmitted,
+		CaptureDescription: captureDescription,
+		Source:             entry.source.name,
+		DuplicateAccepts:   entry.duplicateAccepts,
+		FieldDictionary:    entry.fieldDictionary,
+		Part:               entry.part,
+		Continued:          entry.continued,
+		PayloadFormat:      payloadFormatField(format),
+		OversizeAction:     entry.oversizeAction,
+		TrimmedEvents:      entry.trimmedEvents,
+		Chunk:              entry.chunk,
+		NumChunks:          entry.numChunks,
+		SummaryTable:       bigQuery.spec(),
+		DownstreamObjects:  entry.downstreamObjects,
+		UpstreamObjects:    entry.upstreamObjects,
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	// flatten the fields of analyzers into the root object, followed by the payload
+	buffer := bytes.NewBuffer(make([]byte, 0, len(metadata)+1024+entry.estimatedSize))
+	buffer.Write(metadata[:len(metadata)-1])
+	for _, analyzer := range entry.analyzers {
+		fields, err := json.Marshal(analyzer.result())
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) > 2 { // not "{}"
+			buffer.WriteByte(',')
+			buffer.Write(fields[1 : len(fields)-1])
+		}
+	}
+	return buffer, nil
 }
 
-func uploadEvents(ctx context.Context, latch *sync.WaitGroup, storage *storageManager, entry *logEntry) {
+// startUpload uploads the entry in background, or synchronously with -deterministic.
+// It blocks while all the workers of -upload-concurrency are busy.
+func startUpload(ctx context.Context, latch *sync.WaitGroup, storage *storageManager, entry *logEntry) {
+	latch.Add(1)
+	if deterministic {
+		uploadEvents(ctx, latch, storage, entry)
+	} else if uploadQueue != nil {
+		select {
+		case uploadQueue <- uploadJob{ctx: ctx, latch: latch, storage: storage, entry: entry}:
+		case <-ctx.Done():
+			// the workers may be stuck in canceled uploads; this one fails fast into the spool
+			uploadEvents(ctx, latch, storage, entry)
+		}
+	} else {
+		go func() {
+			uploadLimit.wait(ctx)
+			uploadEvents(ctx, latch, storage, entry)
+		}()
+	}
+}
+
+// uploadEvents serializes and stores the entry, and returns the audit record of the upload
+func uploadEvents(ctx context.Context, latch *sync.WaitGroup, storage *storageManager, entry *logEntry) *auditRecord {
 	defer latch.Done()
+	if !entry.incomplete {
+		// snapshots share the buffer with their live entries
+		atomic.AddInt64(&numUploadsInFlight, 1)
+		defer func() {
+			entry.releaseBuffer()
+			entry.source.acker.release(entry)
+			atomic.AddInt64(&numUploadsInFlight, -1)
+		}()
+	}
+	metricConnsFlushed.Add(1)
+
+	record := &auditRecord{
+		Time:            now().UTC(),
+		ConnID:          entry.connID,
+		NumEvents:       entry.numEvents,
+		NumStoredEvents: len(entry.events),
+		Result:          "ok",
+	}
+	defer auditLog.record(record)
 
 	objectName, err := buildObjectName(entry)
+	if err == nil && entry.continued {
+		objectName = partObjectName(objectName, entry.part)
+	}
+	if err == nil && entry.snapshotTime != 0 {
+		objectName = snapshotObjectName(objectName, entry.snapshotTime)
+	}
+	if err == nil && entry.chunk < entry.numChunks {
+		objectName = chunkObjectName(objectName, entry.chunk)
+	}
+	if err == nil {
+		objectName, err = storage.resolveName(selectRetentionPrefix(entry.sni) + timePrefix(entry.startTime) + objectName)
+	}
 	if err != nil {
 		log.Printf("Failed to build the object name: %v", err)
-		return
+		record.Result = "error"
+		record.Error = err.Error()
+		return record
+	}
+	if objectName == "" {
+		if debug {
+			log.Printf("[D] Skipped connID=%d as the object already exists", entry.connID)
+		}
+		metricDuplicatesSuppressed.Add(dupObjectExists, 1)
+		record.Result = "skipped"
+		return record
+	}
+	record.ObjectName = objectName
+	if !entry.incomplete && recentUploads.seen(objectName) {
+		if debug {
+			log.Printf("[D] Skipped connID=%d as \"%s\" has been uploaded within -dedup-window", entry.connID, objectName)
+		}
+		metricDuplicatesSuppressed.Add(dupRecentUpload, 1)
+		record.Result = "skipped"
+		return record
 	}
 
-	payload, err := serializeEvents(objectName, entry)
+	serializeStartTime := now()
+	payload, summaryLength, err := serializeEvents(objectName, entry, payloadFormat)
 	if err != nil {
 		log.Fatalf("Cannot serialize events: %v", err)
 	}
+	if maxObjectBytes > 0 && len(payload) > maxObjectBytes && entry.oversizeAction == "" {
+		if onOversizedObject == oversizedSplit && len(entry.events) > 1 {
+			chunks, err := splitOversizedEntry(entry, len(payload))
+			if err != nil {
+				log.Fatalf("Cannot split events: %v", err)
+			}
+			log.Printf("Splitting \"%s\" (%d bytes) into %d chunks by -max-object-bytes", objectName, len(payload), len(chunks))
+			for _, chunk := range chunks {
+				latch.Add(1)
+				uploadEvents(ctx, latch, storage, chunk)
+			}
+			record.Result = "split"
+			return record
+		}
+		err = trimOversizedEntry(entry, len(payload))
+		if err != nil {
+			log.Fatalf("Cannot trim events: %v", err)
+		}
+		log.Printf("Trimmed %d events of \"%s\" (%d bytes) by -max-object-bytes", entry.trimmedEvents, objectName, len(payload))
+		payload, summaryLength, err = serializeEvents(objectName, entry, payloadFormat)
+		if err != nil {
+			log.Fatalf("Cannot serialize events: %v", err)
+		}
+		record.NumStoredEvents = len(entry.events)
+	}
+	if maxObjectBytes > 0 && len(payload) > maxObjectBytes {
+		log.Printf("\"%s\" is %d bytes, still exceeding -max-object-bytes=%d", objectName, len(payload), maxObjectBytes)
+	}
+	var bigQueryRow []byte
+	if bigQuery != nil {
+		bigQueryRow, err = buildSummaryRow(objectName, entry, payload, summaryLength, storage.objectURI(objectName), bigQuery.withPayload)
+		if err != nil {
+			log.Fatalf("Cannot build a BigQuery row: %v", err)
+		}
+	}
+	record.UncompressedBytes = len(payload)
+	if paranoid {
+		err = validatePayload(objectName, payload, entry)
+		if err != nil {
+			log.Printf("Refused to write an invalid payload as \"%s\" (events=%v, bytes=%v): %v",
+				objectName, len(entry.events), len(payload), err)
+			metricParanoidFailures.Add(1)
+			record.Result = "error"
+			record.Error = err.Error()
+			return record
+		}
+	}
+	payload, contentEncoding := compressPayload(payload, compression)
+	payload, contentEncoding, err = encryptPayload(entry.sni, payload, contentEncoding)
+	if err != nil {
+		log.Fatalf("Cannot encrypt the payload: %v", err)
+	}
+	variants, err := encodeVariants(objectName, entry)
+	if err != nil {
+		log.Fatalf("Cannot serialize events for -sink-formats: %v", err)
+	}
+	record.Bytes = len(payload)
+	record.SerializeMillis = now().Sub(serializeStartTime).Milliseconds()
 
-	err = storage.write(objectName, payload)
-	if err == nil {
+	startTime := now()
+	attrs := objectAttrs{
+		storageClass:    selectStorageClass(entry, len(payload)),
+		contentEncoding: contentEncoding,
+		payloadFormat:   payloadFormat,
+		variants:        variants,
+	}
+	err = storage.write(objectName, payload, attrs)
+	record.LatencyMillis = now().Sub(startTime).Milliseconds()
+	recordUploadMetrics(record)
+	if err == errObjectExists {
+		if debug {
+			log.Printf("[D] Skipped connID=%d as another writer has stored \"%s\"", entry.connID, objectName)
+		}
+		metricDuplicatesSuppressed.Add(dupObjectExists, 1)
+		record.Result = "skipped"
+	} else if err == nil {
+		if !entry.incomplete {
+			recentUploads.add(objectName)
+		}
+		if bigQueryRow != nil {
+			insertBigQueryRow(ctx, objectName, bigQueryRow)
+		}
+		if clickHouse != nil {
+			clickHouse.add(ctx, objectName, entry)
+		}
+		if kafkaSink != nil {
+			kafkaSink.publish(ctx, objectName, entry, payload, contentEncoding)
+		}
+		if pubSub != nil {
+			pubSub.publish(ctx, objectName, entry, payload, contentEncoding)
+		}
+		notifyUpload(storage, objectName, entry)
 		if debug {
-			log.Printf("[D] Wrote the payload as \"%v\" (events=%v, bytes=%v)",
-				objectName, len(entry.events), len(payload))
+			log.Printf("[D] Wrote the payload as \"%v\" (events=%v, bytes=%v, estimated=%v)",
+				objectName, len(entry.events), len(payload), entry.estimatedSize)
 		}
+	} else if !isObjectError(err) && spool != nil && spool.add(objectName, payload, attrs) == nil {
+		log.Printf("Spooled the payload as \"%s\" after failing to write it (events=%v, bytes=%v): %v",
+			objectName, len(entry.events), len(payload), err)
+		record.Result = "spooled"
+		record.Error = err.Error()
 	} else {
 		log.Printf("Failed to write the payload as \"%s\" (events=%v, bytes=%v): %v",
 			objectName, len(entry.events), len(payload), err)
+		record.Result = "error"
+		record.Error = err.Error()
 	}
+	return record
 }
 
 func mustHostname() string {
@@ -289,54 +948,625 @@ func mustHostname() string {
 func main() {
 	var localDir string
 	var gcsBucketID string
+	var credentialsFile string
+	var configPath string
+	var s3BucketName string
+	var finalFlush bool
+	var follow bool
+	var finalFlushLocalDir string
+	var drainTimeout time.Duration
+	var dedupWindow time.Duration
+	var localDurability string
+	var uploadLeftoversOnStart bool
+	var bigQueryTableSpec string
+	var bigQueryPayload bool
+	var clickHouseDSN string
+	var clickHouseBatchSize int
+	var clickHouseFlushInterval time.Duration
+	var kafkaBrokers string
+	var kafkaTopic string
+	var pubSubTopicSpec string
+	var spoolDir string
+	var spoolRetryInterval time.Duration
+	var uploadAttempts int
+	var secondaryGcsBucketID string
+	var auditLogPath string
+	var notifyWebhookURL string
+	var anomalyWebhookURL string
+	var rateAlertWebhookURL string
+	rates := &rateMonitor{}
+	var onNameCollision string
+	var zstdDictPath string
+	var compressMethod string
+	var replayFilePath string
+	var replayOffsetFile string
+	var listenUnixPath string
+	var listenTCPAddress string
+	var execCommandLine string
+	var replaySpeed float64
+	var faultInjection *faultInjector
+	var uploadOrderBufferSize int
+	var metricsAddr string
+	var adminAddr string
+	var sinkFormatsSpec string
+	var uploadOrderMaxDelay time.Duration
 	var showVersion bool
+	var pidFilePath string
+	var uploadRate float64
+	var uploadConcurrency int
+	var maxMemoryMB int64
+	var uploadBurst int
+	var uploadMaxDelay time.Duration
 
 	flag.Int64Var(&maxNumEvents, "max-num-events", maxNumEvents, fmt.Sprintf("Max number of events in an object (default: %v)", maxNumEvents))
+	flag.DurationVar(&dedupWindow, "dedup-window", 0, "Skip uploading a final object whose name has been uploaded within the duration, e.g. by a connection finalized again or a replayed spool (default: disabled)")
+	flag.IntVar(&maxObjectBytes, "max-object-bytes", 0, "Max size of an object before compression; larger ones are handled by -on-oversized-object (default: unlimited)")
+	flag.StringVar(&onOversizedObject, "on-oversized-object", oversizedTrim, "What to do with an object beyond -max-object-bytes: trim (drop events of low priority) or split (into chunks of objects)")
+	flag.Int64Var(&maxLiveConns, "max-live-conns-hard-limit", 0, "Max number of live connections whose events are buffered; connections beyond it are summarized-only (default: unlimited)")
+	flag.Func("disable-analyzers", fmt.Sprintf("Comma-separated analyzers not to run (available: %s)", strings.Join(analyzerNames(), ",")), disableAnalyzers)
+	flag.DurationVar(&idleGapThreshold, "idle-gap-threshold", idleGapThreshold, "Min gap between events in a connection to count as an idle period")
+	flag.DurationVar(&idleSweeper.timeout, "idle-timeout", 0, "Finalize connections without events for the duration, marked as forcibly closed (default: disabled)")
+	flag.DurationVar(&splitWindow, "split-window", 0, "Upload events of live connections as a part per the duration of events, marked as continued (default: disabled)")
 	flag.StringVar(&host, "host", host, fmt.Sprintf("The hostname (default: %s)", host))
-	flag.StringVar(&localDir, "local", "", "A local directory in which it stores logs")
+	flag.StringVar(&connlessEvents, "connless-events", connlessDrop, "What to do with events without \"conn\": drop, global (store them in an object per -global-events-window), or attach (add them to the connection of the most recent event)")
+	flag.DurationVar(&globalEvents.window, "global-events-window", globalEvents.window, "Time window of objects of -connless-events=global")
+	flag.StringVar(&correlationHeader, "correlation-header", "", "A request header, e.g. x-request-id, whose values link downstream and upstream connections in their summaries (requires h2olog -a)")
+	flag.StringVar(&payloadRetention, "payload-retention", retainAll, "Connections to keep payloads of: all, or errors (5xx responses or reset streams); the others keep only summaries")
+	flag.StringVar(&captureDescription, "capture-description", "", "A description stored in every object of how the events were captured, e.g. the command line of h2olog with its probes and filters")
+	flag.StringVar(&replayFilePath, "replay", "", "A capture file of h2olog to read instead of STDIN")
+	flag.StringVar(&listenUnixPath, "listen-unix", "", "A Unix domain socket to read h2olog events from instead of STDIN (unless \"-\" is given as an input file), accepting connections one after another")
+	flag.StringVar(&listenTCPAddress, "listen-tcp", "", "A TCP address to read h2olog events from remote hosts instead of STDIN (unless \"-\" is given as an input file), e.g. \":9009\", labeling objects by the remote hosts")
+	flag.StringVar(&execCommandLine, "exec", "", "A command line of h2olog to run and read events from instead of STDIN (unless \"-\" is given as an input file), e.g. \"h2olog quic -p $(pgrep -o h2o)\", restarted with backoff when it exits")
+	flag.StringVar(&replayOffsetFile, "replay-offset-file", "", "A file to save the offset of -replay periodically and resume from it")
+	flag.Func("replay-speed", "The speed of -replay paced by event timestamps: \"realtime\", \"Nx\" (e.g. \"10x\"), or \"unlimited\" (default)", func(value string) error {
+		speed, err := parseReplaySpeed(value)
+		replaySpeed = speed
+		return err
+	})
+	flag.DurationVar(&progressInterval, "progress-interval", progressInterval, "Interval to report the progress of -replay")
+	flag.StringVar(&localDir, "local", "", "A local directory in which it stores logs, or comma-separated directories (e.g. on different disks) among which logs are sharded")
+	flag.StringVar(&localDurability, "local-durability", durabilityNone, "Durability of files in -local: none, fsync (each file), or dirsync (each file and its directory)")
+	flag.BoolVar(&uploadLeftoversOnStart, "upload-leftovers", false, "On startup, upload objects in -local that are not recorded as uploaded in -audit-log to the buckets")
+	flag.StringVar(&spoolDir, "spool-dir", "", "A local directory to keep objects whose uploads failed, which are uploaded again every -spool-retry-interval")
+	flag.IntVar(&uploadAttempts, "upload-attempts", 3, "Max number of attempts to write an object on retryable errors, with exponential backoff from 500ms, before it fails or goes to -spool-dir")
+	flag.DurationVar(&spoolRetryInterval, "spool-retry-interval", time.Minute, "Interval to upload the objects in -spool-dir again")
+	flag.StringVar(&credentialsFile, "credentials-file", "", "A GCP credentials file (default: GOOGLE_APPLICATION_CREDENTIALS, Application Default Credentials, or authn.json embedded at build time)")
 	flag.StringVar(&gcsBucketID, "bucket", "", "A GCS bucket ID in which it stores logs")
+	flag.StringVar(&bigQueryTableSpec, "bigquery-table", "", "A BigQuery table (project.dataset.table) into which it streams a summary row of each object, referring to the object by \"object\"")
+	flag.BoolVar(&bigQueryPayload, "bigquery-payload", false, "Include the payload in -bigquery-table rows as a JSON column \"payload\"")
+	flag.StringVar(&clickHouseDSN, "clickhouse-dsn", "", "A DSN of the ClickHouse native protocol into which it inserts a row per event, e.g. \"tcp://localhost:9000?database=default&table=h2olog_events\"")
+	flag.IntVar(&clickHouseBatchSize, "clickhouse-batch-size", 10000, "Number of rows to insert into -clickhouse-dsn at once")
+	flag.DurationVar(&clickHouseFlushInterval, "clickhouse-flush-interval", time.Second, "Max duration to hold rows for -clickhouse-dsn")
+	flag.StringVar(&kafkaBrokers, "kafka-brokers", "", "Comma-separated Kafka brokers (host:port) to which it publishes the payload of each object to -kafka-topic, keyed by dcid")
+	flag.StringVar(&kafkaTopic, "kafka-topic", "", "A Kafka topic for -kafka-brokers")
+	flag.StringVar(&pubSubTopicSpec, "pubsub-topic", "", "A Pub/Sub topic (projects/$project/topics/$topic, or a topic in the project of the credentials) to which it publishes the payload of each object")
+	flag.IntVar(&busBatchConns, "bus-batch-conns", 0, "Max number of connections batched into a message of -kafka-topic and -pubsub-topic (default: a message per connection)")
+	flag.IntVar(&busBatchBytes, "bus-batch-bytes", 0, "Max size of a batched message (default: the limit of the sink)")
+	flag.DurationVar(&busBatchDelay, "bus-batch-delay", busBatchDelay, "Max duration to hold a connection in a partial batch of -bus-batch-conns")
+	flag.StringVar(&s3BucketName, "s3-bucket", "", "An AWS S3 bucket in which it stores logs, with the standard credential resolution of AWS SDK")
+	flag.StringVar(&onNameCollision, "on-name-collision", collisionOverwrite, "What to do when an object name already exists: overwrite, suffix, skip, or error")
+	flag.BoolVar(&exactlyOnce, "exactly-once", false, "Store exactly one object per connection keyed by the dcid and the time of quicly:accept, skipping duplicates resent by -input-ack clients or written by other collectors")
+	flag.StringVar(&secondaryGcsBucketID, "secondary-bucket", "", "A GCS bucket ID, typically in another region, to which it replicates logs asynchronously")
+	flag.Func("storage-class-rules", "Comma-separated rules to choose a GCS storage class by size, duration, or interesting (5xx, reset streams, anomalies, or no quicly:free), e.g. \"interesting=STANDARD,size>1048576=STANDARD,*=NEARLINE\"", func(s string) error {
+		rules, err := parseStorageClassRules(s)
+		storageClassRules = rules
+		return err
+	})
+	flag.Func("inject-faults", "Inject failures and latency into the sinks for testing, e.g. \"seed=42,error-rate=0.1,latency=500ms,latency-rate=0.5,outage=10s/1m\"", func(s string) error {
+		faults, err := parseFaultInjector(s)
+		faultInjection = faults
+		return err
+	})
+	flag.StringVar(&compressMethod, "compress", "", "Compression of objects: none, zstd, or gzip (default: zstd with -zstd-dict, otherwise none)")
+	flag.Func("object-name-template", "A Go template of object names with .Host, .DCID, .ConnID, .AcceptTime, .StartTime, .SNI, and .Role, e.g. \"{{.Host}}/{{.DCID}}-{{.AcceptTime}}\" (default: host-dcid-time)", func(s string) error {
+		tmpl, err := parseObjectNameTemplate(s)
+		objectNameTemplate = tmpl
+		return err
+	})
+	flag.StringVar(&prefixLayout, "prefix-layout", "", "A Go time layout of the prefix of object names by the start time in UTC, e.g. \"2006/01/02/15\" for hourly partitions")
+	flag.Func("encryption-keys", "Comma-separated rules to encrypt objects by SNI with AES-256-GCM keys of tenants in hex, e.g. \"api.example.com=/etc/keys/api,*=/etc/keys/default\"", func(s string) error {
+		rules, err := parseEncryptionRules(s)
+		encryptionRules = rules
+		return err
+	})
+	flag.Func("include-events", "Comma-separated event types to keep in payloads, e.g. \"packet-lost,transport-close-receive\"; the others are counted in num_events but dropped (default: all)", func(s string) error {
+		includeEvents = parseEventTypes(s)
+		return nil
+	})
+	flag.Func("exclude-events", "Comma-separated event types to drop from payloads, e.g. \"packet-received,packet-sent\", which are counted in num_events", func(s string) error {
+		excludeEvents = parseEventTypes(s)
+		return nil
+	})
+	flag.Func("filter-client-cidr", "Comma-separated CIDRs or addresses of clients whose connections are tracked, those prefixed with \"!\" ignored, e.g. \"203.0.113.0/24,!203.0.113.8\" (default: all)", func(s string) error {
+		var err error
+		clientCIDRFilter, err = parseCIDRFilter(s)
+		return err
+	})
+	flag.Func("filter-sni-glob", "Comma-separated glob patterns of SNI whose connections are tracked, those prefixed with \"!\" ignored, e.g. \"*.example.com,!internal.example.com\" (default: all)", func(s string) error {
+		var err error
+		sniGlobFilter, err = parseGlobFilter(s)
+		return err
+	})
+	flag.Func("retention-rules", "Comma-separated rules to prefix object names by SNI for bucket lifecycle rules, e.g. \"api.example.com=retention-90d/,*=retention-7d/\"", func(s string) error {
+		rules, err := parseRetentionRules(s)
+		retentionRules = rules
+		return err
+	})
+	flag.Func("source-hosts", "Comma-separated host labels of input sources (file paths, \"stdin\", or remote IP addresses of -listen-tcp) overriding -host, e.g. \"/var/log/h2o-1.jsonl=web1,stdin=web2\"", func(s string) error {
+		hosts, err := parseSourceHosts(s)
+		sourceHosts = hosts
+		return err
+	})
+	flag.StringVar(&zstdDictPath, "zstd-dict", "", "A dictionary trained by the train-zstd-dict subcommand for -compress=zstd")
+	flag.BoolVar(&finalFlush, "final-flush", false, "Upload connections still live at the end of input, marked as incomplete")
+	flag.StringVar(&finalFlushLocalDir, "final-flush-local", "", "A local directory to which -final-flush writes instead of the other sinks, so that truncated connections don't mix with complete ones")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "Max duration to drain live connections and uploads on SIGTERM or SIGINT, after which the readers, uploads, and sinks are canceled")
+	flag.DurationVar(&drainTimeout, "shutdown-timeout", 30*time.Second, "An alias of -drain-timeout")
+	flag.StringVar(&auditLogPath, "audit-log", "", "A file to which it appends an audit record (JSON lines) for each connection")
+	flag.StringVar(&notifyWebhookURL, "notify-webhook", "", "A URL to which it posts a notification (JSON) for each uploaded object")
+	flag.StringVar(&anomalyWebhookURL, "anomaly-webhook", "", "A URL to which it posts a notification (JSON) for each connection with anomalies, e.g. amplification attempts")
+	flag.DurationVar(&rates.window, "rate-window", time.Minute, "Window to compute the rates of new and freed connections")
+	flag.Float64Var(&rates.threshold, "rate-alert-threshold", 10, "Ratio of the rates of new and freed connections to post -rate-alert-webhook")
+	flag.StringVar(&rateAlertWebhookURL, "rate-alert-webhook", "", "A URL to which it posts an alert (JSON) when the rates of new and freed connections diverge")
+	flag.DurationVar(&signedURLTTL, "signed-url-ttl", 0, "Include a signed URL valid for the duration in notifications of objects in -bucket (default: disabled)")
+	flag.IntVar(&uploadOrderBufferSize, "upload-order-buffer", 0, "Hold up to the number of connections to upload them in the order of their end time (default: disabled)")
+	flag.DurationVar(&uploadOrderMaxDelay, "upload-order-max-delay", 10*time.Second, "Max duration for which -upload-order-buffer holds a connection")
+	flag.StringVar(&pidFilePath, "pidfile", "", "A file to write the process ID to, locked so that only one instance runs per file (e.g. per input source)")
+	flag.Int64Var(&maxMemoryMB, "max-memory-mb", 0, "Approximate max megabytes of buffered payloads, beyond which -memory-pressure applies (default: unlimited)")
+	flag.StringVar(&memory.pressure, "memory-pressure", memory.pressure, "What to do beyond -max-memory-mb: flush (the largest connections) or pause (reading input until uploads finish)")
+	flag.IntVar(&uploadConcurrency, "upload-concurrency", 64, "Max number of concurrent uploads, beyond which reading input waits (0 for unlimited; default: 16 per CPU up to 64)")
+	flag.Float64Var(&uploadRate, "upload-rate", 0, "Max number of uploads per second to smooth bursts (default: unlimited)")
+	flag.IntVar(&uploadBurst, "upload-burst", 10, "Number of uploads allowed at once beyond -upload-rate")
+	flag.DurationVar(&uploadMaxDelay, "upload-max-delay", 30*time.Second, "Max duration for which -upload-rate delays an upload")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "An address to serve metrics at /debug/vars, e.g. \":9100\"")
+	flag.StringVar(&adminAddr, "admin-addr", "", "An address to serve the admin API, e.g. \"localhost:9101\"")
 
+	flag.BoolVar(&autoMaxProcs, "auto-maxprocs", autoMaxProcs, "Set GOMAXPROCS to the CPU quota of the container unless the GOMAXPROCS environment variable is set")
+	flag.BoolVar(&deterministic, "deterministic", false, "Produce the same objects for the same input by uploading one by one, fixing the clock to the Unix epoch, and using \"localhost\" unless -host is given (for golden tests)")
+	flag.BoolVar(&inputAck, "input-ack", false, "Send \"ACK <bytes>\" lines back to -listen-unix and -listen-tcp clients once the events up to the bytes are uploaded, for at-least-once delivery")
+	flag.BoolVar(&follow, "follow", false, "Keep reading the input files given as arguments like tail -F, reopening them when rotated and rewinding them when truncated")
+	flag.StringVar(&jsonParser, "json-parser", jsonParser, "The JSON parser of input lines: goccy, std (encoding/json), or auto (goccy, retrying with std on errors)")
+	flag.BoolVar(&embedFieldDictionary, "field-dictionary", false, "Embed \"field_dictionary\", the fields and their JSON types of events by event type, in objects for schema inference")
+	flag.StringVar(&payloadFormat, "payload-format", payloadFormat, "Layout of the payload in objects: json (an array in the root object), ndjson (the root object as a header line followed by an event per line), parquet (a row per event), avro (a record per connection), or qlog (a trace per connection for qvis)")
+	flag.StringVar(&payloadFormat, "format", payloadFormat, "An alias of -payload-format")
+	flag.StringVar(&sinkFormatsSpec, "sink-formats", "", "Comma-separated formats (payload format[+compression]) by sink (local, gcs, or s3) overriding -payload-format and -compress, e.g. \"local=json+none,gcs=ndjson+zstd\"")
+	flag.BoolVar(&paranoid, "paranoid", false, "Parse each serialized object back and check its fields before upload, refusing to write broken objects")
 	flag.BoolVar(&debug, "debug", false, "Emit debug logs to STDERR")
+	flag.StringVar(&configPath, "config", "", "A YAML or TOML file of settings whose keys are flag names; flags in the command line and H2OLOG_COLLECT_* environment variables take precedence")
 	flag.BoolVar(&showVersion, "version", false, "Show the revision and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s: [flags] [input files (\"-\" for STDIN)...]\n", flag.CommandLine.Name())
+		flag.PrintDefaults()
+		printSubcommands()
+	}
 	flag.Parse()
 
+	err := loadEnv()
+	if err != nil {
+		log.Fatalf("Cannot load environment variables: %v", err)
+	}
+	if configPath != "" {
+		err := loadConfig(configPath)
+		if err != nil {
+			log.Fatalf("Cannot load -config: %v", err)
+		}
+	}
+
+	tuneMaxProcs()
+	uploadConcurrencyGiven := false
+	flag.Visit(func(f *flag.Flag) {
+		uploadConcurrencyGiven = uploadConcurrencyGiven || f.Name == "upload-concurrency"
+	})
+	if !uploadConcurrencyGiven && uploadConcurrency > 0 {
+		uploadConcurrency = defaultUploadConcurrency(uploadConcurrency)
+	}
+
+	if deterministic {
+		now = func() time.Time { return time.Unix(0, 0) }
+		hostGiven := false
+		flag.Visit(func(f *flag.Flag) {
+			hostGiven = hostGiven || f.Name == "host"
+		})
+		if !hostGiven {
+			host = "localhost"
+		}
+	}
+
 	if showVersion {
 		fmt.Printf("%s (rev: %s)\n", strings.TrimSpace(version), revision)
 		os.Exit(0)
 	}
 
+	switch memory.pressure {
+	case pressurePause, pressureFlush:
+	default:
+		log.Fatalf("Invalid -memory-pressure: %s", memory.pressure)
+	}
+	memory.maxBytes = maxMemoryMB * 1024 * 1024
+
+	switch payloadRetention {
+	case retainAll, retainErrors:
+	default:
+		log.Fatalf("Invalid -payload-retention: %s", payloadRetention)
+	}
+
+	switch localDurability {
+	case durabilityNone, durabilityFsync, durabilityDirsync:
+	default:
+		log.Fatalf("Invalid -local-durability: %s", localDurability)
+	}
+
+	switch connlessEvents {
+	case connlessDrop, connlessGlobal, connlessAttach:
+	default:
+		log.Fatalf("Invalid -connless-events: %s", connlessEvents)
+	}
+	if globalEvents.window < time.Millisecond {
+		log.Fatalf("Invalid -global-events-window: %v", globalEvents.window)
+	}
+
+	if uploadAttempts < 1 {
+		log.Fatalf("Invalid -upload-attempts: %d", uploadAttempts)
+	}
+	if busBatchConns > 1 && busBatchDelay <= 0 {
+		log.Fatalf("Invalid -bus-batch-delay: %v", busBatchDelay)
+	}
+
+	switch onOversizedObject {
+	case oversizedTrim, oversizedSplit:
+	default:
+		log.Fatalf("Unknown -on-oversized-object: %s", onOversizedObject)
+	}
+	switch onNameCollision {
+	case collisionOverwrite, collisionSuffix, collisionSkip, collisionError:
+	default:
+		log.Fatalf("Unknown -on-name-collision: %s", onNameCollision)
+	}
+	switch jsonParser {
+	case jsonParserGoccy, jsonParserStd, jsonParserAuto:
+	default:
+		log.Fatalf("Unknown -json-parser: %s", jsonParser)
+	}
+	// defaulted before -payload-format is checked, as -zstd-dict implies -compress=zstd
+	if compressMethod == "" {
+		compressMethod = compressNone
+		if zstdDictPath != "" {
+			compressMethod = compressZstd
+		}
+	}
+	switch payloadFormat {
+	case payloadFormatJSON, payloadFormatNDJSON, payloadFormatQlog:
+	case payloadFormatParquet, payloadFormatAvro:
+		if compressMethod != compressNone {
+			log.Fatalf("-payload-format=%s cannot be used with -compress nor -zstd-dict", payloadFormat)
+		}
+	default:
+		log.Fatalf("Unknown -payload-format: %s", payloadFormat)
+	}
+	if exactlyOnce {
+		if onNameCollision != collisionOverwrite && onNameCollision != collisionSkip {
+			log.Fatalf("-exactly-once cannot be used with -on-name-collision=%s", onNameCollision)
+		}
+		if finalFlush && finalFlushLocalDir == "" {
+			log.Fatalf("-exactly-once requires -final-flush-local for -final-flush")
+		}
+		onNameCollision = collisionSkip
+	}
+
+	var command *subcommand
+	var inputPaths []string
 	if len(flag.Args()) != 0 {
-		fmt.Fprintf(os.Stderr, "Usage of %s:\n", flag.CommandLine.Name())
-		flag.PrintDefaults()
-		os.Exit(0)
+		if c, ok := subcommands[flag.Arg(0)]; ok {
+			command = &c
+		} else {
+			inputPaths = flag.Args()
+		}
+	}
+	if len(inputPaths) > 0 && replayFilePath != "" {
+		log.Fatalf("Input files cannot be given with -replay")
+	}
+	if replayFilePath != "" && (listenUnixPath != "" || listenTCPAddress != "" || execCommandLine != "") {
+		log.Fatalf("-replay cannot be used with -listen-unix, -listen-tcp, nor -exec")
+	}
+	if follow && len(inputPaths) == 0 {
+		log.Fatalf("-follow requires input files as arguments")
+	}
+
+	err = setupCompression(compressMethod, zstdDictPath)
+	if err != nil {
+		log.Fatalf("Cannot set up -compress: %v", err)
+	}
+	if sinkFormatsSpec != "" {
+		sinkFormats, err = parseSinkFormats(sinkFormatsSpec)
+		if err != nil {
+			log.Fatalf("Cannot parse -sink-formats: %v", err)
+		}
 	}
 
-	ctx := context.Background()
+	// canceled by -drain-timeout to stop the readers, the workers, and the sinks
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// resolves GCP credentials only for the GCP sinks, so that it runs without them otherwise
+	var client *gcs.Client
+	if gcsBucketID != "" || (command == nil && (secondaryGcsBucketID != "" || bigQueryTableSpec != "" || pubSubTopicSpec != "")) {
+		credentialsOption, err := resolveCredentials(ctx, credentialsFile)
+		if err != nil {
+			log.Fatalf("Cannot resolve GCP credentials: %v", err)
+		}
+		client, err = gcs.NewClient(ctx, credentialsOption)
+		if err != nil {
+			log.Fatalf("storage.NewClient: %v", err)
+		}
+		defer client.Close()
+	}
+
+	if command != nil {
+		var store archive.Store
+		if gcsBucketID != "" {
+			store = archive.NewGCSStore(client.Bucket(gcsBucketID))
+		} else if strings.Contains(localDir, ",") {
+			log.Fatalf("%s: takes only one directory as -local", flag.Arg(0))
+		} else if localDir != "" {
+			store = archive.NewLocalStore(localDir)
+		} else if !command.storeOptional {
+			log.Fatalf("-bucket or -local is required for %s", flag.Arg(0))
+		}
+		err = command.run(ctx, store, flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("%s: %v", flag.Arg(0), err)
+		}
+		return
+	}
 
-	client, err := gcs.NewClient(ctx, clientOption())
+	// takes over the inputs from the old process if started by soft restart
+	err = softRestart.inherit()
 	if err != nil {
-		log.Fatalf("storage.NewClient: %v", err)
+		log.Fatalf("Cannot take over the inputs by soft restart: %v", err)
+	}
+	softRestart.enabled = (listenUnixPath != "" || listenTCPAddress != "") && execCommandLine == "" && len(inputPaths) == 0 && replayFilePath == ""
+
+	if pidFilePath != "" {
+		release, err := writePidFile(pidFilePath)
+		if err != nil {
+			log.Fatalf("Cannot write the pidfile: %v", err)
+		}
+		defer release()
 	}
-	defer client.Close()
 
 	storage := storageManager{
-		ctx:      ctx,
-		bucket:   nil,
-		localDir: nil,
+		ctx:             ctx,
+		bucket:          nil,
+		localDurability: localDurability,
+		onNameCollision: onNameCollision,
+		createOnly:      exactlyOnce,
+		maxAttempts:     uploadAttempts,
+		faults:          faultInjection,
 	}
 
 	if gcsBucketID != "" {
 		storage.bucket = client.Bucket(gcsBucketID)
+		storage.bucketID = gcsBucketID
+	}
+
+	if s3BucketName != "" {
+		storage.s3Bucket, err = newS3Bucket(s3BucketName)
+		if err != nil {
+			log.Fatalf("Cannot set up the S3 bucket: %v", err)
+		}
+	}
+
+	if secondaryGcsBucketID != "" {
+		storage.secondaryBucket = client.Bucket(secondaryGcsBucketID)
+		storage.replicationSlots = make(chan struct{}, maxReplications)
 	}
 
 	if localDir != "" {
-		os.MkdirAll(localDir, os.ModePerm)
-		storage.localDir = &localDir
+		for _, dir := range strings.Split(localDir, ",") {
+			os.MkdirAll(dir, os.ModePerm)
+			storage.localDirs = append(storage.localDirs, dir)
+		}
+	}
+
+	if auditLogPath != "" {
+		auditLog, err = openAuditLog(auditLogPath)
+		if err != nil {
+			log.Fatalf("Cannot open the audit log: %v", err)
+		}
+		defer auditLog.close()
+	}
+
+	if uploadLeftoversOnStart {
+		if auditLogPath == "" || len(storage.localDirs) == 0 || !storage.hasRemote() {
+			log.Fatalf("-upload-leftovers requires -audit-log, -local, and a bucket")
+		}
+		numUploaded, err := uploadLeftovers(&storage, auditLogPath)
+		if err != nil {
+			log.Fatalf("Cannot upload leftovers: %v", err)
+		}
+		log.Printf("Uploaded %d leftover objects", numUploaded)
+	}
+
+	if bigQueryTableSpec != "" {
+		bigQuery, err = newBigQueryTable(ctx, bigQueryTableSpec, bigQueryPayload)
+		if err != nil {
+			log.Fatalf("Cannot set up -bigquery-table: %v", err)
+		}
+	}
+
+	if clickHouseDSN != "" {
+		clickHouse, err = newClickHouseTable(ctx, clickHouseDSN, clickHouseBatchSize, clickHouseFlushInterval)
+		if err != nil {
+			log.Fatalf("Cannot set up -clickhouse-dsn: %v", err)
+		}
+	}
+
+	if kafkaBrokers != "" || kafkaTopic != "" {
+		kafkaSink, err = newKafkaProducer(ctx, kafkaBrokers, kafkaTopic)
+		if err != nil {
+			log.Fatalf("Cannot set up -kafka-brokers: %v", err)
+		}
+	}
+
+	if pubSubTopicSpec != "" {
+		pubSub, err = newPubSubTopic(ctx, pubSubTopicSpec)
+		if err != nil {
+			log.Fatalf("Cannot set up -pubsub-topic: %v", err)
+		}
+	}
+
+	if dedupWindow > 0 {
+		recentUploads = newRecentUploadCache(dedupWindow)
+	}
+
+	if spoolDir != "" {
+		spool = &deadLetterSpool{
+			dir:      spoolDir,
+			interval: spoolRetryInterval,
+			storage:  &storage,
+		}
+		spool.start(ctx)
+	}
+
+	if metricsAddr != "" {
+		serveMetrics(metricsAddr)
+	}
+
+	if adminAddr != "" {
+		serveAdmin(ctx, adminAddr, &storage)
+	}
+
+	if notifyWebhookURL != "" {
+		notify = newNotifier(notifyWebhookURL)
+	}
+
+	if anomalyWebhookURL != "" {
+		anomalyNotify = newNotifier(anomalyWebhookURL)
+	}
+
+	if rateAlertWebhookURL != "" {
+		rates.alert = newNotifier(rateAlertWebhookURL)
+	}
+	if rates.window > 0 {
+		rates.start(ctx)
 	}
 
 	latch := &sync.WaitGroup{}
-	readJSONLine(ctx, &storage, os.Stdin, latch)
-	latch.Wait()
+
+	flushRequests := make(chan os.Signal, 1)
+	notifyFlushSignal(flushRequests)
+	go func() {
+		for sig := range flushRequests {
+			if exactlyOnce {
+				log.Printf("Ignored %v, as snapshots would take the names of the final objects with -exactly-once", sig)
+				continue
+			}
+			log.Printf("Received %v; flushing all the live connections", sig)
+			connsMutex.Lock()
+			flushAll(ctx, &storage)
+			connsMutex.Unlock()
+		}
+	}()
+
+	restartRequests := make(chan os.Signal, 1)
+	notifySoftRestartSignal(restartRequests)
+	go func() {
+		for sig := range restartRequests {
+			log.Printf("Received %v; handing off the inputs to a new process", sig)
+			err := softRestart.start()
+			if err != nil {
+				log.Printf("Ignored %v: %v", sig, err)
+			}
+		}
+	}()
+
+	// the sink for live connections at the end of input
+	finalStorage := &storage
+	if finalFlushLocalDir != "" {
+		os.MkdirAll(finalFlushLocalDir, os.ModePerm)
+		finalStorage = &storageManager{
+			ctx:             ctx,
+			localDirs:       []string{finalFlushLocalDir},
+			localDurability: localDurability,
+			onNameCollision: onNameCollision,
+			maxAttempts:     uploadAttempts,
+			faults:          faultInjection,
+		}
+	} else if exactlyOnce {
+		// incomplete objects would take the names of the final ones
+		finalStorage = nil
+	}
+
+	stopRequests := make(chan os.Signal, 1)
+	signal.Notify(stopRequests, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-stopRequests
+		log.Printf("Received %v; flushing all the live connections and shutting down", sig)
+		stopManagedCommand()
+		// keep the lock to stop reading the input
+		connsMutex.Lock()
+		if !finishInput(ctx, cancel, &storage, finalStorage, latch, drainTimeout) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
+
+	uploadEvicted = func(entry *logEntry) {
+		finalizeEntry(ctx, &storage, latch, entry)
+	}
+
+	if idleSweeper.timeout > 0 {
+		idleSweeper.start(ctx, &storage, latch)
+	}
+
+	if connlessEvents == connlessGlobal {
+		globalEvents.flushPeriodically(ctx, &storage, latch)
+	}
+
+	if uploadConcurrency > 0 {
+		startUploadWorkers(uploadConcurrency)
+	}
+
+	if uploadRate > 0 {
+		uploadLimit = newUploadLimiter(uploadRate, uploadBurst, uploadMaxDelay)
+	}
+
+	if uploadOrderBufferSize > 0 && uploadOrderMaxDelay > 0 {
+		uploadOrder = newUploadOrderBuffer(uploadOrderBufferSize, uploadOrderMaxDelay, func(entry *logEntry) {
+			startUpload(ctx, latch, &storage, entry)
+		})
+	}
+
+	if replayFilePath != "" {
+		replayFile(ctx, &storage, replayFilePath, replayOffsetFile, replaySpeed, latch)
+	} else {
+		// all the inputs are read concurrently into connToLogs, until all of them end
+		inputs := make([]func(), 0)
+		if execCommandLine != "" {
+			inputs = append(inputs, func() { runManagedCommand(ctx, &storage, execCommandLine, latch) })
+		}
+		if listenTCPAddress != "" {
+			inputs = append(inputs, func() { listenTCP(ctx, &storage, listenTCPAddress, latch) })
+		}
+		if listenUnixPath != "" {
+			inputs = append(inputs, func() { listenUnix(ctx, &storage, listenUnixPath, latch) })
+		}
+		if len(inputPaths) > 0 {
+			inputs = append(inputs, func() { readFiles(ctx, &storage, inputPaths, follow, latch) })
+		}
+		if len(inputs) == 0 {
+			inputs = append(inputs, func() { readJSONLine(ctx, &storage, newInputSource("stdin", os.Stdin), latch) })
+		}
+		readInputs(inputs)
+		// the live connections of the streams are handed off, if any, before the final flush
+		softRestart.wait()
+	}
+	if !finalFlush {
+		finalStorage = nil
+	}
+	connsMutex.Lock()
+	finishInput(ctx, cancel, &storage, finalStorage, latch, 0)
+	connsMutex.Unlock()
 
 	if debug {
 		log.Printf("[D] Shutting down")
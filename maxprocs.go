@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"math"
+	"os"
+	"runtime"
+)
+
+// the number of uploads per CPU for the default of -upload-concurrency, as uploads mostly wait for the network
+const uploadsPerCPU = 16
+
+var autoMaxProcs = true // -auto-maxprocs
+
+// tuneMaxProcs sets GOMAXPROCS to the CPU quota of the container, rounded up, unless the
+// GOMAXPROCS environment variable is set. Otherwise Go uses all the CPUs of the host, and
+// the threads are throttled in small containers.
+func tuneMaxProcs() {
+	if !autoMaxProcs || os.Getenv("GOMAXPROCS") != "" {
+		return
+	}
+	quota := cpuQuota()
+	if quota <= 0 {
+		return
+	}
+	procs := int(math.Ceil(quota))
+	if procs < runtime.GOMAXPROCS(0) {
+		runtime.GOMAXPROCS(procs)
+		log.Printf("Set GOMAXPROCS to %d for the CPU quota %.2f", procs, quota)
+	}
+}
+
+// defaultUploadConcurrency returns the number of upload workers for the CPUs available,
+// up to the given max
+func defaultUploadConcurrency(max int) int {
+	n := runtime.GOMAXPROCS(0) * uploadsPerCPU
+	if n > max {
+		return max
+	}
+	return n
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// what to do when bufferedBytes exceeds -max-memory-mb (-memory-pressure)
+const (
+	// wait for in-flight uploads to release memory before reading more input
+	pressurePause = "pause"
+	// finalize the largest live connections
+	pressureFlush = "flush"
+)
+
+// memoryBudget bounds bufferedBytes (-max-memory-mb). Both actions fall back to the other
+// one: "pause" flushes if no upload is in flight, and "flush" pauses for flushed
+// connections to be uploaded.
+type memoryBudget struct {
+	maxBytes int64
+	pressure string
+}
+
+var memory = &memoryBudget{pressure: pressureFlush}
+
+// the number of uploads which have not released their buffers, updated atomically
+var numUploadsInFlight int64
+
+func (budget *memoryBudget) exceeded() bool {
+	return budget.maxBytes > 0 && atomic.LoadInt64(&bufferedBytes) > budget.maxBytes
+}
+
+// wait blocks reading input while the budget is exceeded, flushing live connections if needed
+func (budget *memoryBudget) wait(ctx context.Context, storage *storageManager, latch *sync.WaitGroup) {
+	if !budget.exceeded() {
+		return
+	}
+	metricMemoryPressure.Add(1)
+	for budget.exceeded() {
+		if budget.pressure == pressureFlush || atomic.LoadInt64(&numUploadsInFlight) == 0 {
+			connsMutex.Lock()
+			budget.flushLargest(ctx, storage, latch)
+			connsMutex.Unlock()
+		}
+		if atomic.LoadInt64(&numUploadsInFlight) == 0 || ctx.Err() != nil {
+			// nothing more to release
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// flushLargest finalizes the largest live connections until the buffers to be released by
+// uploads bring bufferedBytes down to 90% of the budget, so that it doesn't flush on every
+// event. The caller must hold connsMutex.
+func (budget *memoryBudget) flushLargest(ctx context.Context, storage *storageManager, latch *sync.WaitGroup) {
+	entries := make([]*logEntry, 0)
+	for _, key := range connToLogs.Keys() {
+		value, ok := connToLogs.Peek(key)
+		if !ok {
+			continue
+		}
+		entry := value.(*logEntry)
+		if !entry.processed && entry.estimatedSize > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].estimatedSize > entries[j].estimatedSize
+	})
+
+	excess := atomic.LoadInt64(&bufferedBytes) - budget.maxBytes*9/10
+	numFlushed := 0
+	for _, entry := range entries {
+		if excess <= 0 {
+			break
+		}
+		if debug {
+			log.Printf("[D] Flushing connID=%d (%d bytes) as -max-memory-mb is exceeded", entry.connID, entry.estimatedSize)
+		}
+		excess -= int64(entry.estimatedSize)
+		entry.forciblyClosed = true
+		finalizeEntry(ctx, storage, latch, entry)
+		numFlushed++
+	}
+	if numFlushed > 0 {
+		log.Printf("Flushed %d live connections as -max-memory-mb is exceeded", numFlushed)
+	}
+}
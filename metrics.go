@@ -0,0 +1,174 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// metrics exported via expvar at /debug/vars of -metrics-addr
+var (
+	// the difference between the receive time and the event time in milliseconds, per input source
+	// or per remote host of -listen-tcp, removed at the end of the last stream with the label.
+	// -replay has no lag, as its events are not received in real time.
+	metricInputLagMillis = expvar.NewMap("input_lag_ms")
+	// the number of connections created and freed by quicly:free, and their rates per -rate-window
+	metricConnsCreated     = expvar.NewInt("conns_created")
+	metricConnsFreed       = expvar.NewInt("conns_freed")
+	metricNewConnsPerSec   = expvar.NewFloat("new_conns_per_sec")
+	metricFreedConnsPerSec = expvar.NewFloat("freed_conns_per_sec")
+	// the number of connections finalized to be uploaded
+	metricConnsFlushed = expvar.NewInt("conns_flushed")
+	// the number of uploads delayed by -upload-rate
+	metricUploadsDelayed = expvar.NewInt("uploads_delayed")
+	// the number of writes retried by -upload-attempts
+	metricUploadRetries = expvar.NewInt("upload_retries")
+	// the progress of -replay
+	metricReplayBytesProcessed = expvar.NewInt("replay_bytes_processed")
+	metricReplayBytesTotal     = expvar.NewInt("replay_bytes_total")
+	// totals of uploaded objects; divide them by objects_written for averages
+	metricObjectsWritten           = expvar.NewInt("objects_written")
+	metricUncompressedBytesTotal   = expvar.NewInt("uncompressed_bytes_total")
+	metricCompressedBytesTotal     = expvar.NewInt("compressed_bytes_total")
+	metricSerializeMillisTotal     = expvar.NewInt("serialize_ms_total")
+	metricUploadLatencyMillisTotal = expvar.NewInt("upload_latency_ms_total")
+	// the number of connections evicted from the LRU cache before quicly:free
+	metricConnsEvicted = expvar.NewInt("conns_evicted")
+	// the number of times -max-memory-mb is exceeded
+	metricMemoryPressure = expvar.NewInt("memory_pressure")
+	// the number of events without "conn"
+	metricConnlessEvents = expvar.NewInt("connless_events")
+	// the number of connections summarized-only due to -max-live-conns-hard-limit
+	metricLiveConnsGuardTriggered = expvar.NewInt("live_conns_guard_triggered")
+	// the number of objects that -paranoid refused to upload
+	metricParanoidFailures = expvar.NewInt("paranoid_failures")
+	// the number of events dropped from payloads by -include-events or -exclude-events
+	metricEventsFiltered = expvar.NewInt("events_filtered")
+	// the number of connections ignored by -filter-client-cidr or -filter-sni-glob
+	metricConnsUntracked = expvar.NewInt("conns_untracked")
+	// the number of request IDs that linked connections by -correlation-header
+	metricCorrelatedRequests = expvar.NewInt("correlated_requests")
+	// the number of live connections handed off to a new process by soft restart
+	metricConnsHandedOff = expvar.NewInt("conns_handed_off")
+	// the number of quicly:accept or quicly:connect after the first one in a connection
+	metricDuplicateAccepts = expvar.NewInt("duplicate_accepts")
+	// the numbers of duplicate finalizations suppressed by reason (see dedup.go), and the number
+	// of objects in the cache of -dedup-window
+	metricDuplicatesSuppressed = expvar.NewMap("duplicates_suppressed")
+	metricDedupCacheSize       = expvar.NewInt("dedup_cache_size")
+	// the number of events dropped as their connections have been finalized by -idle-timeout or
+	// -max-memory-mb
+	metricEventsAfterForcedClose = expvar.NewInt("events_after_forced_close")
+	// the number of parts of live connections uploaded by -split-window
+	metricPartsSplit = expvar.NewInt("parts_split")
+	// the number of objects trimmed by -max-object-bytes
+	metricObjectsTrimmed = expvar.NewInt("objects_trimmed")
+	// the number of objects split into chunks by -max-object-bytes
+	metricObjectsSplit = expvar.NewInt("objects_split")
+	// the numbers of objects written to -spool-dir and uploaded from it
+	metricObjectsSpooled = expvar.NewInt("objects_spooled")
+	metricSpoolUploads   = expvar.NewInt("spool_uploads")
+	// the number of input lines that -json-parser=auto decoded with std after goccy failed
+	metricJSONParserFallbacks = expvar.NewInt("json_parser_fallbacks")
+	// the numbers of rows inserted into -bigquery-table and failures
+	metricBigQueryRows   = expvar.NewInt("bigquery_rows")
+	metricBigQueryErrors = expvar.NewInt("bigquery_errors")
+	// the number of rows inserted into -clickhouse-dsn, and the number of failed batches
+	metricClickHouseRows   = expvar.NewInt("clickhouse_rows")
+	metricClickHouseErrors = expvar.NewInt("clickhouse_errors")
+	// the numbers of messages published to -kafka-topic and failures
+	metricKafkaMessages = expvar.NewInt("kafka_messages")
+	metricKafkaErrors   = expvar.NewInt("kafka_errors")
+	// the numbers of messages published to -pubsub-topic and failures
+	metricPubSubMessages = expvar.NewInt("pubsub_messages")
+	metricPubSubErrors   = expvar.NewInt("pubsub_errors")
+	// the numbers of connections sent in batches of -bus-batch-conns, by "kafka" and "pubsub"
+	metricBusBatchedRecords = expvar.NewMap("bus_batched_records")
+)
+
+func init() {
+	// the number of connections that have not been finalized
+	expvar.Publish("live_conns", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&numLiveConns)
+	}))
+	// the estimated bytes of payloads buffered in memory
+	expvar.Publish("buffered_bytes", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&bufferedBytes)
+	}))
+	// the number of uploads waiting for a worker of -upload-concurrency
+	expvar.Publish("upload_queue_length", expvar.Func(func() interface{} {
+		return len(uploadQueue)
+	}))
+}
+
+// serveMetrics serves expvar metrics in background, until the listener is handed off by soft
+// restart
+func serveMetrics(addr string) {
+	listener, err := softRestart.listen("tcp", addr, nil)
+	if err != nil {
+		log.Fatalf("Cannot serve metrics at %s: %v", addr, err)
+	}
+	go func() {
+		defer softRestart.stopListening()
+		err := http.Serve(listener, http.DefaultServeMux)
+		if err != nil && !softRestart.startedHandoff() {
+			log.Fatalf("Cannot serve metrics at %s: %v", addr, err)
+		}
+	}()
+}
+
+// recordUploadMetrics adds the sizes and the latencies of an upload to the totals
+func recordUploadMetrics(record *auditRecord) {
+	metricObjectsWritten.Add(1)
+	metricUncompressedBytesTotal.Add(int64(record.UncompressedBytes))
+	metricCompressedBytesTotal.Add(int64(record.Bytes))
+	metricSerializeMillisTotal.Add(record.SerializeMillis)
+	metricUploadLatencyMillisTotal.Add(record.LatencyMillis)
+}
+
+// the number of live streams by the label of input_lag_ms, e.g. those of a remote host of
+// -listen-tcp, guarded by inputLagMutex
+var inputLagStreams = make(map[string]int)
+var inputLagMutex sync.Mutex
+
+// acquireInputLag registers a stream that records its lag with the label. It does nothing if
+// label is "".
+func acquireInputLag(label string) {
+	if label == "" {
+		return
+	}
+	inputLagMutex.Lock()
+	inputLagStreams[label]++
+	inputLagMutex.Unlock()
+}
+
+// releaseInputLag unregisters a stream at its end, and removes the lag of the label once no
+// stream has it. It does nothing if label is "".
+func releaseInputLag(label string) {
+	if label == "" {
+		return
+	}
+	inputLagMutex.Lock()
+	defer inputLagMutex.Unlock()
+	inputLagStreams[label]--
+	if inputLagStreams[label] <= 0 {
+		delete(inputLagStreams, label)
+		metricInputLagMillis.Delete(label)
+	}
+}
+
+// setInputLag records the lag of the latest event from a stream acquired with the label. It does
+// nothing if label is "".
+func setInputLag(label string, lagMillis int64) {
+	if label == "" {
+		return
+	}
+	value, ok := metricInputLagMillis.Get(label).(*expvar.Int)
+	if !ok {
+		value = new(expvar.Int)
+		metricInputLagMillis.Set(label, value)
+	}
+	value.Set(lagMillis)
+}
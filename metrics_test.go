@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestInputLag(t *testing.T) {
+	const label = "test-host"
+	lagOf := func() (int64, bool) {
+		value, ok := metricInputLagMillis.Get(label).(interface{ Value() int64 })
+		if !ok {
+			return 0, false
+		}
+		return value.Value(), true
+	}
+
+	// two streams from a host of -listen-tcp
+	acquireInputLag(label)
+	acquireInputLag(label)
+	setInputLag(label, 10)
+	setInputLag(label, 20)
+	if lag, ok := lagOf(); !ok || lag != 20 {
+		t.Errorf("the lag is %d (%v), want 20", lag, ok)
+	}
+
+	// the other stream continues after one ends
+	releaseInputLag(label)
+	if _, ok := lagOf(); !ok {
+		t.Error("the lag is removed while a stream has the label")
+	}
+	setInputLag(label, 30)
+	if lag, ok := lagOf(); !ok || lag != 30 {
+		t.Errorf("the lag is %d (%v), want 30", lag, ok)
+	}
+
+	releaseInputLag(label)
+	if _, ok := lagOf(); ok {
+		t.Error("the lag is not removed after the last stream")
+	}
+
+	// no lag for -replay
+	acquireInputLag("")
+	setInputLag("", 40)
+	if metricInputLagMillis.Get("") != nil {
+		t.Error("the lag of a source without a label is recorded")
+	}
+	releaseInputLag("")
+}
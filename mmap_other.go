@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// mmapFile reads a whole file into memory, as mmap(2) is not available
+func mmapFile(filePath string) ([]byte, func(), error) {
+	data, err := os.ReadFile(filePath)
+	return data, func() {}, err
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps a whole file into memory read-only
+func mmapFile(filePath string) ([]byte, func(), error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Size() == 0 {
+		return []byte{}, func() {}, nil
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	// it is read from the head to the tail
+	syscall.Madvise(data, syscall.MADV_SEQUENTIAL)
+	return data, func() { syscall.Munmap(data) }, nil
+}
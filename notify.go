@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	gcs "cloud.google.com/go/storage"
+	json "github.com/goccy/go-json"
+)
+
+// a message posted to the webhook for each uploaded object
+type uploadNotification struct {
+	// object name
+	Name string `json:"name"`
+	// connection id
+	ConnID int64 `json:"conn_id"`
+	// the server name indication, if any event has it
+	SNI string `json:"sni,omitempty"`
+	// the guessed time at the time when connection started
+	StartTime time.Time `json:"start_time"`
+	// the guessed time at the time when connection ended
+	EndTime time.Time `json:"end_time"`
+	// the signed URL to read the object, if -signed-url-ttl is given
+	SignedURL string `json:"signed_url,omitempty"`
+	// the time when SignedURL expires
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+type notifier struct {
+	webhookURL string
+	client     *http.Client
+}
+
+func newNotifier(webhookURL string) *notifier {
+	return &notifier{
+		webhookURL: webhookURL,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// post sends a message to the webhook as a JSON body
+func (notifier *notifier) post(message interface{}) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	res, err := notifier.client.Post(notifier.webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status from the webhook: %s", res.Status)
+	}
+	return nil
+}
+
+// the part of a service account key to sign URLs
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+}
+
+// buildSignedURL returns a URL to read the object without credentials until it expires
+func buildSignedURL(bucketID string, objectName string, expires time.Time) (string, error) {
+	var account serviceAccount
+	err := json.Unmarshal(credentialsJSON, &account)
+	if err != nil {
+		return "", err
+	}
+	if account.ClientEmail == "" || account.PrivateKey == "" {
+		return "", fmt.Errorf("the credentials have no client_email or private_key to sign URLs")
+	}
+	return gcs.SignedURL(bucketID, objectName, &gcs.SignedURLOptions{
+		GoogleAccessID: account.ClientEmail,
+		PrivateKey:     []byte(account.PrivateKey),
+		Method:         "GET",
+		Expires:        expires,
+		Scheme:         gcs.SigningSchemeV4,
+	})
+}
+
+// notifyUpload posts a notification of the uploaded object to the webhook
+func notifyUpload(storage *storageManager, objectName string, entry *logEntry) {
+	if notify == nil {
+		return
+	}
+
+	notification := &uploadNotification{
+		Name:      objectName,
+		ConnID:    entry.connID,
+		SNI:       entry.sni,
+		StartTime: entry.startTime,
+		EndTime:   entry.endTime,
+	}
+
+	if signedURLTTL > 0 && storage.bucket != nil {
+		expires := now().Add(signedURLTTL).UTC()
+		signedURL, err := buildSignedURL(storage.bucketID, objectName, expires)
+		if err == nil {
+			notification.SignedURL = signedURL
+			notification.Expires = &expires
+		} else {
+			log.Printf("Cannot sign the URL of \"%s\": %v", objectName, err)
+		}
+	}
+
+	err := notify.post(notification)
+	if err != nil {
+		log.Printf("Failed to notify the upload of \"%s\": %v", objectName, err)
+	}
+}
+
+// a message posted to -anomaly-webhook for each connection with anomalies
+type anomalyNotification struct {
+	ConnID    int64     `json:"conn_id"`
+	SNI       string    `json:"sni,omitempty"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	// see anomalyAnalyzer
+	Anomalies []string `json:"anomalies"`
+}
+
+var anomalyNotify *notifier // -anomaly-webhook=url
+
+// notifyAnomalies posts a notification in background if the connection has anomalies
+func notifyAnomalies(entry *logEntry) {
+	if anomalyNotify == nil {
+		return
+	}
+	anomalies := anomaliesOf(entry)
+	if len(anomalies) == 0 {
+		return
+	}
+
+	notification := &anomalyNotification{
+		ConnID:    entry.connID,
+		SNI:       entry.sni,
+		StartTime: entry.startTime,
+		EndTime:   entry.endTime,
+		Anomalies: anomalies,
+	}
+	go func() {
+		err := anomalyNotify.post(notification)
+		if err != nil {
+			log.Printf("Failed to notify the anomalies of connID=%d: %v", entry.connID, err)
+		}
+	}()
+}
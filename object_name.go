@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// a template of object names, e.g. "{{.StartTime.Format \"2006/01/02\"}}/{{.Host}}-{{.DCID}}"
+// (-object-name-template), or nil for "host-dcid-time"
+var objectNameTemplate *template.Template
+
+// the fields given to -object-name-template
+type objectNameFields struct {
+	Host string
+	// the dcid of quicly:accept, or "" for quicly:connect
+	DCID   string
+	ConnID int64
+	// the time of quicly:accept or quicly:connect in milliseconds
+	AcceptTime int64
+	StartTime  time.Time
+	SNI        string
+	// "server" or "client"
+	Role string
+}
+
+// a time layout of the prefix of object names, e.g. "2006/01/02/15" for hourly partitions
+// (-prefix-layout)
+var prefixLayout string
+
+// timePrefix returns the prefix of object names for the time by -prefix-layout, or ""
+func timePrefix(t time.Time) string {
+	if prefixLayout == "" {
+		return ""
+	}
+	prefix := t.UTC().Format(prefixLayout)
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
+}
+
+func parseObjectNameTemplate(s string) (*template.Template, error) {
+	return template.New("object-name").Option("missingkey=error").Parse(s)
+}
+
+func executeObjectNameTemplate(fields objectNameFields) (string, error) {
+	var name strings.Builder
+	err := objectNameTemplate.Execute(&name, fields)
+	if err == nil && name.Len() == 0 {
+		err = fmt.Errorf("-object-name-template produced an empty name")
+	}
+	return name.String(), err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	json "github.com/goccy/go-json"
+)
+
+// actions on objects larger than -max-object-bytes (-on-oversized-object)
+const (
+	// drop events of low priority until the object fits
+	oversizedTrim = "trim"
+	// split the events into chunks of objects that fit
+	oversizedSplit = "split"
+)
+
+// values of "oversize_action" in the root object
+const (
+	oversizeActionTrimmed = "trimmed"
+	oversizeActionSplit   = "split"
+)
+
+// the size reserved for "oversize_action" and the other fields added to the root object by the actions
+const oversizeFieldsSize = 96
+
+var maxObjectBytes int                // -max-object-bytes
+var onOversizedObject = oversizedTrim // -on-oversized-object=action
+
+// eventPriority returns the priority of an event to keep in a trimmed object, the smaller the
+// more important: those to identify and to close the connection, those of control and of
+// losses, and then per-packet or per-stream ones
+func eventPriority(rawEvent h2ologEvent) int {
+	eventType, _ := rawEvent["type"].(string)
+	switch eventType {
+	case "accept", "connect", "free", "conn-stats", "__gap__":
+		return 0
+	case "send-response", "receive-request", "handshake-done-send", "new-token-send", "new-token-receive":
+		return 1
+	}
+	switch {
+	case strings.Contains(eventType, "-close-"):
+		return 0
+	case strings.Contains(eventType, "lost"), strings.HasPrefix(eventType, "crypto-"),
+		strings.HasPrefix(eventType, "cc-"), strings.Contains(eventType, "version"):
+		return 1
+	}
+	return 2
+}
+
+// eventSizes returns the sizes of the events in JSON, including separators
+func eventSizes(events []h2ologEvent) ([]int, int, error) {
+	sizes := make([]int, len(events))
+	total := 0
+	for i, rawEvent := range events {
+		data, err := json.Marshal(rawEvent)
+		if err != nil {
+			return nil, 0, err
+		}
+		sizes[i] = len(data) + 1
+		total += sizes[i]
+	}
+	return sizes, total, nil
+}
+
+// trimOversizedEntry drops events of the entry by eventPriority, the latest first among those
+// of the same priority, so that the object of objectSize bytes fits in -max-object-bytes
+func trimOversizedEntry(entry *logEntry, objectSize int) error {
+	sizes, total, err := eventSizes(entry.events)
+	if err != nil {
+		return err
+	}
+	budget := maxObjectBytes - (objectSize - total) - oversizeFieldsSize
+
+	order := make([]int, len(entry.events))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return eventPriority(entry.events[order[i]]) < eventPriority(entry.events[order[j]])
+	})
+	kept := make([]bool, len(entry.events))
+	for _, i := range order {
+		if sizes[i] <= budget {
+			kept[i] = true
+			budget -= sizes[i]
+		}
+	}
+
+	events := make([]h2ologEvent, 0, len(entry.events))
+	for i, rawEvent := range entry.events {
+		if kept[i] {
+			events = append(events, rawEvent)
+		}
+	}
+	metricObjectsTrimmed.Add(1)
+	entry.trimmedEvents = len(entry.events) - len(events)
+	entry.oversizeAction = oversizeActionTrimmed
+	entry.events = events
+	return nil
+}
+
+// splitOversizedEntry returns the chunks of the entry whose objects fit in -max-object-bytes,
+// given the size of the object of the entry. An event larger than the limit is a chunk by itself.
+func splitOversizedEntry(entry *logEntry, objectSize int) ([]*logEntry, error) {
+	sizes, total, err := eventSizes(entry.events)
+	if err != nil {
+		return nil, err
+	}
+	budget := maxObjectBytes - (objectSize - total) - oversizeFieldsSize
+
+	var chunks []*logEntry
+	start, size := 0, 0
+	for i := range entry.events {
+		if i > start && size+sizes[i] > budget {
+			chunks = append(chunks, chunkOf(entry, entry.events[start:i]))
+			start, size = i, 0
+		}
+		size += sizes[i]
+	}
+	chunks = append(chunks, chunkOf(entry, entry.events[start:]))
+	for i, chunk := range chunks {
+		chunk.chunk = i + 1
+		chunk.numChunks = len(chunks)
+	}
+	metricObjectsSplit.Add(1)
+	return chunks, nil
+}
+
+// chunkOf returns a chunk of the entry with the events. The buffer is released by the entry.
+func chunkOf(entry *logEntry, events []h2ologEvent) *logEntry {
+	chunk := *entry
+	chunk.events = events[:len(events):len(events)]
+	chunk.estimatedSize = 0
+	chunk.oversizeAction = oversizeActionSplit
+	return &chunk
+}
+
+// chunkObjectName returns the name of a chunk followed by another, so that the last chunk
+// keeps the name of the connection
+func chunkObjectName(objectName string, chunk int) string {
+	return fmt.Sprintf("%s-chunk%d", objectName, chunk)
+}
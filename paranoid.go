@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	json "github.com/goccy/go-json"
+
+	"github.com/gfx/h2olog-collector-gcs/archive"
+)
+
+var paranoid bool // -paranoid
+
+// validatePayload parses the serialized object back and checks it against the entry (-paranoid)
+func validatePayload(objectName string, payload []byte, entry *logEntry) error {
+	if payloadFormat == payloadFormatParquet {
+		return validateParquetPayload(payload)
+	}
+	if payloadFormat == payloadFormatAvro {
+		return validateAvroPayload(payload)
+	}
+	if payloadFormat == payloadFormatQlog {
+		return validateQlogPayload(payload, entry)
+	}
+	record, err := archive.ParseRecord(objectName, payload)
+	if err != nil {
+		return fmt.Errorf("cannot parse the serialized object: %v", err)
+	}
+	switch {
+	case record.SchemaVersion != archive.CurrentSchemaVersion:
+		return fmt.Errorf("schema_version is %d, not %d", record.SchemaVersion, archive.CurrentSchemaVersion)
+	case record.ID != objectName:
+		return fmt.Errorf("id is \"%s\", not \"%s\"", record.ID, objectName)
+	case record.Host != entry.host:
+		return fmt.Errorf("host is \"%s\", not \"%s\"", record.Host, entry.host)
+	case record.ConnID != entry.connID:
+		return fmt.Errorf("conn_id is %d, not %d", record.ConnID, entry.connID)
+	case record.NumEvents != entry.numEvents:
+		return fmt.Errorf("num_events is %d, not %d", record.NumEvents, entry.numEvents)
+	case !record.StartTime.Equal(entry.startTime) || !record.EndTime.Equal(entry.endTime):
+		return fmt.Errorf("start_time or end_time differs")
+	case len(record.Payload) != len(entry.events):
+		return fmt.Errorf("the payload has %d events, not %d", len(record.Payload), len(entry.events))
+	}
+	return nil
+}
+
+// validateParquetPayload checks the magic numbers and the length of the footer of a Parquet object
+func validateParquetPayload(payload []byte) error {
+	const magic = "PAR1"
+	if len(payload) < len(magic)*2+4 || string(payload[:len(magic)]) != magic || string(payload[len(payload)-len(magic):]) != magic {
+		return fmt.Errorf("no magic numbers of Parquet")
+	}
+	footerLength := binary.LittleEndian.Uint32(payload[len(payload)-len(magic)-4:])
+	if int64(footerLength) > int64(len(payload)-len(magic)*2-4) {
+		return fmt.Errorf("the footer length %d exceeds the object", footerLength)
+	}
+	return nil
+}
+
+// validateAvroPayload checks the magic number and the trailing sync marker of an Avro object
+func validateAvroPayload(payload []byte) error {
+	const magic = "Obj\x01"
+	const syncLength = 16
+	if len(payload) < len(magic)+syncLength*2 || string(payload[:len(magic)]) != magic {
+		return fmt.Errorf("no magic number of Avro")
+	}
+	if !bytes.Contains(payload[:len(payload)-syncLength], payload[len(payload)-syncLength:]) {
+		return fmt.Errorf("the sync markers differ")
+	}
+	return nil
+}
+
+// validateQlogPayload parses a qlog object back and checks the number of events
+func validateQlogPayload(payload []byte, entry *logEntry) error {
+	var file qlogFile
+	err := json.Unmarshal(payload, &file)
+	if err != nil {
+		return fmt.Errorf("cannot parse the serialized object: %v", err)
+	}
+	if len(file.Traces) != 1 {
+		return fmt.Errorf("the object has %d traces, not 1", len(file.Traces))
+	}
+	if len(file.Traces[0].Events) != len(entry.events) {
+		return fmt.Errorf("the trace has %d events, not %d", len(file.Traces[0].Events), len(entry.events))
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A minimal Parquet writer for flat schemas of INT64 and UTF-8 BYTE_ARRAY columns, which writes
+// a single uncompressed data page in PLAIN encoding per column chunk. It is enough for tables of
+// events, and saves a dependency on a Parquet library.
+
+// physical types of Parquet columns
+const (
+	parquetInt64     = 2
+	parquetByteArray = 6
+)
+
+// a column in a Parquet schema
+type parquetColumn struct {
+	name string
+	// parquetInt64 (int64 values) or parquetByteArray (string values)
+	physicalType int32
+	// true if values can be nil
+	optional bool
+}
+
+type parquetChunkMeta struct {
+	numValues      int64
+	size           int64
+	dataPageOffset int64
+}
+
+type parquetRowGroupMeta struct {
+	chunks  []parquetChunkMeta
+	numRows int64
+	size    int64
+}
+
+type parquetWriter struct {
+	writer    io.Writer
+	columns   []parquetColumn
+	offset    int64
+	rowGroups []parquetRowGroupMeta
+	numRows   int64
+	// key_value_metadata in the footer, e.g. the summary of a connection
+	keyValues [][2]string
+}
+
+func newParquetWriter(writer io.Writer, columns []parquetColumn) (*parquetWriter, error) {
+	pw := &parquetWriter{writer: writer, columns: columns}
+	return pw, pw.write([]byte("PAR1"))
+}
+
+func (pw *parquetWriter) write(data []byte) error {
+	n, err := pw.writer.Write(data)
+	pw.offset += int64(n)
+	return err
+}
+
+// writeRowGroup writes rows, each of which has a value per column, as a row group
+func (pw *parquetWriter) writeRowGroup(rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	group := parquetRowGroupMeta{numRows: int64(len(rows))}
+	for i, column := range pw.columns {
+		var values bytes.Buffer
+		definitionLevels := make([]bool, len(rows))
+		for j, row := range rows {
+			switch value := row[i].(type) {
+			case nil:
+				if !column.optional {
+					return fmt.Errorf("null in the required column %s", column.name)
+				}
+				continue
+			case int64:
+				binary.Write(&values, binary.LittleEndian, value)
+			case string:
+				binary.Write(&values, binary.LittleEndian, uint32(len(value)))
+				values.WriteString(value)
+			default:
+				return fmt.Errorf("unsupported value in the column %s: %T", column.name, value)
+			}
+			definitionLevels[j] = true
+		}
+
+		var page bytes.Buffer
+		if column.optional {
+			levels := encodeParquetLevels(definitionLevels)
+			binary.Write(&page, binary.LittleEndian, uint32(len(levels)))
+			page.Write(levels)
+		}
+		page.Write(values.Bytes())
+
+		header := &thriftCompactWriter{}
+		header.i32(1, 0) // DATA_PAGE
+		header.i32(2, int32(page.Len()))
+		header.i32(3, int32(page.Len()))
+		header.structBegin(5) // DataPageHeader
+		header.i32(1, int32(len(rows)))
+		header.i32(2, 0) // PLAIN
+		header.i32(3, 3) // RLE
+		header.i32(4, 3) // RLE
+		header.structEnd()
+		header.stop()
+
+		chunk := parquetChunkMeta{
+			numValues:      int64(len(rows)),
+			size:           int64(header.buffer.Len() + page.Len()),
+			dataPageOffset: pw.offset,
+		}
+		if err := pw.write(header.buffer.Bytes()); err != nil {
+			return err
+		}
+		if err := pw.write(page.Bytes()); err != nil {
+			return err
+		}
+		group.chunks = append(group.chunks, chunk)
+		group.size += chunk.size
+	}
+	pw.rowGroups = append(pw.rowGroups, group)
+	pw.numRows += group.numRows
+	return nil
+}
+
+// encodeParquetLevels encodes definition levels of a max level 1 in the RLE hybrid encoding
+func encodeParquetLevels(levels []bool) []byte {
+	var buffer bytes.Buffer
+	var varint [binary.MaxVarintLen64]byte
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		// an RLE run: the run length shifted by one, and the value in a byte
+		buffer.Write(varint[:binary.PutUvarint(varint[:], uint64(j-i)<<1)])
+		if levels[i] {
+			buffer.WriteByte(1)
+		} else {
+			buffer.WriteByte(0)
+		}
+		i = j
+	}
+	return buffer.Bytes()
+}
+
+// close writes the footer. It doesn't close the underlying writer.
+func (pw *parquetWriter) close() error {
+	footer := &thriftCompactWriter{}
+	footer.i32(1, 1) // version
+	footer.listBegin(2, thriftStruct, len(pw.columns)+1)
+	footer.elementBegin()
+	footer.binary(4, "schema")
+	footer.i32(5, int32(len(pw.columns)))
+	footer.elementEnd()
+	for _, column := range pw.columns {
+		footer.elementBegin()
+		footer.i32(1, column.physicalType)
+		if column.optional {
+			footer.i32(3, 1) // OPTIONAL
+		} else {
+			footer.i32(3, 0) // REQUIRED
+		}
+		footer.binary(4, column.name)
+		if column.physicalType == parquetByteArray {
+			footer.i32(6, 0) // UTF8
+		}
+		footer.elementEnd()
+	}
+	footer.i64(3, pw.numRows)
+	footer.listBegin(4, thriftStruct, len(pw.rowGroups))
+	for _, group := range pw.rowGroups {
+		footer.elementBegin()
+		footer.listBegin(1, thriftStruct, len(group.chunks))
+		for i, chunk := range group.chunks {
+			column := pw.columns[i]
+			footer.elementBegin()
+			footer.i64(2, chunk.dataPageOffset)
+			footer.structBegin(3) // ColumnMetaData
+			footer.i32(1, column.physicalType)
+			footer.listBegin(2, thriftI32, 2)
+			footer.element32(0) // PLAIN
+			footer.element32(3) // RLE
+			footer.listBegin(3, thriftBinary, 1)
+			footer.elementBinary(column.name)
+			footer.i32(4, 0) // UNCOMPRESSED
+			footer.i64(5, chunk.numValues)
+			footer.i64(6, chunk.size)
+			footer.i64(7, chunk.size)
+			footer.i64(9, chunk.dataPageOffset)
+			footer.structEnd()
+			footer.elementEnd()
+		}
+		footer.i64(2, group.size)
+		footer.i64(3, group.numRows)
+		footer.elementEnd()
+	}
+	if len(pw.keyValues) > 0 {
+		footer.listBegin(5, thriftStruct, len(pw.keyValues))
+		for _, keyValue := range pw.keyValues {
+			footer.elementBegin()
+			footer.binary(1, keyValue[0])
+			footer.binary(2, keyValue[1])
+			footer.elementEnd()
+		}
+	}
+	footer.binary(6, "h2olog-collector-gcs")
+	footer.stop()
+
+	if err := pw.write(footer.buffer.Bytes()); err != nil {
+		return err
+	}
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], uint32(footer.buffer.Len()))
+	copy(trailer[4:], "PAR1")
+	return pw.write(trailer[:])
+}
+
+// types of the Thrift compact protocol
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftCompactWriter encodes Thrift structs in the compact protocol, for Parquet metadata
+type thriftCompactWriter struct {
+	buffer bytes.Buffer
+	// the last field IDs of the nested structs
+	lastIDs []int16
+	lastID  int16
+}
+
+func (w *thriftCompactWriter) fieldHeader(id int16, fieldType byte) {
+	if delta := id - w.lastID; delta > 0 && delta <= 15 {
+		w.buffer.WriteByte(byte(delta)<<4 | fieldType)
+	} else {
+		w.buffer.WriteByte(fieldType)
+		w.varint(int64(id))
+	}
+	w.lastID = id
+}
+
+func (w *thriftCompactWriter) uvarint(v uint64) {
+	var varint [binary.MaxVarintLen64]byte
+	w.buffer.Write(varint[:binary.PutUvarint(varint[:], v)])
+}
+
+// varint writes a zigzag varint
+func (w *thriftCompactWriter) varint(v int64) {
+	w.uvarint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (w *thriftCompactWriter) i32(id int16, v int32) {
+	w.fieldHeader(id, thriftI32)
+	w.varint(int64(v))
+}
+
+func (w *thriftCompactWriter) i64(id int16, v int64) {
+	w.fieldHeader(id, thriftI64)
+	w.varint(v)
+}
+
+func (w *thriftCompactWriter) binary(id int16, s string) {
+	w.fieldHeader(id, thriftBinary)
+	w.elementBinary(s)
+}
+
+func (w *thriftCompactWriter) structBegin(id int16) {
+	w.fieldHeader(id, thriftStruct)
+	w.elementBegin()
+}
+
+func (w *thriftCompactWriter) structEnd() {
+	w.elementEnd()
+}
+
+func (w *thriftCompactWriter) listBegin(id int16, elementType byte, size int) {
+	w.fieldHeader(id, thriftList)
+	if size < 15 {
+		w.buffer.WriteByte(byte(size)<<4 | elementType)
+	} else {
+		w.buffer.WriteByte(0xf0 | elementType)
+		w.uvarint(uint64(size))
+	}
+}
+
+// elementBegin begins a struct as an element of a list
+func (w *thriftCompactWriter) elementBegin() {
+	w.lastIDs = append(w.lastIDs, w.lastID)
+	w.lastID = 0
+}
+
+func (w *thriftCompactWriter) elementEnd() {
+	w.stop()
+	w.lastID = w.lastIDs[len(w.lastIDs)-1]
+	w.lastIDs = w.lastIDs[:len(w.lastIDs)-1]
+}
+
+func (w *thriftCompactWriter) element32(v int32) {
+	w.varint(int64(v))
+}
+
+func (w *thriftCompactWriter) elementBinary(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buffer.WriteString(s)
+}
+
+func (w *thriftCompactWriter) stop() {
+	w.buffer.WriteByte(0)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	json "github.com/goccy/go-json"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// readParquet reads the columns of a Parquet file by a reference reader, and returns the
+// values by column and the key-value metadata
+func readParquet(t *testing.T, data []byte, columns []parquetColumn) ([][]interface{}, map[string]string) {
+	t.Helper()
+	file, err := buffer.NewBufferFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, err := reader.NewParquetColumnReader(file, 1)
+	if err != nil {
+		t.Fatalf("cannot open the file: %v", err)
+	}
+	defer pr.ReadStop()
+
+	// the root and the columns, whose names in the file are the external ones
+	schema := pr.SchemaHandler.Infos
+	if len(schema) != len(columns)+1 {
+		t.Fatalf("%d schema elements, want %d", len(schema), len(columns)+1)
+	}
+	values := make([][]interface{}, len(columns))
+	for i, column := range columns {
+		if schema[i+1].ExName != column.name {
+			t.Errorf("column %d is %s, want %s", i, schema[i+1].ExName, column.name)
+		}
+		values[i], _, _, err = pr.ReadColumnByIndex(int64(i), pr.GetNumRows())
+		if err != nil {
+			t.Fatalf("cannot read the column %s: %v", column.name, err)
+		}
+	}
+	keyValues := make(map[string]string)
+	for _, keyValue := range pr.Footer.KeyValueMetadata {
+		keyValues[keyValue.Key] = *keyValue.Value
+	}
+	return values, keyValues
+}
+
+func TestParquetWriter(t *testing.T) {
+	columns := []parquetColumn{
+		{name: "id", physicalType: parquetInt64},
+		{name: "name", physicalType: parquetByteArray},
+		{name: "value", physicalType: parquetInt64, optional: true},
+		{name: "note", physicalType: parquetByteArray, optional: true},
+	}
+	manyRowGroups := make([][][]interface{}, 20)
+	for i := range manyRowGroups {
+		manyRowGroups[i] = [][]interface{}{{int64(i), "row", int64(-i), nil}}
+	}
+	tests := []struct {
+		name      string
+		rowGroups [][][]interface{}
+	}{
+		{"empty", nil},
+		{"no nulls", [][][]interface{}{{
+			{int64(1), "a", int64(10), "x"},
+			{int64(2), "", int64(0), ""},
+		}}},
+		{"all nulls", [][][]interface{}{{
+			{int64(1), "a", nil, nil},
+			{int64(2), "b", nil, nil},
+		}}},
+		{"alternating nulls", [][][]interface{}{{
+			{int64(1), "a", int64(10), nil},
+			{int64(2), "b", nil, "y"},
+			{int64(3), "c", int64(30), nil},
+			{int64(-4), "日本語", nil, strings.Repeat("z", 300)},
+		}}},
+		{"row groups", [][][]interface{}{
+			{{int64(1), "a", nil, "x"}},
+			{{int64(2), "b", int64(20), nil}, {int64(3), "c", int64(30), nil}},
+		}},
+		// more than 15 row groups, which take the long form of the list header
+		{"many row groups", manyRowGroups},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var output bytes.Buffer
+			writer, err := newParquetWriter(&output, columns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writer.keyValues = [][2]string{{"key", "value"}}
+			var rows [][]interface{}
+			for _, rowGroup := range test.rowGroups {
+				if err := writer.writeRowGroup(rowGroup); err != nil {
+					t.Fatal(err)
+				}
+				rows = append(rows, rowGroup...)
+			}
+			if err := writer.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			values, keyValues := readParquet(t, output.Bytes(), columns)
+			for i, column := range columns {
+				if len(values[i]) != len(rows) {
+					t.Fatalf("%d values in %s, want %d", len(values[i]), column.name, len(rows))
+				}
+				for j, row := range rows {
+					if !reflect.DeepEqual(values[i][j], row[i]) {
+						t.Errorf("row %d of %s is %#v, want %#v", j, column.name, values[i][j], row[i])
+					}
+				}
+			}
+			if keyValues["key"] != "value" {
+				t.Errorf("metadata is %v", keyValues)
+			}
+		})
+	}
+}
+
+func TestParquetWriterRejectsNullInRequiredColumn(t *testing.T) {
+	writer, err := newParquetWriter(&bytes.Buffer{}, []parquetColumn{{name: "id", physicalType: parquetInt64}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.writeRowGroup([][]interface{}{{nil}}); err == nil {
+		t.Error("no error for null in a required column")
+	}
+}
+
+// TestParquetObjects compares objects in Parquet with those in JSON for the same input
+func TestParquetObjects(t *testing.T) {
+	jsonObjects := collectTestObjects(t, payloadFormatJSON)
+	parquetObjects := collectTestObjects(t, payloadFormatParquet)
+	if len(parquetObjects) != len(jsonObjects) {
+		t.Fatalf("%d objects in Parquet, want %d", len(parquetObjects), len(jsonObjects))
+	}
+	for name, jsonObject := range jsonObjects {
+		parquetName := strings.TrimSuffix(name, ".json") + ".parquet"
+		parquetObject, ok := parquetObjects[parquetName]
+		if !ok {
+			t.Errorf("%s is missing", parquetName)
+			continue
+		}
+		var root map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(jsonObject))
+		decoder.UseNumber()
+		if err := decoder.Decode(&root); err != nil {
+			t.Fatal(err)
+		}
+		payload := root["payload"].([]interface{})
+		delete(root, "payload")
+
+		values, keyValues := readParquet(t, parquetObject, objectParquetColumns)
+		var summary map[string]interface{}
+		decoder = json.NewDecoder(strings.NewReader(keyValues[parquetSummaryKey]))
+		decoder.UseNumber()
+		if err := decoder.Decode(&summary); err != nil {
+			t.Fatalf("%s: cannot decode the summary: %v", parquetName, err)
+		}
+		if !reflect.DeepEqual(summary, root) {
+			t.Errorf("%s: the summary is %v, want %v", parquetName, summary, root)
+		}
+
+		if len(values[0]) != len(payload) {
+			t.Fatalf("%s: %d rows, want %d", parquetName, len(values[0]), len(payload))
+		}
+		connID, _ := root["conn_id"].(json.Number).Int64()
+		for i, item := range payload {
+			event := item.(map[string]interface{})
+			if values[0][i] != connID {
+				t.Errorf("%s: conn_id of row %d is %v, want %d", parquetName, i, values[0][i], connID)
+			}
+			if want := int64OrNil(event["time"]); values[1][i] != want {
+				t.Errorf("%s: time of row %d is %v, want %v", parquetName, i, values[1][i], want)
+			}
+			if values[2][i] != event["type"] {
+				t.Errorf("%s: type of row %d is %v, want %v", parquetName, i, values[2][i], event["type"])
+			}
+			if want := int64OrNil(event["pn"]); values[3][i] != want {
+				t.Errorf("%s: pn of row %d is %v, want %v", parquetName, i, values[3][i], want)
+			}
+			var raw map[string]interface{}
+			decoder := json.NewDecoder(strings.NewReader(values[4][i].(string)))
+			decoder.UseNumber()
+			if err := decoder.Decode(&raw); err != nil {
+				t.Fatalf("%s: cannot decode raw of row %d: %v", parquetName, i, err)
+			}
+			if !reflect.DeepEqual(raw, event) {
+				t.Errorf("%s: raw of row %d is %v, want %v", parquetName, i, raw, event)
+			}
+		}
+	}
+}
+
+// int64OrNil returns the integer of a JSON number, or nil for the others
+func int64OrNil(value interface{}) interface{} {
+	if number, ok := value.(json.Number); ok {
+		if v, err := number.Int64(); err == nil {
+			return v
+		}
+	}
+	return nil
+}
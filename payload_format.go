@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+
+	json "github.com/goccy/go-json"
+)
+
+// layouts of the payload in objects (-payload-format)
+const (
+	// "payload" is an array of events in the root object
+	payloadFormatJSON = "json"
+	// the root object without "payload" is a header line, followed by an event per line, so that
+	// consumers can stream-parse objects
+	payloadFormatNDJSON = "ndjson"
+	// a Parquet file of a row per event, with the root object without "payload" in the metadata
+	payloadFormatParquet = "parquet"
+	// an Avro object container file of a record per connection, whose schema is generated from
+	// the root object
+	payloadFormatAvro = "avro"
+	// a qlog file of a trace per connection, which qvis can load (see qlog.go)
+	payloadFormatQlog = "qlog"
+)
+
+// the key of the root object in the metadata of Parquet objects
+const parquetSummaryKey = "h2olog.summary"
+
+// the columns of Parquet objects, a row per event
+var objectParquetColumns = []parquetColumn{
+	{name: "conn_id", physicalType: parquetInt64},
+	{name: "time", physicalType: parquetInt64, optional: true},
+	{name: "type", physicalType: parquetByteArray},
+	{name: "pn", physicalType: parquetInt64, optional: true},
+	// the event in JSON
+	{name: "raw", physicalType: parquetByteArray},
+}
+
+var payloadFormat = payloadFormatJSON // -payload-format=name
+
+// payloadFormatField returns the value of "payload_format" in objects, which is omitted for JSON
+func payloadFormatField(format string) string {
+	if format == payloadFormatNDJSON {
+		return payloadFormatNDJSON
+	}
+	return ""
+}
+
+// isRecordPayloadFormat reports whether objects in the format are in the schema of the archive
+// package, while the other formats follow their own schemas
+func isRecordPayloadFormat(format string) bool {
+	return format == payloadFormatJSON || format == payloadFormatNDJSON
+}
+
+// writePayload writes the events in the format after the root object without its closing brace
+func writePayload(buffer *bytes.Buffer, events []h2ologEvent, format string) error {
+	if format == payloadFormatNDJSON {
+		buffer.WriteString("}\n")
+		for _, event := range events {
+			line, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			buffer.Write(line)
+			buffer.WriteByte('\n')
+		}
+		return nil
+	}
+
+	payload, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	buffer.WriteString(`,"payload":`)
+	buffer.Write(payload)
+	buffer.WriteByte('}')
+	return nil
+}
+
+// encodeParquetObject writes the events of the connection as a Parquet file with the summary,
+// the root object without "payload", in the metadata
+func encodeParquetObject(summary []byte, connID int64, events []h2ologEvent) ([]byte, error) {
+	rows := make([][]interface{}, 0, len(events))
+	for _, rawEvent := range events {
+		raw, err := json.Marshal(rawEvent)
+		if err != nil {
+			return nil, err
+		}
+		eventType, _ := rawEvent["type"].(string)
+		row := []interface{}{connID, nil, eventType, nil, string(raw)}
+		if time, ok := eventInt64(rawEvent, "time"); ok {
+			row[1] = time
+		}
+		if pn, ok := eventInt64(rawEvent, "pn"); ok {
+			row[3] = pn
+		}
+		rows = append(rows, row)
+	}
+
+	buffer := &bytes.Buffer{}
+	writer, err := newParquetWriter(buffer, objectParquetColumns)
+	if err != nil {
+		return nil, err
+	}
+	writer.keyValues = [][2]string{{parquetSummaryKey, string(summary)}}
+	err = writer.writeRowGroup(rows)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.close()
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// payloadArray returns the payload of an object serialized by serializeEvents as a JSON array,
+// given the object in NDJSON with -payload-format=ndjson, or in JSON otherwise
+func payloadArray(object []byte, summaryLength int) []byte {
+	if payloadFormat == payloadFormatNDJSON {
+		lines := bytes.TrimSuffix(object[summaryLength+len("}\n"):], []byte("\n"))
+		if len(lines) == 0 {
+			return []byte("[]")
+		}
+		array := make([]byte, 0, len(lines)+2)
+		array = append(array, '[')
+		array = append(array, bytes.ReplaceAll(lines, []byte("\n"), []byte(","))...)
+		return append(array, ']')
+	}
+	return object[summaryLength+len(`,"payload":`) : len(object)-1]
+}
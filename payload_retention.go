@@ -0,0 +1,55 @@
+package main
+
+// policies of keeping payloads (-payload-retention)
+const (
+	// keep the payloads of all the connections
+	retainAll = "all"
+	// keep the payloads of connections with 5xx responses or reset streams only
+	retainErrors = "errors"
+)
+
+var payloadRetention = retainAll // -payload-retention=policy
+
+// live connections by h2o's connection ID, to which h2o-layer events without "conn" refer.
+// It is guarded by connsMutex.
+var h2oConns = make(map[connKey]*logEntry)
+
+// observeH2OEvent looks into an h2o-layer event, which has "conn-id" instead of "conn".
+// The caller must hold connsMutex.
+func observeH2OEvent(source *inputSource, rawEvent h2ologEvent) {
+	h2oConnID, ok := eventInt64(rawEvent, "conn-id")
+	if !ok {
+		return
+	}
+	entry := h2oConns[connKey{source, h2oConnID}]
+	if entry == nil {
+		return
+	}
+	switch rawEvent["type"] {
+	case "send-response": // h2o:send_response
+		if status, ok := eventInt64(rawEvent, "status"); ok && status >= 500 {
+			entry.hasErrors = true
+		}
+	case "receive-request-header": // h2o:receive_request_header
+		correlateRequest(entry, rawEvent)
+	}
+}
+
+// applyPayloadRetention drops the payload of the entry except for the events to build the
+// object name, unless the policy keeps it
+func applyPayloadRetention(entry *logEntry) {
+	if payloadRetention != retainErrors || entry.hasErrors {
+		return
+	}
+	events := make([]h2ologEvent, 0, 2)
+	entry.fieldDictionary = nil
+	for _, rawEvent := range entry.events {
+		eventType := rawEvent["type"]
+		if eventType == "accept" || eventType == "connect" || eventType == "free" {
+			events = append(events, rawEvent)
+			entry.observeFields(rawEvent)
+		}
+	}
+	entry.events = events
+	entry.payloadOmitted = true
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPayloadRetentionOfSplitParts(t *testing.T) {
+	defer func(retention string, window time.Duration, order *uploadOrderBuffer) {
+		payloadRetention = retention
+		splitWindow = window
+		uploadOrder = order
+	}(payloadRetention, splitWindow, uploadOrder)
+	payloadRetention = retainErrors
+	splitWindow = time.Second
+
+	tests := []struct {
+		name       string
+		hasErrors  bool
+		wantEvents []string
+	}{
+		{name: "without errors", wantEvents: []string{"accept"}},
+		{name: "with errors", hasErrors: true, wantEvents: []string{"accept", "packet-sent"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var parts []*logEntry
+			uploadOrder = newUploadOrderBuffer(10, time.Hour, func(entry *logEntry) {
+				parts = append(parts, entry)
+			})
+			accept := h2ologEvent{"type": "accept", "conn": int64(1), "time": int64(0)}
+			entry := &logEntry{
+				connID:    1,
+				nameEvent: accept,
+				events:    []h2ologEvent{accept, {"type": "packet-sent", "conn": int64(1), "time": int64(2000)}},
+				startTime: time.Unix(0, 0),
+				endTime:   time.Unix(2, 0),
+				hasErrors: test.hasErrors,
+			}
+			maybeSplitEntry(context.Background(), nil, nil, entry)
+			uploadOrder.flush()
+
+			if len(parts) != 1 {
+				t.Fatalf("%d parts are uploaded, want 1", len(parts))
+			}
+			var events []string
+			for _, rawEvent := range parts[0].events {
+				events = append(events, rawEvent["type"].(string))
+			}
+			if len(events) != len(test.wantEvents) {
+				t.Fatalf("the part has %v, want %v", events, test.wantEvents)
+			}
+			for i := range events {
+				if events[i] != test.wantEvents[i] {
+					t.Errorf("the part has %v, want %v", events, test.wantEvents)
+				}
+			}
+			if parts[0].payloadOmitted == test.hasErrors {
+				t.Errorf("payloadOmitted = %v", parts[0].payloadOmitted)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// writePidFile locks the file exclusively and writes the process ID to it, so that another
+// instance with the same -pidfile fails to start. The lock is held until release is called
+// or the process exits, or is handed off with the file to a new process by soft restart.
+func writePidFile(filePath string) (release func(), err error) {
+	file := softRestart.takeInheritedPidFile(filePath)
+	if file == nil {
+		file, err = os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		err = lockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("another instance is running with %s: %v", filePath, err)
+		}
+	}
+
+	err = file.Truncate(0)
+	if err == nil {
+		// at the beginning, as the offset of a file handed off is shared with the old process
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	softRestart.registerPidFile(filePath, file)
+	return func() {
+		if !softRestart.succeeded() {
+			os.Remove(filePath)
+		}
+		file.Close()
+	}, nil
+}
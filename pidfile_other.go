@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// lockFile does nothing, as flock(2) is not available
+func lockFile(file *os.File) error {
+	return nil
+}
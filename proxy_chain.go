@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+)
+
+// Proxy-chain correlation (-correlation-header) links the connections that carry the same
+// request ID in the header, e.g. a downstream connection to h2o as a reverse proxy and the
+// upstream connection to the origin, whose h2olog runs with -a to emit header names and values.
+// The connection that received the request ID first is downstream of those that received it
+// later, and their summaries refer to each other by "downstream_objects" and "upstream_objects".
+
+var correlationHeader string // -correlation-header=name
+
+// the max number of request IDs to remember, and the max number of connections per request ID
+const (
+	maxCorrelatedRequests        = 65536
+	maxConnsPerCorrelatedRequest = 16
+)
+
+// a connection that carried a request ID, referred to by its key rather than the entry, so
+// that uploaded entries are not retained
+type correlatedConn struct {
+	key connKey
+	// the name of the object of the connection, without suffixes of parts, snapshots, nor chunks
+	objectName string
+	// the time of the request header in milliseconds
+	time int64
+}
+
+// the connections by request ID, guarded by connsMutex
+var correlatedRequests = mustLruMap(maxCorrelatedRequests, nil)
+
+// correlationObjectName returns the name of the object of the connection to refer to it from
+// others, or "" if the connection is not named yet
+func correlationObjectName(entry *logEntry) string {
+	objectName, err := buildObjectName(entry)
+	if err != nil {
+		return ""
+	}
+	return selectRetentionPrefix(entry.sni) + timePrefix(entry.startTime) + objectName
+}
+
+// correlateRequest links the connection of the h2o:receive_request_header event to those that
+// carried the same request ID. The caller must hold connsMutex.
+func correlateRequest(entry *logEntry, rawEvent h2ologEvent) {
+	if correlationHeader == "" || entry.processed {
+		return
+	}
+	name, _ := rawEvent["name"].(string)
+	requestID, _ := rawEvent["value"].(string)
+	if requestID == "" || !strings.EqualFold(name, correlationHeader) {
+		return
+	}
+	objectName := correlationObjectName(entry)
+	if objectName == "" {
+		return
+	}
+	timeMillis, _ := eventInt64(rawEvent, "time")
+
+	var conns []correlatedConn
+	if value, ok := correlatedRequests.Get(requestID); ok {
+		conns = value.([]correlatedConn)
+	}
+	key := connKey{entry.source, entry.connID}
+	for _, conn := range conns {
+		if conn.key == key && conn.objectName == objectName {
+			// another request of the same connection with the same request ID
+			return
+		}
+	}
+	if len(conns) >= maxConnsPerCorrelatedRequest {
+		return
+	}
+	for _, conn := range conns {
+		// the peer may have been uploaded, in which case only this connection refers to it
+		var peer *logEntry
+		if value, ok := connToLogs.Peek(conn.key); ok {
+			peer = value.(*logEntry)
+			if peer.processed || correlationObjectName(peer) != conn.objectName {
+				peer = nil
+			}
+		}
+		if conn.time <= timeMillis {
+			entry.downstreamObjects = appendUnique(entry.downstreamObjects, conn.objectName)
+			if peer != nil {
+				peer.upstreamObjects = appendUnique(peer.upstreamObjects, objectName)
+			}
+		} else {
+			entry.upstreamObjects = appendUnique(entry.upstreamObjects, conn.objectName)
+			if peer != nil {
+				peer.downstreamObjects = appendUnique(peer.downstreamObjects, objectName)
+			}
+		}
+	}
+	if len(conns) == 1 {
+		metricCorrelatedRequests.Add(1)
+	}
+	correlatedRequests.Add(requestID, append(conns, correlatedConn{key: key, objectName: objectName, time: timeMillis}))
+}
+
+// appendUnique appends s to the slice unless it is in the slice
+func appendUnique(slice []string, s string) []string {
+	for _, item := range slice {
+		if item == s {
+			return slice
+		}
+	}
+	return append(slice, s)
+}
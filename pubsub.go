@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	json "github.com/goccy/go-json"
+	"golang.org/x/oauth2"
+
+	"github.com/gfx/h2olog-collector-gcs/archive"
+)
+
+const pubSubScope = "https://www.googleapis.com/auth/pubsub"
+
+// the limit of the size of a publish request
+const pubSubMaxRequestBytes = 10 * 1000 * 1000
+
+// a Pub/Sub topic to which it publishes the payload of each uploaded object (-pubsub-topic),
+// by the REST API with the same credentials as GCS
+type pubSubTopic struct {
+	client *http.Client
+	// "projects/$project/topics/$topic"
+	name string
+	// nil unless -bus-batch-conns is given
+	batch *busBatcher
+}
+
+var pubSub *pubSubTopic
+
+// newPubSubTopic takes "projects/$project/topics/$topic", or a topic name in the project of the
+// credentials
+func newPubSubTopic(ctx context.Context, spec string) (*pubSubTopic, error) {
+	credentials, err := findCredentials(ctx, pubSubScope)
+	if err != nil {
+		return nil, err
+	}
+	name := spec
+	if !strings.HasPrefix(spec, "projects/") {
+		if strings.Contains(spec, "/") {
+			return nil, fmt.Errorf("not projects/$project/topics/$topic: %s", spec)
+		}
+		if credentials.ProjectID == "" {
+			return nil, fmt.Errorf("no project is found in the credentials for %s", spec)
+		}
+		name = fmt.Sprintf("projects/%s/topics/%s", credentials.ProjectID, spec)
+	} else if names := strings.Split(spec, "/"); len(names) != 4 || names[2] != "topics" || names[1] == "" || names[3] == "" {
+		return nil, fmt.Errorf("not projects/$project/topics/$topic: %s", spec)
+	}
+	topic := &pubSubTopic{
+		client: oauth2.NewClient(ctx, credentials.TokenSource),
+		name:   name,
+	}
+	// the data of a message is in base64 in the request
+	topic.batch = newBusBatcher(ctx, pubSubMaxRequestBytes/4*3-1024, topic.publishBatch)
+	return topic, nil
+}
+
+type pubSubPublishRequest struct {
+	Messages []pubSubMessage `json:"messages"`
+}
+
+type pubSubMessage struct {
+	// encoded in base64 by encoding/json
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// publish sends the payload as it is stored, with the object name, its content encoding, and
+// the dcid as attributes, logging errors, as the object is already stored. With -bus-batch-conns,
+// it adds the payload to the batch instead.
+func (topic *pubSubTopic) publish(ctx context.Context, objectName string, entry *logEntry, payload []byte, contentEncoding string) {
+	if topic.batch != nil && topic.batch.add(objectName, entry, payload, contentEncoding) {
+		return
+	}
+	err := topic.send(ctx, pubSubMessage{
+		Data: payload,
+		Attributes: map[string]string{
+			"object":           objectName,
+			"content-encoding": contentEncoding,
+			"key":              messageKey(objectName, entry),
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to publish \"%s\" to Pub/Sub: %v", objectName, err)
+		metricPubSubErrors.Add(1)
+		return
+	}
+	metricPubSubMessages.Add(1)
+	if debug {
+		log.Printf("[D] Published \"%s\" to Pub/Sub (bytes=%v)", objectName, len(payload))
+	}
+}
+
+// publishBatch sends the connections as a message of busBatchEnvelope marked by "batch": "1"
+func (topic *pubSubTopic) publishBatch(ctx context.Context, records []busBatchRecord) {
+	data, err := encodeBusBatch(records)
+	if err == nil {
+		err = topic.send(ctx, pubSubMessage{
+			Data:       data,
+			Attributes: map[string]string{"batch": "1"},
+		})
+	}
+	if err != nil {
+		log.Printf("Failed to publish a batch of %d objects to Pub/Sub: %v", len(records), err)
+		metricPubSubErrors.Add(1)
+		return
+	}
+	metricPubSubMessages.Add(1)
+	metricBusBatchedRecords.Add("pubsub", int64(len(records)))
+	if debug {
+		log.Printf("[D] Published a batch of %d objects to Pub/Sub (bytes=%v)", len(records), len(data))
+	}
+}
+
+func (topic *pubSubTopic) send(ctx context.Context, message pubSubMessage) error {
+	body, err := json.Marshal(pubSubPublishRequest{Messages: []pubSubMessage{message}})
+	if err != nil {
+		return err
+	}
+	if len(body) > pubSubMaxRequestBytes {
+		return archive.NewError(archive.ErrOversized, fmt.Errorf("the request has %d bytes (> %d)", len(body), pubSubMaxRequestBytes))
+	}
+	url := fmt.Sprintf("https://pubsub.googleapis.com/v1/%s:publish", topic.name)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := topic.client.Do(request)
+	if err != nil {
+		return archive.Classify(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return archive.NewError(archive.KindOfStatus(response.StatusCode),
+			fmt.Errorf("publish returned %s: %s", response.Status, strings.TrimSpace(string(data))))
+	}
+	return nil
+}
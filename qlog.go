@@ -0,0 +1,149 @@
+package main
+
+import (
+	"strings"
+
+	json "github.com/goccy/go-json"
+)
+
+// Objects in qlog (-payload-format=qlog) map quicly events into the IETF qlog schema in JSON
+// (draft-ietf-quic-qlog-main-schema, qlog_version 0.3), so that qvis can load them directly.
+// Events without counterparts in qlog are named "h2olog:$type" with their fields as data.
+
+const qlogVersion = "0.3"
+
+type qlogFile struct {
+	QlogVersion string      `json:"qlog_version"`
+	QlogFormat  string      `json:"qlog_format"`
+	Title       string      `json:"title"`
+	Traces      []qlogTrace `json:"traces"`
+}
+
+type qlogTrace struct {
+	Title        string           `json:"title"`
+	VantagePoint qlogVantagePoint `json:"vantage_point"`
+	CommonFields qlogCommonFields `json:"common_fields"`
+	// the root object without "payload"
+	Summary json.RawMessage `json:"h2olog"`
+	Events  []qlogEvent     `json:"events"`
+}
+
+type qlogVantagePoint struct {
+	// "server", "client", or "unknown"
+	Type string `json:"type"`
+}
+
+type qlogCommonFields struct {
+	ODCID      interface{} `json:"ODCID,omitempty"`
+	TimeFormat string      `json:"time_format"`
+	// the start time of the connection in milliseconds, to which the times of events are relative
+	ReferenceTime int64 `json:"reference_time"`
+}
+
+type qlogEvent struct {
+	Time int64                  `json:"time"`
+	Name string                 `json:"name"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// qlogPacketTypes maps epochs in "packet-type" of quicly to packet types of qlog
+var qlogPacketTypes = []string{"initial", "0RTT", "handshake", "1RTT"}
+
+// the fields of h2olog events which are not the data of qlog events
+var qlogOmittedFields = map[string]bool{"type": true, "seq": true, "conn": true, "time": true, "conn_seq": true}
+
+// encodeQlogObject writes the events of the entry as a qlog file of a trace with the summary,
+// the root object without "payload"
+func encodeQlogObject(ID string, summary []byte, entry *logEntry, events []h2ologEvent) ([]byte, error) {
+	referenceTime := entry.startTime.UnixNano() / 1000000
+	trace := qlogTrace{
+		Title:        ID,
+		VantagePoint: qlogVantagePoint{Type: entry.role},
+		CommonFields: qlogCommonFields{TimeFormat: "relative", ReferenceTime: referenceTime},
+		Summary:      summary,
+		Events:       make([]qlogEvent, 0, len(events)),
+	}
+	if trace.VantagePoint.Type == "" {
+		trace.VantagePoint.Type = "unknown"
+	}
+	if entry.nameEvent != nil {
+		trace.CommonFields.ODCID = entry.nameEvent["dcid"]
+	}
+
+	eventTime := referenceTime
+	for _, rawEvent := range events {
+		// events without "time", e.g. those of h2o, take the time of the previous one
+		if t, ok := eventInt64(rawEvent, "time"); ok {
+			eventTime = t
+		}
+		name, data := qlogEventOf(rawEvent)
+		trace.Events = append(trace.Events, qlogEvent{Time: eventTime - referenceTime, Name: name, Data: data})
+	}
+	return json.Marshal(qlogFile{
+		QlogVersion: qlogVersion,
+		QlogFormat:  "JSON",
+		Title:       ID,
+		Traces:      []qlogTrace{trace},
+	})
+}
+
+// qlogEventOf returns the name and the data of the qlog event of an h2olog event
+func qlogEventOf(rawEvent h2ologEvent) (string, map[string]interface{}) {
+	eventType, _ := rawEvent["type"].(string)
+	switch eventType {
+	case "accept", "connect":
+		return "connectivity:connection_started", map[string]interface{}{"dst_cid": rawEvent["dcid"]}
+	case "free":
+		return "connectivity:connection_state_updated", map[string]interface{}{"new": "closed"}
+	case "transport-close-send", "transport-close-receive", "application-close-send", "application-close-receive":
+		data := map[string]interface{}{"owner": "local", "reason": rawEvent["reason-phrase"]}
+		if strings.HasSuffix(eventType, "-receive") {
+			data["owner"] = "remote"
+		}
+		if strings.HasPrefix(eventType, "transport-") {
+			data["connection_code"] = rawEvent["error-code"]
+		} else {
+			data["application_code"] = rawEvent["error-code"]
+		}
+		return "connectivity:connection_closed", data
+	case "packet-sent":
+		return "transport:packet_sent", map[string]interface{}{
+			"header": qlogPacketHeader(rawEvent),
+			"raw":    map[string]interface{}{"length": rawEvent["len"]},
+		}
+	case "packet-received":
+		return "transport:packet_received", map[string]interface{}{
+			"header": qlogPacketHeader(rawEvent),
+			"raw":    map[string]interface{}{"length": rawEvent["decrypted-len"]},
+		}
+	case "packet-acked":
+		return "transport:packets_acked", map[string]interface{}{"packet_numbers": []interface{}{rawEvent["pn"]}}
+	case "packet-lost":
+		return "recovery:packet_lost", map[string]interface{}{"header": qlogPacketHeader(rawEvent)}
+	case "cc-ack-received":
+		return "recovery:metrics_updated", map[string]interface{}{
+			"congestion_window": rawEvent["cwnd"],
+			"bytes_in_flight":   rawEvent["inflight"],
+		}
+	case "crypto-update-secret":
+		label, _ := rawEvent["label"].(string)
+		return "security:key_updated", map[string]interface{}{"key_type": strings.ToLower(label), "trigger": "tls"}
+	}
+
+	data := make(map[string]interface{}, len(rawEvent))
+	for key, value := range rawEvent {
+		if !qlogOmittedFields[key] {
+			data[key] = value
+		}
+	}
+	return "h2olog:" + strings.ReplaceAll(eventType, "-", "_"), data
+}
+
+// qlogPacketHeader returns the header of a packet event with the packet number and the type
+func qlogPacketHeader(rawEvent h2ologEvent) map[string]interface{} {
+	header := map[string]interface{}{"packet_number": rawEvent["pn"]}
+	if epoch, ok := eventInt64(rawEvent, "packet-type"); ok && epoch >= 0 && epoch < int64(len(qlogPacketTypes)) {
+		header["packet_type"] = qlogPacketTypes[epoch]
+	}
+	return header
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	json "github.com/goccy/go-json"
+)
+
+var updateGolden = flag.Bool("update", false, "Update the golden files in test/ with the outputs")
+
+// TestQlogObjects compares objects in qlog from test/test.jsonl with the golden files in
+// test/qlog. Run `go test -run TestQlogObjects -update` to update them after intended changes.
+func TestQlogObjects(t *testing.T) {
+	objects := collectTestObjects(t, payloadFormatQlog)
+	goldenDir := filepath.Join("test", "qlog")
+	if *updateGolden {
+		os.RemoveAll(goldenDir)
+	}
+	for name, data := range objects {
+		goldenPath := filepath.Join(goldenDir, filepath.FromSlash(name))
+		if *updateGolden {
+			os.MkdirAll(filepath.Dir(goldenPath), os.ModePerm)
+			if err := os.WriteFile(goldenPath, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(goldenPath)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("%s differs from %s:\n%s", name, goldenPath, data)
+		}
+
+		var file qlogFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if file.QlogVersion != qlogVersion || len(file.Traces) != 1 || len(file.Traces[0].Events) == 0 {
+			t.Errorf("%s: not a qlog file of a trace with events", name)
+		}
+	}
+
+	goldenFiles, _ := filepath.Glob(filepath.Join(goldenDir, "*"))
+	if len(goldenFiles) != len(objects) {
+		t.Errorf("%d golden files for %d objects", len(goldenFiles), len(objects))
+	}
+}
+
+func TestQlogEventOf(t *testing.T) {
+	tests := []struct {
+		event    string
+		wantName string
+		wantData string
+	}{
+		{
+			`{"type":"accept","conn":1,"time":1,"dcid":"bc6ace5c680ed855"}`,
+			"connectivity:connection_started",
+			`{"dst_cid":"bc6ace5c680ed855"}`,
+		},
+		{
+			`{"type":"free","conn":1,"time":1}`,
+			"connectivity:connection_state_updated",
+			`{"new":"closed"}`,
+		},
+		{
+			`{"type":"transport-close-receive","conn":1,"time":1,"error-code":10,"reason-phrase":"bye"}`,
+			"connectivity:connection_closed",
+			`{"connection_code":10,"owner":"remote","reason":"bye"}`,
+		},
+		{
+			`{"type":"application-close-send","conn":1,"time":1,"error-code":0,"reason-phrase":""}`,
+			"connectivity:connection_closed",
+			`{"application_code":0,"owner":"local","reason":""}`,
+		},
+		{
+			`{"type":"packet-sent","conn":1,"time":1,"pn":7,"len":1280,"packet-type":3}`,
+			"transport:packet_sent",
+			`{"header":{"packet_number":7,"packet_type":"1RTT"},"raw":{"length":1280}}`,
+		},
+		{
+			`{"type":"packet-received","conn":1,"time":1,"pn":0,"decrypted-len":1200,"packet-type":0}`,
+			"transport:packet_received",
+			`{"header":{"packet_number":0,"packet_type":"initial"},"raw":{"length":1200}}`,
+		},
+		{
+			`{"type":"packet-lost","conn":1,"time":1,"pn":3,"packet-type":9}`,
+			"recovery:packet_lost",
+			`{"header":{"packet_number":3}}`,
+		},
+		{
+			`{"type":"packet-acked","conn":1,"time":1,"pn":3}`,
+			"transport:packets_acked",
+			`{"packet_numbers":[3]}`,
+		},
+		{
+			`{"type":"cc-ack-received","conn":1,"time":1,"cwnd":14720,"inflight":1280}`,
+			"recovery:metrics_updated",
+			`{"bytes_in_flight":1280,"congestion_window":14720}`,
+		},
+		{
+			`{"type":"crypto-update-secret","conn":1,"time":1,"label":"CLIENT_HANDSHAKE_TRAFFIC_SECRET"}`,
+			"security:key_updated",
+			`{"key_type":"client_handshake_traffic_secret","trigger":"tls"}`,
+		},
+		{
+			`{"type":"stream-on-open","seq":5,"conn":1,"time":1,"conn_seq":4,"stream-id":0}`,
+			"h2olog:stream_on_open",
+			`{"stream-id":0}`,
+		},
+	}
+	for _, test := range tests {
+		rawEvent, err := decodeEvent(test.event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, data := qlogEventOf(rawEvent)
+		if name != test.wantName {
+			t.Errorf("%s: the name is %s, want %s", test.event, name, test.wantName)
+		}
+		wantData, err := decodeEvent(test.wantData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotData, _ := json.Marshal(data)
+		decodedData, _ := decodeEvent(string(gotData))
+		if !reflect.DeepEqual(decodedData, wantData) {
+			t.Errorf("%s: the data is %s, want %s", test.event, gotData, test.wantData)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"time"
+)
+
+// a message posted to -rate-alert-webhook
+type rateAlert struct {
+	// the rates of new connections and quicly:free per second in the window
+	NewConnsPerSec   float64   `json:"new_conns_per_sec"`
+	FreedConnsPerSec float64   `json:"freed_conns_per_sec"`
+	WindowStart      time.Time `json:"window_start"`
+	WindowEnd        time.Time `json:"window_end"`
+}
+
+// rateMonitor computes the rates of new and freed connections per window. A large divergence
+// between them indicates leaks or capture issues, which is alerted to the webhook if any.
+type rateMonitor struct {
+	window time.Duration
+	// the ratio of the larger rate to the smaller one to alert
+	threshold float64
+	alert     *notifier
+}
+
+func (monitor *rateMonitor) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(monitor.window)
+		defer ticker.Stop()
+		windowStart := time.Now()
+		lastNew := metricConnsCreated.Value()
+		lastFreed := metricConnsFreed.Value()
+		for {
+			var windowEnd time.Time
+			select {
+			case windowEnd = <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			numNew := metricConnsCreated.Value() - lastNew
+			numFreed := metricConnsFreed.Value() - lastFreed
+			lastNew += numNew
+			lastFreed += numFreed
+
+			seconds := windowEnd.Sub(windowStart).Seconds()
+			alert := &rateAlert{
+				NewConnsPerSec:   float64(numNew) / seconds,
+				FreedConnsPerSec: float64(numFreed) / seconds,
+				WindowStart:      windowStart,
+				WindowEnd:        windowEnd,
+			}
+			windowStart = windowEnd
+			metricNewConnsPerSec.Set(alert.NewConnsPerSec)
+			metricFreedConnsPerSec.Set(alert.FreedConnsPerSec)
+
+			if monitor.alert != nil && monitor.diverges(numNew, numFreed) {
+				log.Printf("The rates of new and freed connections diverge: new=%.1f/s, freed=%.1f/s",
+					alert.NewConnsPerSec, alert.FreedConnsPerSec)
+				err := monitor.alert.post(alert)
+				if err != nil {
+					log.Printf("Failed to post the rate alert: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// diverges reports whether the larger count exceeds the smaller one by the threshold ratio;
+// +1 avoids division by zero and alerts on small numbers
+func (monitor *rateMonitor) diverges(numNew int64, numFreed int64) bool {
+	larger := math.Max(float64(numNew), float64(numFreed))
+	smaller := math.Min(float64(numNew), float64(numFreed))
+	return larger/(smaller+1) > monitor.threshold
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the interval to report progress and save the offset of -replay
+var progressInterval = 10 * time.Second // -progress-interval=duration
+
+// saves the offset of -replay once the uploads are drained at the end, set up by replayFile
+var saveReplayOffset func()
+
+// replayFile reads a capture file by mmap(2). If offsetFile is given, it resumes from the
+// offset saved in it, and saves the offset up to which connections are uploaded periodically. If speed is positive, events are
+// paced by their timestamps at that speed.
+func replayFile(ctx context.Context, storage *storageManager, filePath string, offsetFile string, speed float64, latch *sync.WaitGroup) {
+	data, unmap, err := mmapFile(filePath)
+	if err != nil {
+		log.Fatalf("Cannot open %s: %v", filePath, err)
+	}
+	defer unmap()
+
+	var start int64
+	if offsetFile != "" {
+		start, err = loadOffset(offsetFile)
+		if err != nil {
+			log.Fatalf("Cannot load the offset from %s: %v", offsetFile, err)
+		}
+		if start > int64(len(data)) {
+			log.Fatalf("The offset %d in %s exceeds the size of %s", start, offsetFile, filePath)
+		}
+		if start > 0 {
+			log.Printf("Resuming %s from offset %d", filePath, start)
+		}
+	}
+
+	source := newInputSource(filePath, bytes.NewReader(data[start:]))
+	source.offset = start
+	// events are not received in real time
+	source.lagLabel = ""
+	// the saved offset is that of the first event of the oldest connection not uploaded yet,
+	// so that connections live or uploading at a crash are read again from their first events
+	source.acker = newInputAcker(nil)
+	if speed > 0 {
+		source.pacer = &replayPacer{speed: speed}
+	}
+
+	metricReplayBytesTotal.Set(int64(len(data)))
+	progress := &replayProgress{
+		filePath:  filePath,
+		total:     int64(len(data)),
+		start:     start,
+		startTime: time.Now(),
+	}
+
+	done := make(chan struct{})
+	stopped := &sync.WaitGroup{}
+	stopped.Add(1)
+	go func() {
+		defer stopped.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				progress.report(source.processedOffset())
+				saveOffset(offsetFile, source.acker.storedOffset(source.processedOffset()))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	saveReplayOffset = func() {
+		saveOffset(offsetFile, source.acker.storedOffset(source.processedOffset()))
+	}
+	readJSONLine(ctx, storage, source, latch)
+	close(done)
+	stopped.Wait()
+	progress.report(source.processedOffset())
+	// connections still uploading are saved by saveReplayOffset after they are drained
+	saveReplayOffset()
+}
+
+type replayProgress struct {
+	filePath string
+	// the size of the file
+	total int64
+	// the offset where it started, which is not counted for the rate
+	start     int64
+	startTime time.Time
+}
+
+// report logs the progress with ETA to STDERR and updates metrics
+func (progress *replayProgress) report(offset int64) {
+	metricReplayBytesProcessed.Set(offset)
+
+	elapsed := time.Since(progress.startTime)
+	eta := "unknown"
+	if processed := offset - progress.start; processed > 0 {
+		remaining := time.Duration(float64(elapsed) * float64(progress.total-offset) / float64(processed))
+		eta = remaining.Round(time.Second).String()
+	}
+	percentage := 100.0
+	if progress.total > 0 {
+		percentage = float64(offset) * 100 / float64(progress.total)
+	}
+	log.Printf("Replaying %s: %d / %d bytes (%.1f%%), ETA %s, %d connections flushed",
+		progress.filePath, offset, progress.total, percentage, eta, metricConnsFlushed.Value())
+}
+
+// parseReplaySpeed parses -replay-speed. It returns 0 for "unlimited".
+func parseReplaySpeed(value string) (float64, error) {
+	switch value {
+	case "unlimited", "":
+		return 0, nil
+	case "realtime":
+		return 1, nil
+	}
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+	if err != nil || !strings.HasSuffix(value, "x") || speed <= 0 {
+		return 0, fmt.Errorf("invalid replay speed: %q", value)
+	}
+	return speed, nil
+}
+
+// replayPacer delays events so that the intervals of their timestamps are reproduced
+type replayPacer struct {
+	// 1 for realtime, 2 for twice as fast, and so on
+	speed float64
+	// the timestamp of the first event in milliseconds and the wall clock time when it was read
+	baseMillis int64
+	baseTime   time.Time
+}
+
+func (pacer *replayPacer) wait(ctx context.Context, rawEvent h2ologEvent) {
+	timeMillis, ok := eventInt64(rawEvent, "time")
+	if !ok {
+		return
+	}
+	if pacer.baseTime.IsZero() {
+		pacer.baseMillis = timeMillis
+		pacer.baseTime = time.Now()
+		return
+	}
+
+	elapsed := time.Duration(float64(timeMillis-pacer.baseMillis) * float64(time.Millisecond) / pacer.speed)
+	delay := time.Until(pacer.baseTime.Add(elapsed))
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+func loadOffset(offsetFile string) (int64, error) {
+	content, err := os.ReadFile(offsetFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// saveOffset writes the offset atomically by rename(2); it does nothing if offsetFile is empty
+func saveOffset(offsetFile string, offset int64) {
+	if offsetFile == "" {
+		return
+	}
+	tmpFile := offsetFile + ".tmp"
+	err := os.WriteFile(tmpFile, []byte(strconv.FormatInt(offset, 10)+"\n"), 0644)
+	if err == nil {
+		err = os.Rename(tmpFile, offsetFile)
+	}
+	if err != nil {
+		log.Printf("Cannot save the offset to %s: %v", offsetFile, err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// a rule to prefix object names by SNI, e.g. "*.example.com=retention-7d/", so that bucket
+// lifecycle rules with matchesPrefix can apply different retention per tenant
+type retentionRule struct {
+	// a glob pattern of SNI in path.Match syntax; "*" also matches connections without SNI
+	sniPattern string
+	prefix     string
+}
+
+var retentionRules []retentionRule // -retention-rules=rules
+
+// parseRetentionRules parses comma-separated rules, e.g. "api.example.com=retention-90d/,*=retention-7d/"
+func parseRetentionRules(s string) ([]retentionRule, error) {
+	rules := make([]retentionRule, 0)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pair := strings.SplitN(item, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("no prefix in rule '%s'", item)
+		}
+		if _, err := path.Match(pair[0], ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern in rule '%s': %v", item, err)
+		}
+		rules = append(rules, retentionRule{sniPattern: pair[0], prefix: pair[1]})
+	}
+	return rules, nil
+}
+
+// selectRetentionPrefix returns the prefix of the first rule that matches the SNI, or ""
+func selectRetentionPrefix(sni string) string {
+	for _, rule := range retentionRules {
+		if rule.sniPattern == "*" {
+			return rule.prefix
+		}
+		if matched, _ := path.Match(rule.sniPattern, sni); matched && sni != "" {
+			return rule.prefix
+		}
+	}
+	return ""
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// the duration to wait for the components to return after canceling them at -drain-timeout,
+// e.g. for canceled uploads to be spooled
+const drainCancelGrace = 5 * time.Second
+
+// finishInput uploads what is buffered when the input ends or is stopped by a signal. Live
+// connections are uploaded to finalStorage as incomplete unless it is nil. It waits for the
+// uploads for timeout, or indefinitely if timeout is 0. Once timeout expires, it cancels the
+// pipeline by cancel, and returns false. The caller must hold connsMutex.
+func finishInput(ctx context.Context, cancel context.CancelFunc, storage *storageManager, finalStorage *storageManager, latch *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		// flushing is also under the deadline, as it may block on busy workers or slow sinks
+		if uploadOrder != nil {
+			uploadOrder.flush()
+		}
+		globalEvents.flush(ctx, storage, latch)
+		if finalStorage != nil {
+			flushAll(ctx, finalStorage)
+		}
+
+		latch.Wait()
+		storage.wait()
+		if saveReplayOffset != nil {
+			saveReplayOffset()
+		}
+		if bigQuery != nil {
+			bigQuery.close()
+		}
+		if clickHouse != nil {
+			clickHouse.flush(ctx)
+		}
+		if kafkaSink != nil {
+			kafkaSink.close()
+		}
+		if pubSub != nil {
+			pubSub.batch.flush()
+		}
+		close(done)
+	}()
+	if timeout <= 0 {
+		<-done
+		return true
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		log.Printf("Gave up draining after %v; canceling the remaining uploads", timeout)
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(drainCancelGrace):
+		}
+		return false
+	}
+}
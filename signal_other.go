@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// notifyFlushSignal does nothing, as there is no signal for flushAll
+func notifyFlushSignal(c chan<- os.Signal) {}
+
+// notifySoftRestartSignal does nothing, as there is no signal for soft restart
+func notifySoftRestartSignal(c chan<- os.Signal) {}
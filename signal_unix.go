@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyFlushSignal relays SIGUSR1, which triggers flushAll, to c. SIGQUIT is left for
+// the Go runtime to dump goroutines.
+func notifyFlushSignal(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
+
+// notifySoftRestartSignal relays SIGUSR2, which triggers soft restart, to c
+func notifySoftRestartSignal(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
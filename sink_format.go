@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sinks whose formats can be chosen by -sink-formats
+const (
+	sinkLocal = "local"
+	// including -secondary-bucket
+	sinkGCS = "gcs"
+	sinkS3  = "s3"
+)
+
+// the format of objects in a sink
+type sinkFormat struct {
+	// one of payloadFormat* constants
+	payloadFormat string
+	// the content encoding, or "" for none
+	compression string
+}
+
+// formats by sink name overriding -payload-format and -compress (-sink-formats)
+var sinkFormats map[string]sinkFormat
+
+// an encoding of an object for sinks with -sink-formats
+type objectVariant struct {
+	data            []byte
+	contentEncoding string
+	payloadFormat   string
+}
+
+// parseSinkFormats parses comma-separated formats by sink name, each of which is a payload
+// format optionally followed by "+" and a compression, e.g. "local=json,gcs=ndjson+zstd".
+// It must be called after setupCompression.
+func parseSinkFormats(s string) (map[string]sinkFormat, error) {
+	formats := make(map[string]sinkFormat)
+	for _, rule := range strings.Split(s, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		i := strings.Index(rule, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("no '=' in '%s'", rule)
+		}
+		sink, value := rule[:i], rule[i+1:]
+		switch sink {
+		case sinkLocal, sinkGCS, sinkS3:
+		default:
+			return nil, fmt.Errorf("unknown sink '%s' (available: local, gcs, s3)", sink)
+		}
+
+		format := sinkFormat{payloadFormat: value}
+		if j := strings.Index(value, "+"); j >= 0 {
+			format.payloadFormat = value[:j]
+			switch method := value[j+1:]; method {
+			case compressNone:
+			case compressZstd, compressGzip:
+				format.compression = method
+			default:
+				return nil, fmt.Errorf("unknown compression '%s' for %s", method, sink)
+			}
+		}
+		switch format.payloadFormat {
+		case payloadFormatJSON, payloadFormatNDJSON, payloadFormatQlog:
+		case payloadFormatParquet, payloadFormatAvro:
+			if format.compression != "" {
+				return nil, fmt.Errorf("%s cannot be compressed for %s", format.payloadFormat, sink)
+			}
+		default:
+			return nil, fmt.Errorf("unknown payload format '%s' for %s", format.payloadFormat, sink)
+		}
+		if format.compression == compressZstd && zstdEncoder == nil {
+			err := setupZstdEncoder()
+			if err != nil {
+				return nil, err
+			}
+		}
+		formats[sink] = format
+	}
+	return formats, nil
+}
+
+// sinkFormatOf returns the format of objects in the sink
+func sinkFormatOf(sink string) sinkFormat {
+	if format, ok := sinkFormats[sink]; ok {
+		return format
+	}
+	return sinkFormat{payloadFormat: payloadFormat, compression: compression}
+}
+
+// encodeVariants serializes the entry for each sink whose format differs from -payload-format
+// and -compress, sharing the serialization among sinks of the same format
+func encodeVariants(objectName string, entry *logEntry) (map[string]objectVariant, error) {
+	if len(sinkFormats) == 0 {
+		return nil, nil
+	}
+	defaultFormat := sinkFormat{payloadFormat: payloadFormat, compression: compression}
+	variants := make(map[string]objectVariant, len(sinkFormats))
+	encoded := make(map[sinkFormat]objectVariant, len(sinkFormats))
+	for sink, format := range sinkFormats {
+		if format == defaultFormat {
+			continue
+		}
+		variant, ok := encoded[format]
+		if !ok {
+			data, _, err := serializeEvents(objectName, entry, format.payloadFormat)
+			if err != nil {
+				return nil, err
+			}
+			data, contentEncoding := compressPayload(data, format.compression)
+			data, contentEncoding, err = encryptPayload(entry.sni, data, contentEncoding)
+			if err != nil {
+				return nil, err
+			}
+			variant = objectVariant{
+				data:            data,
+				contentEncoding: contentEncoding,
+				payloadFormat:   format.payloadFormat,
+			}
+			encoded[format] = variant
+		}
+		variants[sink] = variant
+	}
+	return variants, nil
+}
@@ -0,0 +1,727 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	json "github.com/goccy/go-json"
+)
+
+// Soft restart (SIGUSR2) replaces the process with a new one, e.g. of an upgraded binary,
+// without closing the sockets of -listen-unix and -listen-tcp. It stops reading the streams,
+// starts the program at the path it was started with, passing the listeners, the streams, and
+// the pidfile as file descriptors, and sends the live connections of the streams through a
+// pipe. The new process resumes the streams from the bytes read but not processed, while the
+// old one finishes its uploads and exits.
+
+// the environment variable that tells the new process the file descriptor of the state
+const softRestartEnv = "H2OLOG_COLLECTOR_SOFT_RESTART_FD"
+
+// errHandedOff stops the scanner of a stream handed off to the new process
+var errHandedOff = errors.New("handed off to the new process")
+
+// the state sent to the new process
+type softRestartState struct {
+	// the process ID of the old process
+	Pid       int             `json:"pid"`
+	Listeners []handoffFile   `json:"listeners"`
+	Streams   []handoffStream `json:"streams"`
+	// the pidfile, or nil without -pidfile
+	PidFile *handoffFile `json:"pid_file,omitempty"`
+}
+
+// a file descriptor passed to the new process, identified by the key, e.g. "tcp:0.0.0.0:8080"
+type handoffFile struct {
+	Key string `json:"key"`
+	FD  int    `json:"fd"`
+}
+
+// a stream of -listen-unix or -listen-tcp with its live connections
+type handoffStream struct {
+	// "unix" or "tcp"
+	Network  string `json:"network"`
+	FD       int    `json:"fd"`
+	Name     string `json:"name"`
+	Host     string `json:"host"`
+	LagLabel string `json:"lag_label"`
+	// the offset after the last processed line
+	Offset     int64 `json:"offset"`
+	LastConnID int64 `json:"last_conn_id"`
+	// the bytes read but not processed yet, which precede the rest of the stream
+	Remainder []byte `json:"remainder,omitempty"`
+	// the offset acknowledged to the sender, or -1 without -input-ack
+	Acked   int64          `json:"acked"`
+	Entries []handoffEntry `json:"entries"`
+}
+
+// a connection in connToLogs, which is live unless Processed
+type handoffEntry struct {
+	ConnID           int64             `json:"conn_id"`
+	StartTime        time.Time         `json:"start_time"`
+	EndTime          time.Time         `json:"end_time"`
+	SentPn           int64             `json:"sent_pn"`
+	AckedPn          int64             `json:"acked_pn"`
+	SNI              string            `json:"sni,omitempty"`
+	Role             string            `json:"role,omitempty"`
+	H2OConnID        int64             `json:"h2o_conn_id"`
+	Processed        bool              `json:"processed,omitempty"`
+	NumEvents        uint64            `json:"num_events"`
+	ClientAddr       string            `json:"client_addr,omitempty"`
+	FilterDecided    bool              `json:"filter_decided,omitempty"`
+	Untracked        bool              `json:"untracked,omitempty"`
+	SummaryOnly      bool              `json:"summary_only,omitempty"`
+	ForciblyClosed   bool              `json:"forcibly_closed,omitempty"`
+	HasErrors        bool              `json:"has_errors,omitempty"`
+	EstimatedSize    int               `json:"estimated_size,omitempty"`
+	NameEvent        h2ologEvent       `json:"name_event,omitempty"`
+	DuplicateAccepts []duplicateAccept `json:"duplicate_accepts,omitempty"`
+	Part             int               `json:"part,omitempty"`
+	PartStartTime    time.Time         `json:"part_start_time"`
+	Downstream       []string          `json:"downstream_objects,omitempty"`
+	Upstream         []string          `json:"upstream_objects,omitempty"`
+	Events           []h2ologEvent     `json:"events,omitempty"`
+	GapSkipped       uint64            `json:"gap_skipped,omitempty"`
+	GapFromTime      int64             `json:"gap_from_time,omitempty"`
+	GapToTime        int64             `json:"gap_to_time,omitempty"`
+	// the state of the analyzers by module name
+	Analyzers map[string]json.RawMessage `json:"analyzers,omitempty"`
+	// the offset of the first event held by -input-ack, or -1
+	AckOffset int64 `json:"ack_offset"`
+}
+
+// a listener registered for soft restart
+type registeredListener struct {
+	key      string
+	listener net.Listener
+}
+
+// a stream stopped for soft restart, which is passed to the new process
+type takenStream struct {
+	network string
+	source  *inputSource
+	file    *os.File
+}
+
+// a stream inherited from the old process
+type inheritedStream struct {
+	state handoffStream
+	conn  net.Conn
+}
+
+// softRestarter hands off the inputs to a new process on SIGUSR2, and takes them over in the
+// new process
+type softRestarter struct {
+	// true if the inputs are only -listen-unix and -listen-tcp, which can be handed off
+	enabled bool
+
+	mutex     sync.Mutex
+	listeners []registeredListener
+	// the streams being read, and the accept loops and the readers to wait for them to stop
+	streams map[*inputSource]net.Conn
+	readers sync.WaitGroup
+	// the pidfile, which is handed off with its lock
+	pidFilePath string
+	pidFile     *os.File
+	// the streams stopped by the handoff
+	taken []takenStream
+	// set once the handoff starts, updated atomically
+	handingOff int32
+	// set once the new process takes over the inputs, updated atomically
+	handedOff int32
+	// closed once the handoff ends, successfully or not
+	done chan struct{}
+
+	// what the new process inherits, guarded by mutex
+	inheritedListeners map[string]*os.File
+	inheritedStreams   []inheritedStream
+	inheritedPidFile   *os.File
+}
+
+var softRestart = &softRestarter{
+	streams: make(map[*inputSource]net.Conn),
+	done:    make(chan struct{}),
+}
+
+// startedHandoff returns true once the handoff starts, after which accepts and reads stop
+func (restarter *softRestarter) startedHandoff() bool {
+	return atomic.LoadInt32(&restarter.handingOff) != 0
+}
+
+// succeeded returns true if the new process has taken over the inputs
+func (restarter *softRestarter) succeeded() bool {
+	return atomic.LoadInt32(&restarter.handedOff) != 0
+}
+
+// listen returns the listener inherited from the old process, or a new one, and registers it
+// to hand it off. prepare is called before listening anew, e.g. to remove a stale socket file.
+func (restarter *softRestarter) listen(network string, address string, prepare func()) (net.Listener, error) {
+	key := network + ":" + address
+	restarter.mutex.Lock()
+	file := restarter.inheritedListeners[key]
+	delete(restarter.inheritedListeners, key)
+	restarter.mutex.Unlock()
+
+	var listener net.Listener
+	var err error
+	if file != nil {
+		listener, err = net.FileListener(file)
+		file.Close()
+	} else {
+		if prepare != nil {
+			prepare()
+		}
+		listener, err = net.Listen(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	restarter.mutex.Lock()
+	restarter.listeners = append(restarter.listeners, registeredListener{key: key, listener: listener})
+	// the accept loop counts as a reader, so that the handoff waits for the streams it accepts
+	restarter.readers.Add(1)
+	restarter.mutex.Unlock()
+	return listener, nil
+}
+
+// stopListening is called when the accept loop of a listener returns
+func (restarter *softRestarter) stopListening() {
+	restarter.readers.Done()
+}
+
+// addStream registers a stream being read, which stops at once if the handoff has started
+func (restarter *softRestarter) addStream(source *inputSource, conn net.Conn) {
+	restarter.mutex.Lock()
+	defer restarter.mutex.Unlock()
+	restarter.streams[source] = conn
+	restarter.readers.Add(1)
+	if restarter.startedHandoff() {
+		source.stopForHandoff(conn)
+	}
+}
+
+// removeStream unregisters a stream once it is closed or taken
+func (restarter *softRestarter) removeStream(source *inputSource) {
+	restarter.mutex.Lock()
+	delete(restarter.streams, source)
+	restarter.mutex.Unlock()
+	restarter.readers.Done()
+}
+
+// takeStream keeps the stream stopped by the handoff to pass it to the new process, and returns
+// true, or returns false if the stream is not stopped by the handoff, e.g. at its end
+func (restarter *softRestarter) takeStream(network string, source *inputSource, conn net.Conn) bool {
+	if !source.handedOff() {
+		return false
+	}
+	filer, ok := conn.(interface{ File() (*os.File, error) })
+	if !ok {
+		log.Printf("Cannot hand off %s: not a file", source.name)
+		return false
+	}
+	file, err := filer.File()
+	if err != nil {
+		log.Printf("Cannot hand off %s: %v", source.name, err)
+		return false
+	}
+	restarter.mutex.Lock()
+	restarter.taken = append(restarter.taken, takenStream{network: network, source: source, file: file})
+	restarter.mutex.Unlock()
+	return true
+}
+
+// stopForHandoff makes the reader stop at the end of the lines read so far
+func (source *inputSource) stopForHandoff(conn net.Conn) {
+	atomic.StoreInt32(&source.handoff, 1)
+	conn.SetReadDeadline(time.Now())
+}
+
+// handedOff returns true if the stream is stopped to hand it off to the new process
+func (source *inputSource) handedOff() bool {
+	return atomic.LoadInt32(&source.handoff) != 0
+}
+
+// start stops accepting and reading the inputs, and hands them off to a new process in
+// background. The caller exits once wait returns.
+func (restarter *softRestarter) start() error {
+	if !restarter.enabled {
+		return errors.New("soft restart requires -listen-unix or -listen-tcp without the other inputs")
+	}
+	executable, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+
+	restarter.mutex.Lock()
+	defer restarter.mutex.Unlock()
+	if restarter.startedHandoff() {
+		return errors.New("already restarting")
+	}
+	listenerFiles := make([]*os.File, 0, len(restarter.listeners))
+	for _, registered := range restarter.listeners {
+		filer, ok := registered.listener.(interface{ File() (*os.File, error) })
+		var file *os.File
+		if ok {
+			file, err = filer.File()
+		} else {
+			err = errors.New("not a file")
+		}
+		if err != nil {
+			for _, file := range listenerFiles {
+				file.Close()
+			}
+			return fmt.Errorf("cannot hand off %s: %v", registered.key, err)
+		}
+		listenerFiles = append(listenerFiles, file)
+	}
+
+	atomic.StoreInt32(&restarter.handingOff, 1)
+	// the new process accepts the pending connections on the duplicated sockets
+	for _, registered := range restarter.listeners {
+		if listener, ok := registered.listener.(*net.UnixListener); ok {
+			listener.SetUnlinkOnClose(false)
+		}
+		registered.listener.Close()
+	}
+	for source, conn := range restarter.streams {
+		source.stopForHandoff(conn)
+	}
+	go restarter.handOff(executable, listenerFiles)
+	return nil
+}
+
+// wait waits for the handoff to end if it has started
+func (restarter *softRestarter) wait() {
+	if restarter.startedHandoff() {
+		<-restarter.done
+	}
+}
+
+// handOff starts the new process once all the streams stop, and sends the state to it
+func (restarter *softRestarter) handOff(executable string, listenerFiles []*os.File) {
+	defer close(restarter.done)
+	restarter.readers.Wait()
+
+	restarter.mutex.Lock()
+	taken := restarter.taken
+	state := softRestartState{Pid: os.Getpid()}
+	// the state is read from fd 3, followed by the others in the order of ExtraFiles
+	files := make([]*os.File, 0, len(listenerFiles)+len(taken)+1)
+	for i, registered := range restarter.listeners {
+		state.Listeners = append(state.Listeners, handoffFile{Key: registered.key, FD: 4 + len(files)})
+		files = append(files, listenerFiles[i])
+	}
+	streamFDs := make([]int, len(taken))
+	for i, stream := range taken {
+		streamFDs[i] = 4 + len(files)
+		files = append(files, stream.file)
+	}
+	if restarter.pidFile != nil {
+		state.PidFile = &handoffFile{Key: restarter.pidFilePath, FD: 4 + len(files)}
+		files = append(files, restarter.pidFile)
+	}
+	restarter.mutex.Unlock()
+	defer func() {
+		for _, file := range files {
+			if file != restarter.pidFile {
+				file.Close()
+			}
+		}
+	}()
+
+	// freeze the live connections, which no longer take events, so that no one uploads them
+	connsMutex.Lock()
+	var frozen []*logEntry
+	for i, stream := range taken {
+		streamState, entries := freezeStream(stream.source)
+		streamState.Network = stream.network
+		streamState.FD = streamFDs[i]
+		state.Streams = append(state.Streams, streamState)
+		frozen = append(frozen, entries...)
+	}
+	connsMutex.Unlock()
+
+	err := restarter.exec(executable, files, &state)
+
+	connsMutex.Lock()
+	defer connsMutex.Unlock()
+	if err != nil {
+		log.Printf("Cannot hand off the inputs to a new process: %v", err)
+		// the live connections are uploaded as incomplete at the end
+		for _, entry := range frozen {
+			entry.processed = false
+			atomic.AddInt64(&numLiveConns, 1)
+		}
+		return
+	}
+	for _, stream := range taken {
+		forgetSource(stream.source)
+	}
+	for _, entry := range frozen {
+		entry.releaseBuffer()
+	}
+	metricConnsHandedOff.Add(int64(len(frozen)))
+	atomic.StoreInt32(&restarter.handedOff, 1)
+	log.Printf("Handed off %d streams with %d live connections; exiting after uploads", len(taken), len(frozen))
+}
+
+// exec starts the new process with the files from fd 4, and sends the state through fd 3
+func (restarter *softRestarter) exec(executable string, files []*os.File, state *softRestartState) error {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), softRestartEnv+"=3")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append([]*os.File{reader}, files...)
+	err = cmd.Start()
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	log.Printf("Started a new process (pid=%d)", cmd.Process.Pid)
+	// the new process reads the state as soon as it starts, or fails with EPIPE if it exits
+	err = json.NewEncoder(writer).Encode(state)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("cannot send the state to the new process: %v", err)
+	}
+	return cmd.Process.Release()
+}
+
+// freezeStream returns the state of the source and its live entries, which are marked as
+// processed, so that they are not uploaded. The caller must hold connsMutex.
+func freezeStream(source *inputSource) (handoffStream, []*logEntry) {
+	state := handoffStream{
+		Name:       source.name,
+		Host:       source.host,
+		LagLabel:   source.lagLabel,
+		Offset:     source.processedOffset(),
+		LastConnID: source.lastConnID,
+		Remainder:  source.remainder,
+		Acked:      -1,
+	}
+	if source.acker != nil {
+		source.acker.mutex.Lock()
+		state.Acked = source.acker.acked
+		source.acker.mutex.Unlock()
+	}
+	var frozen []*logEntry
+	for _, key := range connToLogs.Keys() {
+		value, ok := connToLogs.Peek(key)
+		if !ok || key.(connKey).source != source {
+			continue
+		}
+		entry := value.(*logEntry)
+		state.Entries = append(state.Entries, entry.handoffState())
+		if !entry.processed {
+			entry.processed = true
+			atomic.AddInt64(&numLiveConns, -1)
+			frozen = append(frozen, entry)
+		}
+	}
+	return state, frozen
+}
+
+// handoffState returns the state of the entry to restore it in the new process
+func (entry *logEntry) handoffState() handoffEntry {
+	state := handoffEntry{
+		ConnID:         entry.connID,
+		StartTime:      entry.startTime,
+		EndTime:        entry.endTime,
+		SentPn:         entry.sentPn,
+		AckedPn:        entry.ackedPn,
+		SNI:            entry.sni,
+		Role:           entry.role,
+		H2OConnID:      entry.h2oConnID,
+		Processed:      entry.processed,
+		NumEvents:      entry.numEvents,
+		ClientAddr:     entry.clientAddr,
+		FilterDecided:  entry.filterDecided,
+		Untracked:      entry.untracked,
+		SummaryOnly:    entry.summaryOnly,
+		ForciblyClosed: entry.forciblyClosed,
+		AckOffset:      -1,
+	}
+	if entry.processed {
+		// only to ignore the trailing events
+		return state
+	}
+	state.HasErrors = entry.hasErrors
+	state.EstimatedSize = entry.estimatedSize
+	state.NameEvent = entry.nameEvent
+	state.DuplicateAccepts = entry.duplicateAccepts
+	state.Part = entry.part
+	state.PartStartTime = entry.partStartTime
+	state.Downstream = entry.downstreamObjects
+	state.Upstream = entry.upstreamObjects
+	state.Events = entry.events
+	if analyzers, err := analyzerStates(entry.analyzers); err == nil {
+		state.Analyzers = analyzers
+	} else {
+		log.Printf("Cannot hand off the analyzers of connID=%d: %v", entry.connID, err)
+	}
+	state.GapSkipped = entry.gapSkipped
+	state.GapFromTime = entry.gapFromTime
+	state.GapToTime = entry.gapToTime
+	if acker := entry.source.acker; acker != nil {
+		acker.mutex.Lock()
+		if offset, ok := acker.pending[entry]; ok {
+			state.AckOffset = offset
+		}
+		acker.mutex.Unlock()
+	}
+	return state
+}
+
+// forgetSource removes the entries of the source handed off to the new process from connToLogs.
+// The caller must hold connsMutex.
+func forgetSource(source *inputSource) {
+	for _, key := range connToLogs.Keys() {
+		if key.(connKey).source == source {
+			// processed entries are not uploaded on removal
+			connToLogs.Remove(key)
+		}
+	}
+	for key := range h2oConns {
+		if key.source == source {
+			delete(h2oConns, key)
+		}
+	}
+}
+
+// inherit takes over the inputs from the old process if this process is started by soft
+// restart, which reads the state before the old process exits
+func (restarter *softRestarter) inherit() error {
+	fdString := os.Getenv(softRestartEnv)
+	if fdString == "" {
+		return nil
+	}
+	os.Unsetenv(softRestartEnv)
+	fd, err := strconv.Atoi(fdString)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", softRestartEnv, err)
+	}
+	pipe := os.NewFile(uintptr(fd), "soft-restart")
+	var state softRestartState
+	decoder := json.NewDecoder(pipe)
+	// the events keep numbers as they are
+	decoder.UseNumber()
+	err = decoder.Decode(&state)
+	pipe.Close()
+	if err != nil {
+		return err
+	}
+
+	restarter.mutex.Lock()
+	defer restarter.mutex.Unlock()
+	restarter.inheritedListeners = make(map[string]*os.File)
+	for _, listener := range state.Listeners {
+		restarter.inheritedListeners[listener.Key] = os.NewFile(uintptr(listener.FD), listener.Key)
+	}
+	numEntries := 0
+	for _, stream := range state.Streams {
+		file := os.NewFile(uintptr(stream.FD), stream.Name)
+		conn, err := net.FileConn(file)
+		file.Close()
+		if err != nil {
+			log.Printf("Cannot resume %s: %v", stream.Name, err)
+			continue
+		}
+		restarter.inheritedStreams = append(restarter.inheritedStreams, inheritedStream{state: stream, conn: conn})
+		numEntries += len(stream.Entries)
+	}
+	if state.PidFile != nil {
+		restarter.inheritedPidFile = os.NewFile(uintptr(state.PidFile.FD), state.PidFile.Key)
+	}
+	log.Printf("Took over %d listeners and %d streams with %d connections from pid=%d",
+		len(state.Listeners), len(restarter.inheritedStreams), numEntries, state.Pid)
+	return nil
+}
+
+// takeInheritedStreams returns the streams of the network inherited from the old process, and
+// forgets them
+func (restarter *softRestarter) takeInheritedStreams(network string) []inheritedStream {
+	restarter.mutex.Lock()
+	defer restarter.mutex.Unlock()
+	var streams []inheritedStream
+	rest := restarter.inheritedStreams[:0]
+	for _, stream := range restarter.inheritedStreams {
+		if stream.state.Network == network {
+			streams = append(streams, stream)
+		} else {
+			rest = append(rest, stream)
+		}
+	}
+	restarter.inheritedStreams = rest
+	return streams
+}
+
+// takeInheritedPidFile returns the locked pidfile of the path inherited from the old process,
+// or nil
+func (restarter *softRestarter) takeInheritedPidFile(filePath string) *os.File {
+	restarter.mutex.Lock()
+	defer restarter.mutex.Unlock()
+	file := restarter.inheritedPidFile
+	restarter.inheritedPidFile = nil
+	if file != nil && file.Name() != filePath {
+		file.Close()
+		return nil
+	}
+	return file
+}
+
+// registerPidFile hands off the pidfile with its lock
+func (restarter *softRestarter) registerPidFile(filePath string, file *os.File) {
+	restarter.mutex.Lock()
+	restarter.pidFilePath = filePath
+	restarter.pidFile = file
+	restarter.mutex.Unlock()
+}
+
+// resume returns the source of the inherited stream with its connections restored
+func (stream inheritedStream) resume() *inputSource {
+	state := stream.state
+	source := newInputSource(state.Name, io.MultiReader(bytes.NewReader(state.Remainder), stream.conn))
+	source.host = state.Host
+	source.lagLabel = state.LagLabel
+	source.offset = state.Offset
+	source.lastConnID = state.LastConnID
+	if state.Acked >= 0 {
+		source.acker = newInputAcker(stream.conn)
+		source.acker.acked = state.Acked
+	}
+
+	connsMutex.Lock()
+	defer connsMutex.Unlock()
+	for _, entryState := range state.Entries {
+		entry := restoreEntry(source, entryState)
+		connToLogs.Add(connKey{source, entry.connID}, entry)
+		if entry.processed {
+			continue
+		}
+		atomic.AddInt64(&numLiveConns, 1)
+		if entry.h2oConnID >= 0 {
+			h2oConns[connKey{source, entry.h2oConnID}] = entry
+		}
+		if entryState.AckOffset >= 0 {
+			source.acker.track(entry, entryState.AckOffset)
+		}
+	}
+	return source
+}
+
+// restoreEntry returns the entry of the state
+func restoreEntry(source *inputSource, state handoffEntry) *logEntry {
+	entry := &logEntry{
+		connID:            state.ConnID,
+		source:            source,
+		host:              source.host,
+		startTime:         state.StartTime,
+		endTime:           state.EndTime,
+		sentPn:            state.SentPn,
+		ackedPn:           state.AckedPn,
+		sni:               state.SNI,
+		role:              state.Role,
+		h2oConnID:         state.H2OConnID,
+		processed:         state.Processed,
+		numEvents:         state.NumEvents,
+		clientAddr:        state.ClientAddr,
+		filterDecided:     state.FilterDecided,
+		untracked:         state.Untracked,
+		summaryOnly:       state.SummaryOnly,
+		forciblyClosed:    state.ForciblyClosed,
+		hasErrors:         state.HasErrors,
+		nameEvent:         state.NameEvent,
+		duplicateAccepts:  state.DuplicateAccepts,
+		part:              state.Part,
+		partStartTime:     state.PartStartTime,
+		downstreamObjects: state.Downstream,
+		upstreamObjects:   state.Upstream,
+		events:            state.Events,
+		gapSkipped:        state.GapSkipped,
+		gapFromTime:       state.GapFromTime,
+		gapToTime:         state.GapToTime,
+	}
+	if entry.processed {
+		return entry
+	}
+	analyzers, err := restoreAnalyzers(state.Analyzers)
+	if err != nil {
+		log.Printf("Cannot restore the analyzers of connID=%d: %v", entry.connID, err)
+		analyzers = newAnalyzers()
+	}
+	entry.analyzers = analyzers
+	if entry.events == nil && !entry.summaryOnly {
+		entry.events = make([]h2ologEvent, 0, capacityOfEvents)
+	}
+	for _, rawEvent := range entry.events {
+		entry.observeFields(rawEvent)
+	}
+	entry.addEstimatedSize(state.EstimatedSize)
+	return entry
+}
+
+// analyzerStates returns the state of the analyzers of a connection, which sees all its events
+// including those not in the payload, by module name
+func analyzerStates(analyzers []analyzer) (map[string]json.RawMessage, error) {
+	states := make(map[string]json.RawMessage, len(analyzers))
+	i := 0
+	for _, module := range analyzerModules {
+		if module.disabled || i >= len(analyzers) {
+			continue
+		}
+		var state interface{} = analyzers[i]
+		if a, ok := analyzers[i].(handoffAnalyzer); ok {
+			state = a.handoffState()
+		}
+		data, err := json.Marshal(state)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", module.name, err)
+		}
+		states[module.name] = data
+		i++
+	}
+	return states, nil
+}
+
+// restoreAnalyzers returns the analyzers of the states by analyzerStates. Those missing in the
+// states, e.g. enabled by the new process, start over.
+func restoreAnalyzers(states map[string]json.RawMessage) ([]analyzer, error) {
+	analyzers := newAnalyzers()
+	i := 0
+	for _, module := range analyzerModules {
+		if module.disabled {
+			continue
+		}
+		if data, ok := states[module.name]; ok {
+			var err error
+			if a, ok := analyzers[i].(handoffAnalyzer); ok {
+				err = a.restoreState(data)
+			} else {
+				err = json.Unmarshal(data, analyzers[i])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", module.name, err)
+			}
+		}
+		i++
+	}
+	return analyzers, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"testing"
+
+	json "github.com/goccy/go-json"
+)
+
+// TestAnalyzerHandoff compares the analyzers of the events of test/test.jsonl with those handed
+// off in the middle of them
+func TestAnalyzerHandoff(t *testing.T) {
+	input, err := os.Open("test/test.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+	// the events of the first connection
+	var events []h2ologEvent
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		rawEvent, err := decodeEvent(scanner.Text())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rawEvent["conn"] != nil && (len(events) == 0 || rawEvent["conn"] == events[0]["conn"]) {
+			events = append(events, rawEvent)
+		}
+	}
+
+	for _, split := range []int{0, 1, len(events) / 2, len(events)} {
+		analyzers := newAnalyzers()
+		before := newAnalyzers()
+		for i, rawEvent := range events {
+			for _, analyzer := range analyzers {
+				analyzer.update(rawEvent["type"], rawEvent)
+			}
+			if i < split {
+				for _, analyzer := range before {
+					analyzer.update(rawEvent["type"], rawEvent)
+				}
+			}
+		}
+
+		// the state passes through JSON as in the pipe to the new process
+		states, err := analyzerStates(before)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(states)
+		if err != nil {
+			t.Fatal(err)
+		}
+		states = nil
+		if err := json.Unmarshal(data, &states); err != nil {
+			t.Fatal(err)
+		}
+		after, err := restoreAnalyzers(states)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rawEvent := range events[split:] {
+			for _, analyzer := range after {
+				analyzer.update(rawEvent["type"], rawEvent)
+			}
+		}
+
+		names := analyzerNames()
+		for i := range analyzers {
+			want, _ := json.Marshal(analyzers[i].result())
+			got, _ := json.Marshal(after[i].result())
+			if string(got) != string(want) {
+				t.Errorf("%s handed off after %d events: %s, want %s", names[i], split, got, want)
+			}
+		}
+	}
+}
+
+func TestRestoreAnalyzersWithoutStates(t *testing.T) {
+	analyzers, err := restoreAnalyzers(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(analyzers) != len(newAnalyzers()) {
+		t.Errorf("%d analyzers, want %d", len(analyzers), len(newAnalyzers()))
+	}
+}
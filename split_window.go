@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	json "github.com/goccy/go-json"
+)
+
+// the duration of events in a part of a long-lived connection, or 0 not to split connections (-split-window)
+var splitWindow time.Duration
+
+// an analyzer whose result is computed when a part is split, as the analyzer of the live
+// connection continues while the part is uploaded
+type frozenAnalyzer struct {
+	fields json.RawMessage
+}
+
+func (analyzer *frozenAnalyzer) update(eventType interface{}, rawEvent h2ologEvent) {}
+
+func (analyzer *frozenAnalyzer) result() interface{} {
+	return analyzer.fields
+}
+
+func freezeAnalyzers(analyzers []analyzer) ([]analyzer, error) {
+	frozen := make([]analyzer, 0, len(analyzers))
+	for _, analyzer := range analyzers {
+		fields, err := json.Marshal(analyzer.result())
+		if err != nil {
+			return nil, err
+		}
+		frozen = append(frozen, &frozenAnalyzer{fields: fields})
+	}
+	return frozen, nil
+}
+
+// partObjectName returns the name of a part followed by another, so that the final object of
+// the connection keeps the name of unsplit ones
+func partObjectName(objectName string, part int) string {
+	return fmt.Sprintf("%s-part%d", objectName, part)
+}
+
+// maybeSplitEntry uploads the events of the entry as a part marked as continued once they span
+// -split-window, and the entry continues with the following events. The summary fields of a
+// part are those of the connection up to the split, and so is the decision of
+// -payload-retention on its payload. The caller must hold connsMutex.
+func maybeSplitEntry(ctx context.Context, storage *storageManager, latch *sync.WaitGroup, entry *logEntry) {
+	// parts of a connection are held until the filters decide to track it
+	if entry.summaryOnly || entry.nameEvent == nil || len(entry.events) == 0 || entry.awaitingFilter() {
+		return
+	}
+	if entry.partStartTime.IsZero() {
+		entry.partStartTime = entry.startTime
+	}
+	if entry.endTime.Sub(entry.partStartTime) < splitWindow {
+		return
+	}
+
+	analyzers, err := freezeAnalyzers(entry.analyzers)
+	if err != nil {
+		log.Printf("Cannot split connID=%d: %v", entry.connID, err)
+		return
+	}
+	if entry.part == 0 {
+		entry.part = 1
+	}
+	part := *entry
+	part.analyzers = analyzers
+	part.continued = true
+	applyPayloadRetention(&part)
+	if debug {
+		log.Printf("[D] Splitting part %d of connID=%d (events=%d)", part.part, entry.connID, len(part.events))
+	}
+	metricPartsSplit.Add(1)
+
+	entry.part++
+	entry.partStartTime = entry.endTime
+	entry.events = make([]h2ologEvent, 0, capacityOfEvents)
+	entry.estimatedSize = 0
+	entry.fieldDictionary = nil
+
+	if uploadOrder != nil {
+		uploadOrder.add(&part)
+	} else {
+		startUpload(ctx, latch, storage, &part)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// deadLetterSpool keeps payloads whose uploads failed in a local directory, and uploads them
+// again periodically until they succeed (-spool-dir)
+type deadLetterSpool struct {
+	dir      string
+	interval time.Duration
+	storage  *storageManager
+}
+
+var spool *deadLetterSpool
+
+// add writes the payload to the spool
+func (spool *deadLetterSpool) add(objectName string, data []byte, attrs objectAttrs) error {
+	filePath := path.Join(spool.dir, objectName+fileSuffix(attrs.contentEncoding, attrs.payloadFormat))
+	os.MkdirAll(path.Dir(filePath), os.ModePerm)
+	err := writeLocalFile(filePath, data, spool.storage.localDurability, false)
+	if err == nil {
+		metricObjectsSpooled.Add(1)
+	}
+	return err
+}
+
+// start drains the spool in background every interval until ctx is canceled
+func (spool *deadLetterSpool) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(spool.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			numUploaded, err := spool.drain()
+			if numUploaded > 0 {
+				log.Printf("Uploaded %d objects in the spool", numUploaded)
+			}
+			if err != nil && debug {
+				log.Printf("[D] Stopped draining the spool: %v", err)
+			}
+		}
+	}()
+}
+
+// drain uploads the spooled objects, removing them once uploaded. It stops at the first
+// failure except for those of the objects themselves, as the sinks are likely to be still
+// unreachable.
+func (spool *deadLetterSpool) drain() (int, error) {
+	numUploaded := 0
+	err := filepath.WalkDir(spool.dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		relPath, err := filepath.Rel(spool.dir, filePath)
+		if err != nil {
+			return err
+		}
+		objectName, contentEncoding := parseLocalFileName(filepath.ToSlash(relPath))
+		if objectName == "" {
+			return nil
+		}
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+
+		record := &auditRecord{
+			Time:       now().UTC(),
+			ObjectName: objectName,
+			Bytes:      len(data),
+			Result:     "ok",
+		}
+		defer auditLog.record(record)
+		if recentUploads.seen(objectName) {
+			// e.g. a snapshot spooled before the final object
+			metricDuplicatesSuppressed.Add(dupSpoolReplay, 1)
+			record.Result = "skipped"
+			return os.Remove(filePath)
+		}
+		// spooled objects are in -payload-format
+		err = spool.storage.write(objectName, data, objectAttrs{contentEncoding: contentEncoding, payloadFormat: payloadFormat})
+		if err == errObjectExists {
+			metricDuplicatesSuppressed.Add(dupSpoolReplay, 1)
+			record.Result = "skipped"
+			return os.Remove(filePath)
+		}
+		if err != nil {
+			record.Result = "error"
+			record.Error = err.Error()
+			if isObjectError(err) {
+				// retries never fix it, but the other objects can be uploaded
+				log.Printf("Cannot upload \"%s\" in the spool: %v", objectName, err)
+				return nil
+			}
+			return err
+		}
+		numUploaded++
+		metricSpoolUploads.Add(1)
+		return os.Remove(filePath)
+	})
+	return numUploaded, err
+}
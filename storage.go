@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	gcs "cloud.google.com/go/storage"
+
+	"github.com/gfx/h2olog-collector-gcs/archive"
+)
+
+// the delay before the first retry of a write, doubled for each retry
+const uploadRetryBackoff = 500 * time.Millisecond
+
+// the max number of in-flight writes to the secondary bucket
+const maxReplications = 64
+
+// per-object attributes passed to storageManager.write
+type objectAttrs struct {
+	// GCS storage class, or "" for the bucket's default
+	storageClass string
+	// "zstd" if the data is compressed, or "" for plain JSON
+	contentEncoding string
+	// -payload-format of the data
+	payloadFormat string
+	// encodings of the object by sink name that differ from the data with -sink-formats
+	variants map[string]objectVariant
+}
+
+// forSink returns the data and the attributes of the object to write to the sink
+func (attrs objectAttrs) forSink(sink string, data []byte) ([]byte, objectAttrs) {
+	variant, ok := attrs.variants[sink]
+	if !ok {
+		return data, attrs
+	}
+	attrs.contentEncoding = variant.contentEncoding
+	attrs.payloadFormat = variant.payloadFormat
+	attrs.variants = nil
+	return variant.data, attrs
+}
+
+// strategies for an object name that already exists (-on-name-collision)
+const (
+	collisionOverwrite = "overwrite"
+	collisionSuffix    = "suffix"
+	collisionSkip      = "skip"
+	collisionError     = "error"
+)
+
+type storageManager struct {
+	ctx      context.Context
+	bucket   *gcs.BucketHandle
+	bucketID string
+	// local directories, among which objects are sharded by the hash of their names
+	localDirs []string
+	// one of durability* constants
+	localDurability string
+	s3Bucket        *s3Bucket
+
+	// one of collision* constants
+	onNameCollision string
+	// true to write objects to GCS only if they don't exist (-exactly-once)
+	createOnly bool
+	// the max number of attempts of a write that fails with retryable errors (-upload-attempts)
+	maxAttempts int
+
+	// an optional bucket, typically in another region, to which objects are
+	// replicated asynchronously
+	secondaryBucket *gcs.BucketHandle
+	// in-flight writes to secondaryBucket
+	replicating sync.WaitGroup
+	// the slots of in-flight writes to secondaryBucket, up to maxReplications
+	replicationSlots chan struct{}
+
+	// injects failures and latency into writes for testing (-inject-faults); may be nil
+	faults *faultInjector
+}
+
+// objectURI returns the URI of the object in the primary remote sink, or the object name
+// if there is no remote sink
+func (storage *storageManager) objectURI(objectName string) string {
+	if storage.bucket != nil {
+		return fmt.Sprintf("gs://%s/%s", storage.bucketID, objectName)
+	}
+	if storage.s3Bucket != nil {
+		return fmt.Sprintf("s3://%s/%s", storage.s3Bucket.name, objectName)
+	}
+	return objectName
+}
+
+// write writes the object to all the sinks, retrying the whole write on retryable errors up to
+// maxAttempts. Errors are classified by the kinds of the archive package, except errObjectExists.
+func (storage *storageManager) write(objectName string, data []byte, attrs objectAttrs) error {
+	backoff := uploadRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := storage.writeOnce(objectName, data, attrs)
+		if err == nil || attempt >= storage.maxAttempts || !errors.Is(err, archive.ErrRetryable) {
+			return err
+		}
+		if debug {
+			log.Printf("[D] Retrying \"%s\" in %v after attempt %d: %v", objectName, backoff, attempt, err)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-storage.ctx.Done():
+			return err
+		}
+		backoff *= 2
+		metricUploadRetries.Add(1)
+	}
+}
+
+func (storage *storageManager) writeOnce(objectName string, data []byte, attrs objectAttrs) error {
+	err := storage.faults.inject(storage.ctx, objectName)
+	if err != nil {
+		return classifyError(err)
+	}
+	writes := &sinkWrites{}
+	if len(storage.localDirs) > 0 {
+		data, attrs := attrs.forSink(sinkLocal, data)
+		filePath := path.Join(storage.localDirFor(objectName), objectName+fileSuffix(attrs.contentEncoding, attrs.payloadFormat))
+		// object names may have directories, e.g. by -retention-rules
+		os.MkdirAll(path.Dir(filePath), os.ModePerm)
+		err := writes.add(writeLocalFile(filePath, data, storage.localDurability, storage.createOnly))
+		if err != nil {
+			return classifyError(err)
+		}
+	}
+	err = storage.writeRemote(objectName, data, attrs, writes)
+	if err != nil {
+		return err
+	}
+	return writes.result()
+}
+
+// sinkWrites counts the sinks written with createOnly, so that a write fails with
+// errObjectExists only if all of them have the object, e.g. as another writer has stored it, and
+// not if a previous attempt has stored it in some of them
+type sinkWrites struct {
+	numSinks    int
+	numExisting int
+}
+
+// add counts the result of a write to a sink, and returns the error unless it is errObjectExists
+func (writes *sinkWrites) add(err error) error {
+	writes.numSinks++
+	if err == errObjectExists {
+		writes.numExisting++
+		return nil
+	}
+	return err
+}
+
+// result returns errObjectExists if all the sinks have had the object
+func (writes *sinkWrites) result() error {
+	if writes.numSinks > 0 && writes.numExisting == writes.numSinks {
+		return errObjectExists
+	}
+	return nil
+}
+
+// classifyError classifies an error of a sink by the kinds of the archive package, e.g. so that
+// write can tell retryable errors
+func classifyError(err error) error {
+	if err == errObjectExists {
+		return err
+	}
+	return archive.Classify(err)
+}
+
+// isObjectError reports whether the write failed because of the object itself, e.g. its size,
+// which retries never fix unlike failures of sinks
+func isObjectError(err error) bool {
+	return errors.Is(err, archive.ErrOversized) || errors.Is(err, archive.ErrSchema)
+}
+
+// writeRemote writes the object to the sinks other than the local directories, counting them in
+// writes
+func (storage *storageManager) writeRemote(objectName string, data []byte, attrs objectAttrs, writes *sinkWrites) error {
+	if storage.s3Bucket != nil {
+		data, attrs := attrs.forSink(sinkS3, data)
+		err := writes.add(storage.s3Bucket.write(storage.ctx, objectName, data, attrs, storage.createOnly))
+		if err != nil {
+			return classifyError(err)
+		}
+	}
+	data, attrs = attrs.forSink(sinkGCS, data)
+	if storage.bucket != nil {
+		err := writes.add(storage.writeObject(storage.bucket, objectName, data, attrs))
+		if err != nil {
+			return classifyError(err)
+		}
+	}
+	if storage.secondaryBucket != nil {
+		// waits for a slot, so that a slow secondary bucket slows down the uploads
+		// rather than piling up replications
+		storage.replicationSlots <- struct{}{}
+		storage.replicating.Add(1)
+		go func() {
+			defer func() {
+				<-storage.replicationSlots
+				storage.replicating.Done()
+			}()
+			err := storage.writeObject(storage.secondaryBucket, objectName, data, attrs)
+			if err != nil {
+				log.Printf("Failed to replicate \"%s\" to the secondary bucket: %v", objectName, err)
+			} else if debug {
+				log.Printf("[D] Replicated \"%s\" to the secondary bucket", objectName)
+			}
+		}()
+	}
+	return nil
+}
+
+// resolveName applies the collision strategy to the object name across all the sinks.
+// It returns "" if the object should be skipped.
+func (storage *storageManager) resolveName(objectName string) (string, error) {
+	if storage.onNameCollision == collisionOverwrite || storage.onNameCollision == "" {
+		return objectName, nil
+	}
+
+	for i := 0; ; i++ {
+		name := objectName
+		if i > 0 {
+			name = fmt.Sprintf("%s-%d", objectName, i)
+		}
+		exists, err := storage.exists(name)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return name, nil
+		}
+
+		switch storage.onNameCollision {
+		case collisionSkip:
+			return "", nil
+		case collisionError:
+			return "", fmt.Errorf("the object \"%s\" already exists", name)
+		}
+	}
+}
+
+// exists reports whether the object exists in any of the sinks
+func (storage *storageManager) exists(objectName string) (bool, error) {
+	if len(storage.localDirs) > 0 {
+		// with or without the suffix of compression, or in Parquet, Avro, or qlog
+		for _, pattern := range []string{".json*", ".parquet", ".avro", ".qlog*"} {
+			filePaths, err := filepath.Glob(path.Join(storage.localDirFor(objectName), objectName+pattern))
+			if err != nil {
+				return false, err
+			}
+			if len(filePaths) > 0 {
+				return true, nil
+			}
+		}
+	}
+	if storage.s3Bucket != nil {
+		exists, err := storage.s3Bucket.exists(storage.ctx, objectName)
+		if err != nil || exists {
+			return exists, err
+		}
+	}
+	for _, bucket := range []*gcs.BucketHandle{storage.bucket, storage.secondaryBucket} {
+		if bucket == nil {
+			continue
+		}
+		_, err := bucket.Object(objectName).Attrs(storage.ctx)
+		if err == nil {
+			return true, nil
+		} else if err != gcs.ErrObjectNotExist {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// localDirFor returns the shard of localDirs for the object
+func (storage *storageManager) localDirFor(objectName string) string {
+	if len(storage.localDirs) == 1 {
+		return storage.localDirs[0]
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(objectName))
+	return storage.localDirs[hash.Sum32()%uint32(len(storage.localDirs))]
+}
+
+func (storage *storageManager) writeObject(bucket *gcs.BucketHandle, objectName string, data []byte, attrs objectAttrs) error {
+	object := bucket.Object(objectName)
+	if storage.createOnly {
+		object = object.If(gcs.Conditions{DoesNotExist: true})
+	}
+	writer := object.NewWriter(storage.ctx)
+	writer.ContentType = contentTypeOf(data, attrs.payloadFormat)
+	writer.StorageClass = attrs.storageClass
+	writer.ContentEncoding = attrs.contentEncoding
+	_, err := writer.Write(data)
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil && storage.createOnly && isPreconditionFailed(err) {
+		return errObjectExists
+	}
+	if err != nil {
+		// TODO: handle temporary server errors
+		return err
+	}
+	return nil
+}
+
+// hasRemote reports whether there is any sink other than the local directories
+func (storage *storageManager) hasRemote() bool {
+	return storage.bucket != nil || storage.s3Bucket != nil || storage.secondaryBucket != nil
+}
+
+// wait blocks until all the asynchronous writes finish
+func (storage *storageManager) wait() {
+	storage.replicating.Wait()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a rule to choose a GCS storage class, e.g. "size>1048576=STANDARD"
+type storageClassRule struct {
+	// "size", "duration", "interesting" that matches connections worth looking into (see
+	// isInterestingConn), or "*" that matches any connection
+	attr string
+	// '>' or '<'
+	op byte
+	// bytes for "size" or nanoseconds for "duration"
+	threshold int64
+	// the storage class name, e.g. "NEARLINE"
+	storageClass string
+}
+
+func (rule *storageClassRule) match(size int, duration time.Duration, interesting bool) bool {
+	var value int64
+	switch rule.attr {
+	case "*":
+		return true
+	case "interesting":
+		return interesting
+	case "size":
+		value = int64(size)
+	case "duration":
+		value = int64(duration)
+	}
+	if rule.op == '>' {
+		return value > rule.threshold
+	}
+	return value < rule.threshold
+}
+
+// parseStorageClassRules parses comma-separated rules, e.g.
+// "interesting=STANDARD,size>1048576=STANDARD,duration>10m=STANDARD,*=NEARLINE"
+func parseStorageClassRules(s string) ([]storageClassRule, error) {
+	rules := make([]storageClassRule, 0)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pair := strings.SplitN(item, "=", 2)
+		if len(pair) != 2 || pair[1] == "" {
+			return nil, fmt.Errorf("no storage class in rule '%s'", item)
+		}
+		rule := storageClassRule{storageClass: strings.ToUpper(pair[1])}
+		if pair[0] == "*" || pair[0] == "interesting" {
+			rule.attr = pair[0]
+			rules = append(rules, rule)
+			continue
+		}
+
+		i := strings.IndexAny(pair[0], "<>")
+		if i < 0 {
+			return nil, fmt.Errorf("no operator in rule '%s'", item)
+		}
+		rule.attr = pair[0][:i]
+		rule.op = pair[0][i]
+		value := pair[0][i+1:]
+
+		switch rule.attr {
+		case "size":
+			threshold, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size in rule '%s': %v", item, err)
+			}
+			rule.threshold = threshold
+		case "duration":
+			threshold, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid duration in rule '%s': %v", item, err)
+			}
+			rule.threshold = int64(threshold)
+		default:
+			return nil, fmt.Errorf("unknown attribute '%s' in rule '%s'", rule.attr, item)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// selectStorageClass returns the storage class of the first matched rule, or "" for the bucket's default
+func selectStorageClass(entry *logEntry, size int) string {
+	duration := entry.endTime.Sub(entry.startTime)
+	interesting := isInterestingConn(entry)
+	for _, rule := range storageClassRules {
+		if rule.match(size, duration, interesting) {
+			return rule.storageClass
+		}
+	}
+	return ""
+}
+
+// isInterestingConn reports whether the connection is likely to be read, i.e. one with 5xx
+// responses or reset streams, with anomalies, or finalized without quicly:free
+func isInterestingConn(entry *logEntry) bool {
+	return entry.hasErrors || entry.forciblyClosed || len(anomaliesOf(entry)) > 0
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// an S3 bucket as a sink (-s3-bucket)
+type s3Bucket struct {
+	client *s3.S3
+	name   string
+}
+
+// newS3Bucket resolves credentials and the region in the standard way of AWS SDK,
+// i.e. environment variables, ~/.aws/config, ~/.aws/credentials, and instance roles.
+func newS3Bucket(name string) (*s3Bucket, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Bucket{
+		client: s3.New(sess),
+		name:   name,
+	}, nil
+}
+
+// write puts the object. The storage class is not set, as -storage-class-rules has GCS storage classes.
+// With createOnly, the put is conditional on the absence of the object by "If-None-Match: *", and it
+// returns errObjectExists if the object exists.
+func (bucket *s3Bucket) write(ctx context.Context, objectName string, data []byte, attrs objectAttrs, createOnly bool) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket.name),
+		Key:         aws.String(objectName),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentTypeOf(data, attrs.payloadFormat)),
+	}
+	if attrs.contentEncoding != "" {
+		input.ContentEncoding = aws.String(attrs.contentEncoding)
+	}
+	request, _ := bucket.client.PutObjectRequest(input)
+	request.SetContext(ctx)
+	if createOnly {
+		// PutObjectInput of this SDK has no field for the header
+		request.HTTPRequest.Header.Set("If-None-Match", "*")
+	}
+	err := request.Send()
+	if failure, ok := err.(awserr.RequestFailure); ok && createOnly {
+		// 409 is returned for a concurrent conditional write
+		switch failure.StatusCode() {
+		case http.StatusPreconditionFailed, http.StatusConflict:
+			return errObjectExists
+		}
+	}
+	return err
+}
+
+func (bucket *s3Bucket) exists(ctx context.Context, objectName string) (bool, error) {
+	_, err := bucket.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket.name),
+		Key:    aws.String(objectName),
+	})
+	if err == nil {
+		return true, nil
+	}
+	if failure, ok := err.(awserr.RequestFailure); ok && failure.StatusCode() == http.StatusNotFound {
+		return false, nil
+	}
+	return false, err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+
+	json "github.com/goccy/go-json"
+)
+
+// A summary row is the root object without the payload, stored for each object by sinks of
+// summaries (-bigquery-table). It shares the serialization with the object, so that the two
+// stores are consistent without serializing twice, and they refer to each other: the row by
+// "object", the URI of the object, and the object by "summary_table", where the row has the same
+// "id".
+
+// buildSummaryRow makes a row from the object serialized by serializeEvents, taking its summary
+// part, with "object" referring to the stored object and optionally the payload as a JSON string.
+// Objects not in the JSON formats are serialized again only as far as the row needs.
+func buildSummaryRow(objectName string, entry *logEntry, object []byte, summaryLength int, objectURI string, withPayload bool) ([]byte, error) {
+	if !isRecordPayloadFormat(payloadFormat) {
+		if withPayload {
+			var err error
+			object, summaryLength, err = serializeEvents(objectName, entry, payloadFormatJSON)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			summary, err := serializeSummary(objectName, entry, payloadFormat)
+			if err != nil {
+				return nil, err
+			}
+			object, summaryLength = summary.Bytes(), summary.Len()
+		}
+	}
+
+	uri, err := json.Marshal(objectURI)
+	if err != nil {
+		return nil, err
+	}
+	row := bytes.NewBuffer(make([]byte, 0, summaryLength+len(uri)+16))
+	row.Write(object[:summaryLength])
+	row.WriteString(`,"object":`)
+	row.Write(uri)
+	if withPayload {
+		// a JSON column takes a JSON string
+		payload, err := json.Marshal(string(payloadArray(object, summaryLength)))
+		if err != nil {
+			return nil, err
+		}
+		row.WriteString(`,"payload":`)
+		row.Write(payload)
+	}
+	row.WriteByte('}')
+	return row.Bytes(), nil
+}
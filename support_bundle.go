@@ -0,0 +1,218 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	json "github.com/goccy/go-json"
+
+	"github.com/gfx/h2olog-collector-gcs/archive"
+)
+
+// the max number of the latest lines of -audit-log in a support bundle
+const supportBundleAuditLines = 1000
+
+// flags whose values may contain credentials, which are redacted in support bundles
+var supportBundleSecretFlags = map[string]bool{
+	"clickhouse-dsn":     true,
+	"notify-webhook":     true,
+	"anomaly-webhook":    true,
+	"rate-alert-webhook": true,
+}
+
+// a flag in config.json of a support bundle
+type supportBundleFlag struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// true if it is given in the command line, environment variables, or -config
+	Set bool `json:"set"`
+}
+
+// runSupportBundle writes a gzipped tarball for bug reports with the version, the effective
+// flags, the latest lines of -audit-log, and the metrics of the collector running at
+// -metrics-addr, given the same flags as the collector. What cannot be gathered is listed in
+// errors.txt.
+func runSupportBundle(ctx context.Context, store archive.Store, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: support-bundle OUTPUT")
+	}
+	file, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	var problems []string
+	add := func(name string, data []byte) error {
+		err := tarWriter.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tarWriter.Write(data)
+		return err
+	}
+	addJSON := func(name string, value interface{}) error {
+		data, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return err
+		}
+		return add(name, append(data, '\n'))
+	}
+
+	hostname, _ := os.Hostname()
+	err = addJSON("version.json", map[string]interface{}{
+		"version":    strings.TrimSpace(version),
+		"revision":   revision,
+		"go_version": runtime.Version(),
+		"os":         runtime.GOOS,
+		"arch":       runtime.GOARCH,
+		"num_cpu":    runtime.NumCPU(),
+		"gomaxprocs": runtime.GOMAXPROCS(0),
+		"hostname":   hostname,
+		"time":       time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = addJSON("config.json", effectiveFlags())
+	if err != nil {
+		return err
+	}
+
+	if auditLogPath := flag.Lookup("audit-log").Value.String(); auditLogPath != "" {
+		lines, err := tailLines(auditLogPath, supportBundleAuditLines)
+		if err == nil {
+			err = add("audit.jsonl", lines)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("audit log: %v", err))
+		}
+	}
+
+	if metricsAddr := flag.Lookup("metrics-addr").Value.String(); metricsAddr != "" {
+		metrics, err := fetchMetrics(ctx, metricsAddr)
+		if err == nil {
+			err = add("metrics.json", metrics)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("metrics: %v", err))
+		}
+	}
+
+	if len(problems) > 0 {
+		err = add("errors.txt", []byte(strings.Join(problems, "\n")+"\n"))
+		if err != nil {
+			return err
+		}
+	}
+	err = tarWriter.Close()
+	if err != nil {
+		return err
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return err
+	}
+	log.Printf("Wrote a support bundle to %s", args[0])
+	return file.Close()
+}
+
+// effectiveFlags returns all the flags with their values after -config and environment
+// variables are applied, redacting credentials
+func effectiveFlags() []supportBundleFlag {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	flags := make([]supportBundleFlag, 0)
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if supportBundleSecretFlags[f.Name] && value != "" {
+			value = "REDACTED"
+		} else if u, err := url.Parse(value); err == nil && u.User != nil {
+			u.User = url.User("REDACTED")
+			value = u.String()
+		}
+		flags = append(flags, supportBundleFlag{Name: f.Name, Value: value, Set: given[f.Name]})
+	})
+	return flags
+}
+
+// tailLines returns the last n lines of the file
+func tailLines(filePath string, n int) ([]byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := make([][]byte, 0, n)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(lines) == n {
+			lines = lines[1:]
+		}
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	buffer := &bytes.Buffer{}
+	for _, line := range lines {
+		buffer.Write(line)
+		buffer.WriteByte('\n')
+	}
+	return buffer.Bytes(), nil
+}
+
+// fetchMetrics returns the expvar metrics of the collector serving them at addr, except
+// "cmdline", which may contain credentials
+func fetchMetrics(ctx context.Context, addr string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/debug/vars", nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", response.Status)
+	}
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	var metrics map[string]json.RawMessage
+	err = json.Unmarshal(data, &metrics)
+	if err != nil {
+		return nil, err
+	}
+	delete(metrics, "cmdline")
+	return json.MarshalIndent(metrics, "", "  ")
+}
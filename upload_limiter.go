@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// uploadLimiter is a token bucket that spreads bursts of uploads, e.g. by idle timeouts,
+// over time (-upload-rate and -upload-burst). No upload is delayed more than maxDelay.
+type uploadLimiter struct {
+	mutex sync.Mutex
+	// the interval to add a token
+	interval time.Duration
+	// the capacity of the bucket
+	burst int
+	// the max delay of an upload, beyond which the rate is exceeded
+	maxDelay time.Duration
+	// the time when the next token is available
+	next time.Time
+}
+
+func newUploadLimiter(rate float64, burst int, maxDelay time.Duration) *uploadLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &uploadLimiter{
+		interval: time.Duration(float64(time.Second) / rate),
+		burst:    burst,
+		maxDelay: maxDelay,
+	}
+}
+
+// wait blocks until a token is available. It does nothing if limiter is nil.
+func (limiter *uploadLimiter) wait(ctx context.Context) {
+	if limiter == nil {
+		return
+	}
+
+	delay := limiter.reserve(now())
+	if delay > 0 {
+		metricUploadsDelayed.Add(1)
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// reserve takes a token at currentTime, and returns the delay until it is available
+func (limiter *uploadLimiter) reserve(currentTime time.Time) time.Duration {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	// tokens don't accumulate beyond the burst
+	if full := currentTime.Add(-time.Duration(limiter.burst-1) * limiter.interval); limiter.next.Before(full) {
+		limiter.next = full
+	}
+	delay := limiter.next.Sub(currentTime)
+	if delay > limiter.maxDelay {
+		// the uploads beyond the rate don't delay the following ones, so that the bucket drains
+		// once the burst ends
+		delay = limiter.maxDelay
+		limiter.next = currentTime.Add(limiter.maxDelay)
+	}
+	limiter.next = limiter.next.Add(limiter.interval)
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUploadLimiter(t *testing.T) {
+	// a token per 100ms, up to 2 tokens, and delays up to 1s
+	type upload struct {
+		at   time.Duration
+		want time.Duration
+	}
+	tests := []struct {
+		name    string
+		uploads []upload
+	}{
+		{
+			name:    "within the burst",
+			uploads: []upload{{0, 0}, {0, 0}},
+		},
+		{
+			name:    "beyond the burst",
+			uploads: []upload{{0, 0}, {0, 0}, {0, 100 * time.Millisecond}, {0, 200 * time.Millisecond}},
+		},
+		{
+			name:    "refilled",
+			uploads: []upload{{0, 0}, {0, 0}, {0, 100 * time.Millisecond}, {time.Second, 0}, {time.Second, 0}, {time.Second, 100 * time.Millisecond}},
+		},
+		{
+			name: "burst capped by the max delay followed by idle traffic",
+			uploads: func() []upload {
+				uploads := []upload{{0, 0}, {0, 0}}
+				for i := 1; i <= 100; i++ {
+					want := time.Duration(i) * 100 * time.Millisecond
+					if want > time.Second {
+						want = time.Second
+					}
+					uploads = append(uploads, upload{0, want})
+				}
+				// the delays of 10s for the burst are not owed after it
+				return append(uploads, upload{1500 * time.Millisecond, 0}, upload{5 * time.Second, 0}, upload{5 * time.Second, 0})
+			}(),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := newUploadLimiter(10, 2, time.Second)
+			start := time.Unix(1618988758, 0)
+			for i, upload := range test.uploads {
+				if delay := limiter.reserve(start.Add(upload.at)); delay != upload.want {
+					t.Errorf("upload %d at %v is delayed by %v, want %v", i, upload.at, delay, upload.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNilUploadLimiter(t *testing.T) {
+	var limiter *uploadLimiter
+	// nil-safe
+	limiter.wait(context.Background())
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+type orderedEntry struct {
+	entry    *logEntry
+	queuedAt time.Time
+}
+
+// a min-heap of entries ordered by endTime
+type orderedEntries []orderedEntry
+
+func (entries orderedEntries) Len() int { return len(entries) }
+func (entries orderedEntries) Less(i, j int) bool {
+	return entries[i].entry.endTime.Before(entries[j].entry.endTime)
+}
+func (entries orderedEntries) Swap(i, j int) { entries[i], entries[j] = entries[j], entries[i] }
+
+func (entries *orderedEntries) Push(x interface{}) {
+	*entries = append(*entries, x.(orderedEntry))
+}
+
+func (entries *orderedEntries) Pop() interface{} {
+	old := *entries
+	n := len(old)
+	x := old[n-1]
+	*entries = old[:n-1]
+	return x
+}
+
+// uploadOrderBuffer delays finalized entries and releases them in the order of endTime,
+// so that consumers see connections roughly in chronological order.
+type uploadOrderBuffer struct {
+	mutex   sync.Mutex
+	entries orderedEntries
+	// the max number of entries to hold
+	maxSize int
+	// the max duration for which an entry is held
+	maxDelay time.Duration
+	upload   func(entry *logEntry)
+
+	done    chan struct{}
+	stopped sync.WaitGroup
+}
+
+func newUploadOrderBuffer(maxSize int, maxDelay time.Duration, upload func(entry *logEntry)) *uploadOrderBuffer {
+	buffer := &uploadOrderBuffer{
+		entries:  make(orderedEntries, 0, maxSize+1),
+		maxSize:  maxSize,
+		maxDelay: maxDelay,
+		upload:   upload,
+		done:     make(chan struct{}),
+	}
+
+	buffer.stopped.Add(1)
+	go func() {
+		defer buffer.stopped.Done()
+		ticker := time.NewTicker(buffer.maxDelay / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				buffer.releaseExpired(time.Now())
+			case <-buffer.done:
+				return
+			}
+		}
+	}()
+	return buffer
+}
+
+func (buffer *uploadOrderBuffer) add(entry *logEntry) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	heap.Push(&buffer.entries, orderedEntry{entry: entry, queuedAt: time.Now()})
+	for buffer.entries.Len() > buffer.maxSize {
+		buffer.upload(heap.Pop(&buffer.entries).(orderedEntry).entry)
+	}
+}
+
+// releaseExpired releases entries held longer than maxDelay, together with the ones that ended before them
+func (buffer *uploadOrderBuffer) releaseExpired(now time.Time) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	var until time.Time
+	for _, item := range buffer.entries {
+		if now.Sub(item.queuedAt) >= buffer.maxDelay && item.entry.endTime.After(until) {
+			until = item.entry.endTime
+		}
+	}
+	if until.IsZero() {
+		return
+	}
+	for buffer.entries.Len() > 0 && !buffer.entries[0].entry.endTime.After(until) {
+		buffer.upload(heap.Pop(&buffer.entries).(orderedEntry).entry)
+	}
+}
+
+// flush stops the buffer and releases all the entries
+func (buffer *uploadOrderBuffer) flush() {
+	close(buffer.done)
+	buffer.stopped.Wait()
+
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	for buffer.entries.Len() > 0 {
+		buffer.upload(heap.Pop(&buffer.entries).(orderedEntry).entry)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+type uploadJob struct {
+	ctx     context.Context
+	latch   *sync.WaitGroup
+	storage *storageManager
+	entry   *logEntry
+	// an upload other than of a connection, e.g. of global events, run instead of entry
+	upload func()
+}
+
+// run uploads the job, marking it done in latch
+func (job uploadJob) run() {
+	if job.upload != nil {
+		defer job.latch.Done()
+		job.upload()
+		return
+	}
+	uploadEvents(job.ctx, job.latch, job.storage, job.entry)
+}
+
+// the queue of uploadWorkers, or nil if the number of uploads is unbounded
+var uploadQueue chan uploadJob
+
+// startUploadWorkers starts n workers (-upload-concurrency). The queue has as many slots as
+// the workers, so that a burst of connections blocks the reader rather than piling up uploads.
+func startUploadWorkers(n int) {
+	uploadQueue = make(chan uploadJob, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			for job := range uploadQueue {
+				uploadLimit.wait(job.ctx)
+				job.run()
+			}
+		}()
+	}
+}
+
+// startBackgroundUpload runs the upload other than of a connection in the same way as
+// startUpload, so that it is bounded by -upload-concurrency and -upload-rate as well
+func startBackgroundUpload(ctx context.Context, latch *sync.WaitGroup, upload func()) {
+	latch.Add(1)
+	job := uploadJob{ctx: ctx, latch: latch, upload: upload}
+	if deterministic {
+		job.run()
+	} else if uploadQueue != nil {
+		select {
+		case uploadQueue <- job:
+		case <-ctx.Done():
+			job.run()
+		}
+	} else {
+		go func() {
+			uploadLimit.wait(ctx)
+			job.run()
+		}()
+	}
+}